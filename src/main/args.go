@@ -12,7 +12,7 @@ import (
 	"os"
 )
 
-const helpMessage = "Usage: main --help | -f conf-file [start | stop]\nWhen 'start' will start it as a daemon process, 'stop' will stop the daemon\nIf no 'start' provided, then it will start as normal process"
+const helpMessage = "Usage: main --help | -f conf-file [start | stop | reload]\nWhen 'start' will start it as a daemon process, 'stop' will stop the daemon, 'reload' makes the daemon re-read its conf file\nIf no 'start' provided, then it will start as normal process"
 
 // Args holds all the commandline parameters
 type Args struct {
@@ -52,6 +52,9 @@ func parseArgs() (*Args, string) {
 		case "stop":
 			arg.args["cmd"] = "stop"
 			break
+		case "reload":
+			arg.args["cmd"] = "reload"
+			break
 		case "daemon":
 			arg.args["cmd"] = "daemon"
 			break
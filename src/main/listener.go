@@ -0,0 +1,149 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"socks/config"
+	"strconv"
+)
+
+// listen opens the listener described by conf
+func listen(conf *config.ListenerConf) (net.Listener, error) {
+
+	switch conf.Transport {
+	case "unix":
+		removeStaleSocket(conf.Address)
+		return net.Listen("unix", conf.Address)
+	case "tls":
+		tlsConfig, err := newTLSConfig(conf)
+		if err != nil {
+			return nil, err
+		}
+		return tls.Listen("tcp", listenerAddress(conf), tlsConfig)
+	case "":
+		return net.Listen("tcp", listenerAddress(conf))
+	}
+
+	return net.Listen(conf.Transport, listenerAddress(conf))
+}
+
+// listenerAddress returns the host:port of a TCP based listener
+func listenerAddress(conf *config.ListenerConf) string {
+	return net.JoinHostPort(conf.Address, strconv.Itoa(conf.Listen))
+}
+
+// listenerName names a listener in the logs
+func listenerName(conf *config.ListenerConf) string {
+
+	if len(conf.Name) != 0 {
+		return conf.Name
+	}
+
+	if conf.Transport == "unix" {
+		return conf.Address
+	}
+
+	return listenerAddress(conf)
+}
+
+// sameListener tells whether a and b describe the same socket
+func sameListener(a *config.ListenerConf, b *config.ListenerConf) bool {
+	return (a.Transport == b.Transport) && (a.Address == b.Address) && (a.Listen == b.Listen)
+}
+
+// TLS versions accepted as minVersion
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig loads the certificate of a TLS listener, and the CA bundle
+// client certificates are verified against
+func newTLSConfig(conf *config.ListenerConf) (*tls.Config, error) {
+
+	certificate, err := tls.LoadX509KeyPair(conf.Certificate, conf.Key)
+	if err != nil {
+		return nil, errors.New("Loading certificate: " + err.Error())
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tlsVersions[conf.MinVersion]}
+
+	if len(conf.ClientCa) == 0 {
+		return tlsConfig, nil
+	}
+
+	bundle, err := ioutil.ReadFile(conf.ClientCa)
+	if err != nil {
+		return nil, errors.New("Loading client CA: " + err.Error())
+	}
+
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("Loading client CA: no certificate found in " + conf.ClientCa)
+	}
+
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if conf.ClientAuth == "optional" {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return tlsConfig, nil
+}
+
+// handshakeTLS completes the TLS handshake of conn and returns the
+// identity of its verified client certificate, empty when the listener
+// doesn't take it or there is none
+func handshakeTLS(conn *tls.Conn, conf *config.ListenerConf) (string, error) {
+
+	err := conn.Handshake()
+	if err != nil {
+		return "", err
+	}
+
+	chains := conn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", nil
+	}
+
+	switch conf.Identity {
+	case "cn":
+		return chains[0][0].Subject.CommonName, nil
+	case "subject":
+		return chains[0][0].Subject.String(), nil
+	}
+
+	return "", nil
+}
+
+// removeStaleSocket removes a socket file left by a previous run. A
+// socket still served, or any other kind of file, is kept and makes the
+// listen fail.
+func removeStaleSocket(path string) {
+
+	info, err := os.Lstat(path)
+	if err != nil || (info.Mode()&os.ModeSocket) == 0 {
+		return
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+
+	os.Remove(path)
+}
@@ -10,15 +10,18 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
+	"socks/access"
 	"socks/config"
 	"socks/log"
 	"strconv"
 	"syscall"
+	"time"
 )
 
 var pidFile = "/tmp/socks5.pid"
@@ -43,6 +46,9 @@ func main() {
 	case "stop":
 		stopDaemon(args)
 		break
+	case "reload":
+		reloadDaemon(args)
+		break
 	default:
 		start(args)
 		break
@@ -51,25 +57,13 @@ func main() {
 
 func daemonize(args *Args) {
 
-	// Remove pid file upon receiving signal SIGTERM
-	channel := make(chan os.Signal, 1)
-	signal.Notify(channel, os.Interrupt, os.Kill, syscall.SIGTERM)
-
-	// watcher on SIGTERM signal
-	go func() {
-		signalType := <-channel
-		signal.Stop(channel)
-
-		fmt.Printf("Received signal: %v. Exiting...\n", signalType)
-
-		// remove pid file
-		os.Remove(pidFile)
+	// start the server, it returns once shut down by a signal
+	var status bool = start(args)
 
-		os.Exit(0)
-	}()
+	// remove pid file
+	os.Remove(pidFile)
 
-	// start the server
-	if start(args) != true {
+	if status != true {
 		os.Exit(1)
 	}
 }
@@ -110,9 +104,41 @@ func startDaemon(args *Args) {
 
 func stopDaemon(args *Args) {
 
-	// when received the 'stop', check if pid file exists first
+	// Find the daemon process
+	process, pid := findDaemon(args)
+
+	fmt.Printf("Shutdown the daemon '%s' with pid: [%v] ...\n", args.Get("self"), pid)
+
+	// ask the daemon to shutdown gracefully
+	err := process.Signal(syscall.SIGTERM)
+
+	// Any error?
+	if err != nil {
+		fmt.Printf("Unable to shutdown daemon: '%s'(pid: %v) with error %v\n", args.Get("self"), pid, err)
+		os.Exit(1)
+	}
+
+	// wait for the daemon to drain its sessions and exit
+	for process.Signal(syscall.Signal(0)) == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// remove PID file, in case the daemon didn't
+	os.Remove(pidFile)
+
+	fmt.Printf("Daemon (pid: %v) shutdown successfully\n", pid)
+
+	// Exit
+	os.Exit(0)
+}
+
+// findDaemon reads the pid file and finds the daemon process,
+// exits when the daemon is not running
+func findDaemon(args *Args) (*os.Process, int) {
+
+	// check if pid file exists first
 	// if it exists, read pid from file
-	// then trying to stop the process.
+	// then find the process.
 	_, err := os.Stat(pidFile)
 
 	// pid file exists?
@@ -144,21 +170,24 @@ func stopDaemon(args *Args) {
 		os.Exit(1)
 	}
 
-	// remove PID file
-	os.Remove(pidFile)
+	return process, pid
+}
 
-	fmt.Printf("Shutdown the daemon '%s' with pid: [%v] ...\n", args.Get("self"), pid)
+func reloadDaemon(args *Args) {
 
-	// kill process and exit immediately
-	err = process.Kill()
+	// Find the daemon process
+	process, pid := findDaemon(args)
+
+	// ask the daemon to reload its conf file
+	err := process.Signal(syscall.SIGHUP)
 
 	// Any error?
 	if err != nil {
-		fmt.Printf("Unable to shutdown daemon: '%s'(pid: %v) with error %v\n", args.Get("self"), pid, err)
+		fmt.Printf("Unable to reload daemon: '%s'(pid: %v) with error %v\n", args.Get("self"), pid, err)
 		os.Exit(1)
 	}
 
-	fmt.Printf("Daemon (pid: %v) shutdown successfully\n", pid)
+	fmt.Printf("Daemon (pid: %v) asked to reload its config, check the log for the result\n", pid)
 
 	// Exit
 	os.Exit(0)
@@ -195,16 +224,74 @@ func start(args *Args) bool {
 	log.SetLevel(log.Level(config.Log.Level))
 	log.SetOutput(config.Log.Path)
 
+	// Refuse to start with an invalid config
+	if err := validate(config); err != nil {
+		log.Errorf("Invalid config: %s\n", err.Error())
+		return false
+	}
+
 	// create a server instance
 	server := New(config)
+	done := make(chan bool)
 
 	log.Infof("Socks5 server is starting....\n")
 
+	// Shutdown gracefully upon SIGTERM or SIGINT
+	channel := make(chan os.Signal, 1)
+	signal.Notify(channel, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		signalType := <-channel
+		signal.Stop(channel)
+
+		log.Infof("Received signal: %v. Shutting down...\n", signalType)
+
+		ctx, cancel := context.WithTimeout(context.Background(), server.Config().Server.DrainTimeout())
+		defer cancel()
+
+		server.Shutdown(ctx)
+		close(done)
+	}()
+
+	// Reload the config upon SIGHUP, the access logs are reopened for
+	// logrotate
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	go func() {
+		for range reload {
+			log.Infof("Received signal: SIGHUP. Reloading config...\n")
+
+			access.Reopen()
+
+			if err := server.Reload(); err != nil {
+				log.Errorf("Config reload rejected, keeping the current config: %s\n", err.Error())
+			}
+
+			server.LogStats()
+		}
+	}()
+
+	// Log the counters upon SIGUSR1, where there is one
+	if len(statsSignals) != 0 {
+		stats := make(chan os.Signal, 1)
+		signal.Notify(stats, statsSignals...)
+
+		go func() {
+			for range stats {
+				server.LogStats()
+			}
+		}()
+	}
+
 	// Start the server
 	if server.Start() != true {
 		log.Errorf("Statring socks failed\n")
 		return false
 	}
 
+	// wait for the sessions to drain
+	<-done
+
 	return true
 }
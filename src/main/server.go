@@ -8,34 +8,237 @@
 package main
 
 import (
+	gocontext "context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"socks"
+	"socks/access"
+	"socks/acl"
+	"socks/authentication"
+	"socks/command"
 	"socks/config"
 	"socks/context"
+	"socks/limit"
 	"socks/log"
+	"socks/quota"
+	"socks/resolver"
 	"socks/session"
+	"socks/shaping"
+	"socks/upstream"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// How long a refused client gets to send its greeting before the
+// failure reply
+const rejectTimeout = 5 * time.Second
+
+// How long the sessions closed at the shutdown deadline get to finish
+const closeTimeout = 2 * time.Second
+
+// How many refused clients may wait for their failure reply at once,
+// the ones over it are closed right away
+const maxRejects = 256
+
+// Slots of the refused clients waiting for their failure reply
+var rejects = make(chan bool, maxRejects)
+
 // Server hodls the context for server
 type Server struct {
-	config *config.Config
+	config      atomic.Value
+	listeners   []net.Listener
+	mutex       sync.Mutex
+	closing     bool
+	connections map[net.Conn]bool
+	waiter      sync.WaitGroup
+	// Sessions running on each config, an old config's compiled state
+	// is dropped when its count reaches 0
+	refs map[*config.Config]int
 }
 
 // New method: create a new instance of Server
-func New(config *config.Config) *Server {
-	return &Server{config: config}
+func New(conf *config.Config) *Server {
+
+	server := &Server{connections: make(map[net.Conn]bool), refs: make(map[*config.Config]int)}
+	server.config.Store(conf)
+
+	return server
 }
 
-// Start method: start the server
-func (server *Server) Start() bool {
+// Config method: returns the current config, sessions keep the config
+// they started with
+func (server *Server) Config() *config.Config {
+	return server.config.Load().(*config.Config)
+}
 
-	listener, err := net.Listen(server.config.Server.Protocol, net.JoinHostPort(server.config.Server.Address, strconv.Itoa(server.config.Server.Listen)))
+// Reload method: re-read and validate the conf file, then swap it in.
+// On any error the current config is kept.
+func (server *Server) Reload() error {
 
+	current := server.Config()
+
+	if len(current.Path) == 0 {
+		return errors.New("No conf file to reload, running with the default config")
+	}
+
+	conf, err := config.Load(current.Path)
 	if err != nil {
-		log.Errorf("Error : %s", err)
+		return err
+	}
+
+	err = validate(conf)
+	if err != nil {
+		return err
+	}
+
+	// The listeners are not re-created
+	if !sameListeners(conf.ListenerConfs(), current.ListenerConfs()) {
+		log.Warnf("Listener addresses changed, they take effect after a restart\n")
+	}
+
+	// Neither is the quota file
+	if conf.Quota.Path != current.Quota.Path {
+		log.Warnf("Quota file changed, it takes effect after a restart\n")
+	}
+
+	server.mutex.Lock()
+	previous := server.Config()
+	server.config.Store(conf)
+	swap(conf)
+	// The compiled state of the previous config goes with its last session
+	if server.refs[previous] == 0 {
+		drop(previous)
+	}
+	server.mutex.Unlock()
+
+	// Apply the log settings
+	log.SetLevel(log.Level(conf.Log.Level))
+	if conf.Log.Path != current.Log.Path {
+		log.SetOutput(conf.Log.Path)
+	}
+
+	log.Infof("Config reloaded from %s\n", conf.Path)
+
+	return nil
+}
+
+// hold returns the current config, counted as in use until release
+func (server *Server) hold() *config.Config {
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	conf := server.Config()
+	server.refs[conf]++
+
+	return conf
+}
+
+// release ends a use of conf, an old config is dropped after its last
+func (server *Server) release(conf *config.Config) {
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.refs[conf]--
+	if server.refs[conf] > 0 {
+		return
+	}
+
+	delete(server.refs, conf)
+	if conf != server.Config() {
+		drop(conf)
+	}
+}
+
+// swap makes conf the current config of the packages carrying state
+// over a reload: the shaping buckets and the DNS cache
+func swap(conf *config.Config) {
+
+	shaping.Swap(&conf.Shaping)
+	resolver.Swap(&conf.Resolver)
+}
+
+// drop forgets what was compiled for conf, once no session runs on it
+func drop(conf *config.Config) {
+
+	acls := []*config.AclConf{&conf.Acl}
+	for _, profile := range conf.Acls {
+		acls = append(acls, profile)
+	}
+
+	acl.Drop(acls...)
+	upstream.Drop(&conf.Upstream)
+	upstream.DropOutbound(&conf.Outbound)
+	resolver.Drop(&conf.Resolver)
+	shaping.Drop(&conf.Shaping)
+	access.Drop(&conf.Access)
+}
+
+// Start method: open all the listeners and serve them until Shutdown.
+// Returns false when a listener can't be opened.
+func (server *Server) Start() bool {
+
+	confs := server.Config().ListenerConfs()
+
+	// The traffic counters saved by the previous run
+	if err := quota.Start(&server.Config().Quota); err != nil {
+		log.Errorf("Error : %s\n", err.Error())
 		return false
 	}
 
+	var listeners []net.Listener
+
+	for index := range confs {
+		listener, err := listen(&confs[index])
+		if err != nil {
+			log.Errorf("Error : %s: %s\n", listenerName(&confs[index]), err)
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			quota.Stop()
+			return false
+		}
+		log.Infof("Listening on %s (%s)\n", listenerName(&confs[index]), listener.Addr().Network())
+		listeners = append(listeners, listener)
+	}
+
+	server.mutex.Lock()
+	if server.closing {
+		server.mutex.Unlock()
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		return true
+	}
+	server.listeners = listeners
+	server.mutex.Unlock()
+
+	var waiter sync.WaitGroup
+
+	for index, listener := range listeners {
+		waiter.Add(1)
+		go func(index int, listener net.Listener) {
+			defer waiter.Done()
+			server.serve(index, confs[index], listener)
+		}(index, listener)
+	}
+
+	waiter.Wait()
+
+	log.Infof("Stopped accepting incoming connections\n")
+
+	return true
+}
+
+// serve accepts the connections of one listener until it is closed.
+// conf is the listener's settings at start, the current config's ones
+// are used as long as they describe the same socket.
+func (server *Server) serve(index int, conf config.ListenerConf, listener net.Listener) {
+
 	// Start to accept incoming connections
 	for {
 
@@ -44,6 +247,11 @@ func (server *Server) Start() bool {
 
 		if err != nil {
 
+			// The listener is closed by Shutdown
+			if server.isClosing() {
+				return
+			}
+
 			log.Errorf("Error in accepting incoming connection: %s\n", err.Error())
 			continue
 		}
@@ -54,25 +262,197 @@ func (server *Server) Start() bool {
 			continue
 		}
 
+		settings := conf
+		if current := server.Config().ListenerConfs(); (index < len(current)) && sameListener(&current[index], &conf) {
+			settings = current[index]
+		}
+
+		// Admission control, the current limits apply. The session runs
+		// with the config it started with.
+		current := server.hold()
+		if !limit.Accept(&current.Limits) {
+			refuse(connection, current, &settings, &limit.RefusedError{Limit: limit.REFUSED_RATE})
+			server.release(current)
+			continue
+		}
+
+		client := clientAddress(connection)
+		if err := limit.Admit(&current.Limits, client); err != nil {
+			refuse(connection, current, &settings, err)
+			server.release(current)
+			continue
+		}
+
+		// Track the connection, refused when shutting down
+		if !server.track(connection) {
+			limit.Release(client)
+			connection.Close()
+			server.release(current)
+			continue
+		}
+
 		// Handle the incoming connections.
-		go server.handleIncoming(connection)
+		go server.handleIncoming(connection, current, client, &settings)
 	}
 }
 
-func (server *Server) handleIncoming(conn net.Conn) {
+// Shutdown method: stop accepting new connections and wait for the
+// sessions in flight to finish. When ctx expires first the remaining
+// sessions are closed and ctx's error is returned.
+func (server *Server) Shutdown(ctx gocontext.Context) error {
+
+	server.mutex.Lock()
+	if server.closing {
+		server.mutex.Unlock()
+		return errors.New("Server is already shutting down")
+	}
+	server.closing = true
+	for _, listener := range server.listeners {
+		listener.Close()
+	}
+	server.mutex.Unlock()
+
+	log.Infof("Shutting down, waiting for %d sessions\n", server.sessions())
+
+	server.LogStats()
+
+	done := make(chan bool)
+	go func() {
+		server.waiter.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Infof("All sessions finished\n")
+		// The traffic counters are saved once the sessions are over
+		quota.Stop()
+		return nil
+	case <-ctx.Done():
+	}
+
+	// Deadline reached, force the rest to close
+	server.mutex.Lock()
+	log.Warnf("Shutdown deadline reached, closing %d sessions\n", len(server.connections))
+	for connection := range server.connections {
+		connection.Close()
+	}
+	server.mutex.Unlock()
+
+	// Give the closed sessions a moment to count their last bytes
+	select {
+	case <-done:
+	case <-time.After(closeTimeout):
+		log.Warnf("Sessions still closing, saving the traffic counters without them\n")
+	}
+	quota.Stop()
+
+	return ctx.Err()
+}
+
+// LogStats method: log the sessions in flight and the counters of what
+// was refused or dropped since the start
+func (server *Server) LogStats() {
+
+	log.Infof("Sessions: %d\n", server.sessions())
+
+	rate, sessions, clients, users := limit.Stats()
+	log.Infof("Refused connections: %d over the accept rate, %d over the session limit, %d over the client limit, %d over the user limit\n", rate, sessions, clients, users)
+
+	outOfOrder, expired, overflow := command.FragmentStats()
+	log.Infof("UDP fragments dropped: %d out of order, %d timed out, %d over the queue size\n", outOfOrder, expired, overflow)
+}
+
+func (server *Server) isClosing() bool {
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.closing
+}
+
+func (server *Server) sessions() int {
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return len(server.connections)
+}
+
+func (server *Server) track(conn net.Conn) bool {
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	if server.closing {
+		return false
+	}
+
+	server.connections[conn] = true
+	server.waiter.Add(1)
+
+	return true
+}
+
+func (server *Server) untrack(conn net.Conn) {
+
+	server.mutex.Lock()
+	delete(server.connections, conn)
+	server.mutex.Unlock()
+
+	server.waiter.Done()
+}
+
+// handleIncoming runs the session of an admitted connection on conf,
+// client is the source address it is counted under
+func (server *Server) handleIncoming(conn net.Conn, conf *config.Config, client string, listener *config.ListenerConf) {
+
+	defer server.untrack(conn)
+	defer server.release(conf)
+	defer limit.Release(client)
 
 	log.Infof("Incomming: %s, Remote Addr: %s\n", conn.LocalAddr().Network(), conn.RemoteAddr().String())
 
+	// One access log record per session, written when it ends
+	record := newRecord(conn, listener)
+	defer writeRecord(conf, record)
+
+	// The handshake has to finish in time, TLS included
+	if timeout := conf.Timeouts.HandshakeTimeout(); timeout != 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	// TLS first, the client certificate may give the identity
+	var identity string
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		var err error
+		identity, err = handshakeTLS(tlsConn, listener)
+		if err != nil {
+			log.Errorf("TLS handshake with %s failed: %s\n", conn.RemoteAddr().String(), err.Error())
+			record.End(access.REASON_TLS, err)
+			conn.Close()
+			return
+		}
+	}
+
 	// create the context
-	contxt, err := context.New(conn, server.config)
+	contxt, err := context.New(conn, conf, listener)
 
 	// Check the context is valid
 	if contxt == nil {
 		log.Errorf("error during create Context: %s\n", err.Error())
+		record.End(access.REASON_HANDSHAKE, err)
 		conn.Close()
 		return
 	}
 
+	contxt.SetRecord(record)
+
+	if len(identity) != 0 {
+		contxt.SetUsername(identity)
+		log.Infof("Client certificate identity: %s\n", identity)
+	}
+
 	log.Infof("Context created, version: %d\n", contxt.Version())
 
 	// create a session
@@ -86,6 +466,209 @@ func (server *Server) handleIncoming(conn net.Conn) {
 		log.Errorf("Session create failed: %s\n", err.Error())
 	}
 
+	if user := contxt.Username(); len(user) != 0 {
+		record.User = user
+	}
+
 	// Done
 	conn.Close()
 }
+
+// refuse drops a connection over the limits, with a SOCKS failure reply
+// when configured
+func refuse(conn net.Conn, conf *config.Config, listener *config.ListenerConf, err error) {
+
+	log.Warnf("Refused %s: %s\n", conn.RemoteAddr().String(), err.Error())
+
+	record := newRecord(conn, listener)
+	record.End(access.REASON_REFUSED, err)
+	writeRecord(conf, record)
+
+	// No TLS handshake for a refused client, that is the cost to avoid
+	if _, ok := conn.(*tls.Conn); ok || !conf.Limits.Reply {
+		conn.Close()
+		return
+	}
+
+	// A flood of refused clients doesn't get a goroutine each
+	select {
+	case rejects <- true:
+		go func() {
+			defer func() { <-rejects }()
+			reject(conn)
+		}()
+	default:
+		conn.Close()
+	}
+}
+
+// reject reads the client's greeting and answers it with a failure:
+// no acceptable method for SOCKS 5, request rejected for SOCKS 4. The
+// greeting is read first so that closing doesn't reset the reply away.
+func reject(conn net.Conn) {
+
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+
+	buffer := make([]byte, 512)
+	count, err := conn.Read(buffer)
+	if (err != nil) || (count == 0) {
+		return
+	}
+
+	switch buffer[0] {
+	case socks.SOCKS_VERSION_V5:
+		conn.Write([]byte{socks.SOCKS_VERSION_V5, socks.SOCKS_AUTH_NOACCEPTABLE})
+	case socks.SOCKS_VERSION_V4:
+		conn.Write([]byte{socks.SOCKS_V4_REPLY_VERSION, socks.SOCKS_V4_STATUS_REJECTED, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+// newRecord starts the access log record of a connection
+func newRecord(conn net.Conn, listener *config.ListenerConf) *access.Record {
+
+	record := access.NewRecord()
+	record.Client = conn.RemoteAddr().String()
+	record.Listener = listenerName(listener)
+
+	return record
+}
+
+// writeRecord ends the record and appends it to the access log
+func writeRecord(conf *config.Config, record *access.Record) {
+
+	record.Duration = time.Since(record.Time)
+	record.End(access.REASON_CLOSED, nil)
+
+	access.Get(&conf.Access).Write(record)
+}
+
+// clientAddress is the source address sessions are counted under, empty
+// for unix socket clients
+func clientAddress(conn net.Conn) string {
+
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+
+	return ""
+}
+
+// validate the whole config, each section by the package using it
+func validate(conf *config.Config) error {
+
+	err := conf.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = authentication.CheckMethods(conf.Auth.Methods)
+	if err != nil {
+		return errors.New("auth.methods: " + err.Error())
+	}
+
+	err = authentication.CheckMethods(conf.Server.Methods)
+	if err != nil {
+		return errors.New("server.methods: " + err.Error())
+	}
+
+	for index, listener := range conf.Listeners {
+		err = authentication.CheckMethods(listener.Methods)
+		if err != nil {
+			return errors.New("listeners[" + strconv.Itoa(index) + "].methods: " + err.Error())
+		}
+		if listener.Transport == "tls" {
+			_, err = newTLSConfig(&listener)
+			if err != nil {
+				return errors.New("listeners[" + strconv.Itoa(index) + "]: " + err.Error())
+			}
+		}
+	}
+
+	_, err = acl.New(&conf.Acl)
+	if err != nil {
+		return errors.New("acl: " + err.Error())
+	}
+
+	for name, profile := range conf.Acls {
+		if profile == nil {
+			return errors.New("acls." + name + ": empty profile")
+		}
+		_, err = acl.New(profile)
+		if err != nil {
+			return errors.New("acls." + name + ": " + err.Error())
+		}
+	}
+
+	_, err = upstream.New(&conf.Upstream)
+	if err != nil {
+		return errors.New("upstream: " + err.Error())
+	}
+
+	outbound, err := upstream.NewOutbound(&conf.Outbound)
+	if err != nil {
+		return errors.New("outbound: " + err.Error())
+	}
+
+	err = outbound.Check(conf.Server.Egress)
+	if err != nil {
+		return errors.New("server.egress: " + err.Error())
+	}
+
+	for index, listener := range conf.Listeners {
+		err = outbound.Check(listener.Egress)
+		if err != nil {
+			return errors.New("listeners[" + strconv.Itoa(index) + "].egress: " + err.Error())
+		}
+	}
+
+	for index, rule := range conf.Acl.Rules {
+		err = outbound.Check(rule.Egress)
+		if err != nil {
+			return errors.New("acl: rule " + strconv.Itoa(index+1) + ": " + err.Error())
+		}
+	}
+
+	for name, profile := range conf.Acls {
+		for index, rule := range profile.Rules {
+			err = outbound.Check(rule.Egress)
+			if err != nil {
+				return errors.New("acls." + name + ": rule " + strconv.Itoa(index+1) + ": " + err.Error())
+			}
+		}
+	}
+
+	_, err = resolver.New(&conf.Resolver)
+	if err != nil {
+		return errors.New("resolver: " + err.Error())
+	}
+
+	_, err = shaping.New(&conf.Shaping)
+	if err != nil {
+		return errors.New("shaping: " + err.Error())
+	}
+
+	_, err = access.New(&conf.Access)
+	if err != nil {
+		return errors.New("access: " + err.Error())
+	}
+
+	return nil
+}
+
+// sameListeners tells whether both lists open the same sockets
+func sameListeners(a []config.ListenerConf, b []config.ListenerConf) bool {
+
+	if len(a) != len(b) {
+		return false
+	}
+
+	for index := range a {
+		if !sameListener(&a[index], &b[index]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,17 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+//go:build windows
+
+package main
+
+import (
+	"os"
+)
+
+// No SIGUSR1, the counters are logged on reload and shutdown only
+var statsSignals = []os.Signal{}
@@ -0,0 +1,18 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// The signals asking for the counters in the log
+var statsSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,331 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package access
+
+import (
+        "bytes"
+        "encoding/json"
+        "errors"
+        "os"
+        "strings"
+        "sync"
+        "text/template"
+        "time"
+        "socks/log"
+        "socks/config"
+)
+
+const (
+        FORMAT_JSON		= "json"
+        FORMAT_TEXT		= "text"
+)
+
+// The line of the text format when the config has no template
+const DEFAULT_TEMPLATE = `{{.Time.Format "2006-01-02T15:04:05.000Z07:00"}} {{.Client}} {{or .Listener "-"}} {{or .Method "-"}} {{or .User "-"}} {{or .Command "-"}} {{or .Destination "-"}} {{or .Resolved "-"}} {{.Reply}} {{.Up}} {{.Down}} {{.Duration}} {{.Reason}}`
+
+// Reply of a session that didn't send one
+const NO_REPLY = -1
+
+// Why a session ended
+const (
+        REASON_TLS		= "tls handshake failed"
+        REASON_HANDSHAKE	= "handshake failed"
+        REASON_REQUEST	= "bad request"
+        REASON_REFUSED	= "refused"
+        REASON_QUOTA		= "over quota"
+        REASON_DENIED	= "denied"
+        REASON_DIAL		= "dial failed"
+        REASON_FAILED	= "failed"
+        REASON_CLIENT	= "client closed"
+        REASON_TARGET	= "target closed"
+        REASON_IDLE		= "idle timeout"
+        REASON_CLOSED	= "closed by server"
+        REASON_ERROR		= "error"
+)
+
+// One finished session. Time is when it started, User the authenticated
+// user or the unverified USERID of a Socks V4 request, Reply the last
+// reply code sent to the client, Up and Down the bytes relayed each way.
+// Reason tells why it ended, Error the error behind it if any.
+type Record struct {
+    Time			time.Time
+    Client		string
+    Listener		string
+    Method		string
+    User			string
+    Command		string
+    Destination	string
+    Resolved		string
+    Reply		int
+    Up			int64
+    Down			int64
+    Duration		time.Duration
+    Reason		string
+    Error		string
+}
+
+// The JSON line of a record
+type jsonRecord struct {
+    Time			string		`json:"time"`
+    Client		string		`json:"client"`
+    Listener		string		`json:"listener,omitempty"`
+    Method		string		`json:"method,omitempty"`
+    User			string		`json:"user,omitempty"`
+    Command		string		`json:"command,omitempty"`
+    Destination	string		`json:"destination,omitempty"`
+    Resolved		string		`json:"resolved,omitempty"`
+    Reply		*int			`json:"reply,omitempty"`
+    Up			int64		`json:"up"`
+    Down			int64		`json:"down"`
+    Duration		float64		`json:"duration"`
+    Reason		string		`json:"reason,omitempty"`
+    Error		string		`json:"error,omitempty"`
+}
+
+type Logger struct {
+    format		string
+    template		*template.Template
+    output		*output
+}
+
+// An access log file, shared by the loggers writing to it. refs counts
+// them, the file is closed when the last one is dropped.
+type output struct {
+    path			string
+    file			*os.File
+    refs			int
+    mutex		sync.Mutex
+}
+
+// Compiled loggers, keyed by their config
+var loggers		map[*config.AccessConf]*Logger = make(map[*config.AccessConf]*Logger)
+var loggersLock	sync.Mutex
+
+// Opened files, keyed by their path
+var outputs		map[string]*output = make(map[string]*output)
+
+/*----------------------------------------------------------
+    Create a Logger
+-----------------------------------------------------------*/
+
+// Returns the compiled Logger of the config. Without a path, or when the
+// config doesn't compile, it writes nothing.
+func Get(conf *config.AccessConf) (*Logger) {
+
+    loggersLock.Lock()
+    defer loggersLock.Unlock()
+
+    logger, found := loggers[conf]
+    if (found) {
+        return logger
+    }
+
+    logger, err := New(conf)
+    if (err == nil) {
+        logger.output, err = open(conf.Path)
+    }
+    if (err != nil) {
+        log.Errorf("Invalid access log config, sessions are not logged: %s\n", err.Error())
+        logger = nil
+    }
+
+    loggers[conf] = logger
+
+    return logger
+}
+
+// Drop forgets the compiled logger of conf, it is called once the last
+// session of a config replaced by a reload is over. Its file is closed
+// unless the logger of another config writes to it.
+func Drop(conf *config.AccessConf) {
+
+    loggersLock.Lock()
+    defer loggersLock.Unlock()
+
+    logger := loggers[conf]
+    delete(loggers, conf)
+
+    if ((logger == nil) || (logger.output == nil)) {
+        return
+    }
+
+    logger.output.refs--
+    if (logger.output.refs > 0) {
+        return
+    }
+
+    delete(outputs, logger.output.path)
+
+    logger.output.mutex.Lock()
+    defer logger.output.mutex.Unlock()
+
+    logger.output.file.Close()
+}
+
+// Reopen the files by their path, after logrotate moved them away. A
+// file that can't be opened again is kept.
+func Reopen() {
+
+    loggersLock.Lock()
+    defer loggersLock.Unlock()
+
+    for path, opened := range outputs {
+
+        file, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0640)
+        if (err != nil) {
+            log.Errorf("Access log reopen failed, writing to the old file: %s\n", err.Error())
+            continue
+        }
+
+        opened.mutex.Lock()
+        opened.file.Close()
+        opened.file = file
+        opened.mutex.Unlock()
+    }
+}
+
+// Compile the config, the file is opened by Get
+func New(conf *config.AccessConf) (*Logger, error) {
+
+    var logger *Logger = &Logger{ format : conf.Format }
+
+    switch (conf.Format) {
+        case "", FORMAT_JSON:
+            logger.format = FORMAT_JSON
+            break
+        case FORMAT_TEXT:
+            var text string = conf.Template
+            if (len(text) == 0) {
+                text = DEFAULT_TEMPLATE
+            }
+            var err error
+            logger.template, err = template.New("access").Parse(text)
+            if (err != nil) {
+                return nil, errors.New("Malformed template: " + err.Error())
+            }
+            break
+        default:
+            return nil, errors.New("Unknown format: '" + conf.Format + "'")
+    }
+
+    if ((len(conf.Template) != 0) && (logger.format != FORMAT_TEXT)) {
+        return nil, errors.New("A template needs the text format")
+    }
+
+    return logger, nil
+}
+
+/*----------------------------------------------------------
+    Logger Implementation
+-----------------------------------------------------------*/
+
+// Write the record of a finished session, one line
+func (logger *Logger) Write(record *Record) {
+
+    if ((logger == nil) || (logger.output == nil)) {
+        return
+    }
+
+    var line []byte
+    var err error
+
+    if (logger.format == FORMAT_TEXT) {
+        var buffer bytes.Buffer
+        err = logger.template.Execute(&buffer, record)
+        line = []byte(strings.TrimRight(buffer.String(), "\n"))
+    } else {
+        line, err = json.Marshal(record.json())
+    }
+
+    if (err != nil) {
+        log.Errorf("Access log record failed: %s\n", err.Error())
+        return
+    }
+
+    line = append(line, '\n')
+
+    logger.output.mutex.Lock()
+    defer logger.output.mutex.Unlock()
+
+    if _, err = logger.output.file.Write(line); err != nil {
+        log.Errorf("Access log write failed: %s\n", err.Error())
+    }
+}
+
+/*----------------------------------------------------------
+    Record Implementation
+-----------------------------------------------------------*/
+
+// A record starting now
+func NewRecord() (*Record) {
+    return &Record{ Time : time.Now(), Reply : NO_REPLY }
+}
+
+// End tells why the session ended, the first reason is kept
+func (record *Record) End(reason string, err error) {
+
+    if (len(record.Reason) != 0) {
+        return
+    }
+
+    record.Reason = reason
+    if (err != nil) {
+        record.Error = err.Error()
+    }
+}
+
+func (record *Record) json() (*jsonRecord) {
+
+    var line *jsonRecord = &jsonRecord{ Time			: record.Time.Format(time.RFC3339Nano),
+                                        Client		: record.Client,
+                                        Listener		: record.Listener,
+                                        Method		: record.Method,
+                                        User			: record.User,
+                                        Command		: record.Command,
+                                        Destination	: record.Destination,
+                                        Resolved		: record.Resolved,
+                                        Up			: record.Up,
+                                        Down			: record.Down,
+                                        Duration		: record.Duration.Seconds(),
+                                        Reason		: record.Reason,
+                                        Error		: record.Error }
+
+    if (record.Reply != NO_REPLY) {
+        var reply int = record.Reply
+        line.Reply = &reply
+    }
+
+    return line
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+
+// The shared file of path, nil for an empty path. The loggers' lock is
+// held.
+func open(path string) (*output, error) {
+
+    if (len(path) == 0) {
+        return nil, nil
+    }
+
+    if opened := outputs[path]; opened != nil {
+        opened.refs++
+        return opened, nil
+    }
+
+    file, err := os.OpenFile(path, os.O_WRONLY | os.O_CREATE | os.O_APPEND, 0640)
+    if (err != nil) {
+        return nil, err
+    }
+
+    outputs[path] = &output{ path : path, file : file, refs : 1 }
+
+    return outputs[path], nil
+}
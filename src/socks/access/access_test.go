@@ -0,0 +1,170 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package access
+
+import (
+        "errors"
+        "io/ioutil"
+        "os"
+        "path/filepath"
+        "strings"
+        "testing"
+        "time"
+        "socks/config"
+)
+
+func TestFormat(t *testing.T) {
+
+    var cases = []struct {
+        name			string
+        conf			config.AccessConf
+        record		*Record
+        line			string
+    }{
+        { "json",
+          config.AccessConf{},
+          testRecord(),
+          `{"time":"2018-03-04T05:06:07.008Z","client":"10.1.0.5:40000","listener":"tcp:1080","method":"userpass","user":"alice","command":"connect","destination":"example.com:443","resolved":"192.0.2.1:443","reply":0,"up":100,"down":2000,"duration":1.5,"reason":"client closed"}` },
+        { "json without reply",
+          config.AccessConf{ Format : FORMAT_JSON },
+          &Record{ Time : testTime(), Client : "10.1.0.5:40000", Reply : NO_REPLY, Reason : REASON_HANDSHAKE, Error : "EOF" },
+          `{"time":"2018-03-04T05:06:07.008Z","client":"10.1.0.5:40000","up":0,"down":0,"duration":0,"reason":"handshake failed","error":"EOF"}` },
+        { "text",
+          config.AccessConf{ Format : FORMAT_TEXT },
+          testRecord(),
+          `2018-03-04T05:06:07.008Z 10.1.0.5:40000 tcp:1080 userpass alice connect example.com:443 192.0.2.1:443 0 100 2000 1.5s client closed` },
+        { "text empty fields",
+          config.AccessConf{ Format : FORMAT_TEXT },
+          &Record{ Time : testTime(), Client : "10.1.0.5:40000", Reply : NO_REPLY, Reason : REASON_REFUSED },
+          `2018-03-04T05:06:07.008Z 10.1.0.5:40000 - - - - - - -1 0 0 0s refused` },
+        { "template",
+          config.AccessConf{ Format : FORMAT_TEXT, Template : "{{.User}} {{.Destination}} {{.Up}}\n" },
+          testRecord(),
+          `alice example.com:443 100` },
+    }
+
+    for _, test := range cases {
+
+        var path string = filepath.Join(t.TempDir(), "access.log")
+        test.conf.Path = path
+
+        var logger *Logger = Get(&test.conf)
+        if (logger == nil) {
+            t.Fatalf("%s: no logger", test.name)
+        }
+        logger.Write(test.record)
+        Drop(&test.conf)
+
+        if line := readLog(t, path); line != test.line + "\n" {
+            t.Errorf("%s: %q, want %q", test.name, line, test.line + "\n")
+        }
+    }
+}
+
+func TestNewErrors(t *testing.T) {
+
+    var cases = []config.AccessConf{
+        { Format : "xml" },
+        { Format : FORMAT_TEXT, Template : "{{.User" },
+        { Format : FORMAT_JSON, Template : "{{.User}}" },
+    }
+
+    for _, conf := range cases {
+        if _, err := New(&conf); err == nil {
+            t.Errorf("%+v compiled", conf)
+        }
+    }
+}
+
+// The first reason a session ends for is kept
+func TestEnd(t *testing.T) {
+
+    var record *Record = NewRecord()
+    record.End(REASON_DIAL, errors.New("refused"))
+    record.End(REASON_CLOSED, nil)
+
+    if ((record.Reason != REASON_DIAL) || (record.Error != "refused")) {
+        t.Fatalf("ended for %q, %q", record.Reason, record.Error)
+    }
+}
+
+// The file is closed with the last logger writing to it
+func TestDropCloses(t *testing.T) {
+
+    var path string = filepath.Join(t.TempDir(), "access.log")
+    var first *config.AccessConf = &config.AccessConf{ Path : path }
+    var second *config.AccessConf = &config.AccessConf{ Path : path, Format : FORMAT_TEXT }
+
+    Get(first)
+    var logger *Logger = Get(second)
+
+    Drop(first)
+    logger.Write(testRecord())
+    if (len(readLog(t, path)) == 0) {
+        t.Fatalf("file closed while in use")
+    }
+
+    Drop(second)
+
+    loggersLock.Lock()
+    defer loggersLock.Unlock()
+
+    if (outputs[path] != nil) {
+        t.Fatalf("file still open")
+    }
+}
+
+// Reopen follows the path after the file was moved away
+func TestReopen(t *testing.T) {
+
+    var directory string = t.TempDir()
+    var path string = filepath.Join(directory, "access.log")
+    var conf *config.AccessConf = &config.AccessConf{ Path : path }
+    defer Drop(conf)
+
+    var logger *Logger = Get(conf)
+    logger.Write(testRecord())
+
+    var rotated string = filepath.Join(directory, "access.log.1")
+    if err := os.Rename(path, rotated); err != nil {
+        t.Fatalf("rename: %v", err)
+    }
+
+    Reopen()
+    logger.Write(testRecord())
+
+    if ((strings.Count(readLog(t, rotated), "\n") != 1) || (strings.Count(readLog(t, path), "\n") != 1)) {
+        t.Fatalf("rotated: %q, reopened: %q", readLog(t, rotated), readLog(t, path))
+    }
+}
+
+/*----------------------------------------------------------
+    Helpers
+-----------------------------------------------------------*/
+
+func testTime() (time.Time) {
+    return time.Date(2018, 3, 4, 5, 6, 7, 8000000, time.UTC)
+}
+
+// A CONNECT that went through
+func testRecord() (*Record) {
+
+    return &Record{ Time : testTime(), Client : "10.1.0.5:40000", Listener : "tcp:1080", Method : "userpass",
+                    User : "alice", Command : "connect", Destination : "example.com:443", Resolved : "192.0.2.1:443",
+                    Reply : 0, Up : 100, Down : 2000, Duration : 1500 * time.Millisecond, Reason : REASON_CLIENT }
+}
+
+func readLog(t *testing.T, path string) (string) {
+
+    bytes, err := ioutil.ReadFile(path)
+    if (err != nil) {
+        t.Fatalf("access log: %v", err)
+    }
+
+    return string(bytes)
+}
@@ -0,0 +1,446 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package acl
+
+import (
+        "errors"
+        "net"
+        "path"
+        "strconv"
+        "strings"
+        "sync"
+        "socks"
+        "socks/log"
+        "socks/config"
+        "socks/address"
+        "socks/context"
+)
+
+const (
+        ACTION_ALLOW		= "allow"
+        ACTION_DENY		= "deny"
+)
+
+// How a rule matches a request
+const (
+        MATCH_NO			= iota
+        MATCH_YES
+        // A rule on destination networks and a domain name not resolved yet
+        MATCH_UNRESOLVED
+)
+
+// Command names used in the rules
+var COMMAND_NAMES map[string]byte = map[string]byte {
+    "connect"	: socks.SOCKS_COMMAND_CONNECT,
+    "bind"		: socks.SOCKS_COMMAND_BIND,
+    "udp"		: socks.SOCKS_COMMAND_UDP_ASSOCIATE,
+}
+
+// What a request is evaluated on. Resolved is the address a domain name
+// resolved to, nil until the server resolves it.
+type Request struct {
+    Client		net.IP
+    User			string
+    Command		byte
+    Atyp			byte
+    Host			string
+    Port			int
+    Resolved		net.IP
+}
+
+// Build the Request of a session
+func NewRequest(contxt *context.Context, command byte, address address.Address) (*Request) {
+
+    var client net.IP
+    if addr, ok := (*contxt.Connection()).RemoteAddr().(*net.TCPAddr); ok {
+        client = addr.IP
+    }
+
+    return &Request{ Client	: client,
+                     User		: contxt.Username(),
+                     Command	: command,
+                     Atyp		: address.Atyp(),
+                     Host		: address.DstAddr(),
+                     Port		: address.DstPort() }
+}
+
+// The request is denied by Rule, or by the default action when empty
+type DeniedError struct {
+    Rule			string
+}
+
+type Acl struct {
+    allow		bool
+    rules		[]*Rule
+}
+
+type portRange struct {
+    low			int
+    high			int
+}
+
+type Rule struct {
+    conf			*config.AclRule
+    allow		bool
+    clients		[]*net.IPNet
+    users		map[string]bool
+    commands		map[byte]bool
+    destinations	[]*net.IPNet
+    domains		[]string
+    ports		[]portRange
+}
+
+// Compiled ACLs, keyed by their config
+var acls		map[*config.AclConf]*Acl = make(map[*config.AclConf]*Acl)
+var aclsLock	sync.Mutex
+
+/*----------------------------------------------------------
+    Create an Acl
+-----------------------------------------------------------*/
+
+// Returns the compiled Acl of the config. A config that doesn't compile,
+// or a missing one, denies everything.
+func Get(conf *config.AclConf) (*Acl) {
+
+    if (conf == nil) {
+        return &Acl{ allow : false }
+    }
+
+    aclsLock.Lock()
+    defer aclsLock.Unlock()
+
+    acl := acls[conf]
+    if (acl != nil) {
+        return acl
+    }
+
+    acl, err := New(conf)
+    if (err != nil) {
+        log.Errorf("Invalid ACL, all requests are denied: %s\n", err.Error())
+        acl = &Acl{ allow : false }
+    }
+
+    acls[conf] = acl
+
+    return acl
+}
+
+// Drop forgets the compiled ACLs of confs, it is called once the last
+// session of a config replaced by a reload is over
+func Drop(confs ...*config.AclConf) {
+
+    aclsLock.Lock()
+    defer aclsLock.Unlock()
+
+    for _, conf := range confs {
+        delete(acls, conf)
+    }
+}
+
+func New(conf *config.AclConf) (*Acl, error) {
+
+    var acl *Acl = &Acl{ allow : true }
+
+    switch (conf.Default) {
+        case "", ACTION_ALLOW:
+            break
+        case ACTION_DENY:
+            acl.allow = false
+            break
+        default:
+            return nil, errors.New("Unknown ACL default action: " + conf.Default)
+    }
+
+    for index := range conf.Rules {
+        rule, err := NewRule(&conf.Rules[index])
+        if (err != nil) {
+            return nil, errors.New("ACL rule " + strconv.Itoa(index + 1) + ": " + err.Error())
+        }
+        acl.rules = append(acl.rules, rule)
+    }
+
+    return acl, nil
+}
+
+/*----------------------------------------------------------
+    Acl Implementation
+-----------------------------------------------------------*/
+
+// Returns whether the request is allowed and the rule that decided it,
+// nil when no rule matched. A domain name not resolved yet can't be
+// decided when a rule on destination networks comes before the deciding
+// one: the last result is false then, and the request has to be decided
+// with the addresses the name resolves to.
+func (acl *Acl) Evaluate(request *Request) (bool, *config.AclRule, bool) {
+
+    var decided bool = true
+
+    for _, rule := range acl.rules {
+        switch (rule.match(request)) {
+            case MATCH_YES:
+                return rule.allow, rule.conf, decided
+            case MATCH_UNRESOLVED:
+                decided = false
+                break
+        }
+    }
+
+    return acl.allow, nil, decided
+}
+
+// Evaluates a domain name request again with an address the name
+// resolved to, the rules on destination networks may match it then
+func (acl *Acl) EvaluateResolved(request *Request, ip net.IP) (bool, *config.AclRule) {
+
+    var resolved Request = *request
+    resolved.Resolved = ip
+
+    allowed, rule, _ := acl.Evaluate(&resolved)
+
+    return allowed, rule
+}
+
+// Decides a domain name request with all the addresses the name resolved
+// to, in the order they are connected to. The first address allowed
+// decides, the request is denied when none is.
+func (acl *Acl) EvaluateAddresses(request *Request, ips []net.IP) (bool, *config.AclRule) {
+
+    var denied *config.AclRule
+
+    for index, ip := range ips {
+        allowed, rule := acl.EvaluateResolved(request, ip)
+        if (allowed) {
+            return true, rule
+        }
+        if (index == 0) {
+            denied = rule
+        }
+    }
+
+    if (len(ips) == 0) {
+        return false, nil
+    }
+
+    return false, denied
+}
+
+// Compile a single rule
+func NewRule(conf *config.AclRule) (*Rule, error) {
+
+    var err error
+    var rule *Rule = &Rule{ conf : conf }
+
+    switch (conf.Action) {
+        case ACTION_ALLOW:
+            rule.allow = true
+            break
+        case ACTION_DENY:
+            rule.allow = false
+            break
+        default:
+            return nil, errors.New("Unknown action: '" + conf.Action + "'")
+    }
+
+    rule.clients, err = parseCIDRs(conf.Clients)
+    if (err != nil) {
+        return nil, err
+    }
+
+    rule.destinations, err = parseCIDRs(conf.Destinations)
+    if (err != nil) {
+        return nil, err
+    }
+
+    if (len(conf.Users) != 0) {
+        rule.users = make(map[string]bool)
+        for _, user := range conf.Users {
+            rule.users[user] = true
+        }
+    }
+
+    if (len(conf.Commands) != 0) {
+        rule.commands = make(map[byte]bool)
+        for _, name := range conf.Commands {
+            command, found := COMMAND_NAMES[strings.ToLower(name)]
+            if (!found) {
+                return nil, errors.New("Unknown command: '" + name + "'")
+            }
+            rule.commands[command] = true
+        }
+    }
+
+    for _, domain := range conf.Domains {
+        domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+        if _, err = path.Match(domain, ""); err != nil {
+            return nil, errors.New("Malformed domain pattern: '" + domain + "'")
+        }
+        rule.domains = append(rule.domains, domain)
+    }
+
+    for _, port := range conf.Ports {
+        var low, high int
+        if index := strings.IndexByte(port, '-'); index >= 0 {
+            low, err  = strconv.Atoi(strings.TrimSpace(port[:index]))
+            if (err == nil) {
+                high, err = strconv.Atoi(strings.TrimSpace(port[index + 1:]))
+            }
+        } else {
+            low, err = strconv.Atoi(strings.TrimSpace(port))
+            high = low
+        }
+        if ((err != nil) || (low < 0) || (high > 65535) || (low > high)) {
+            return nil, errors.New("Malformed port range: '" + port + "'")
+        }
+        rule.ports = append(rule.ports, portRange{ low : low, high : high })
+    }
+
+    if ((conf.Upload < 0) || (conf.Download < 0)) {
+        return nil, errors.New("Upload and download must not be negative")
+    }
+
+    return rule, nil
+}
+
+// A domain name not resolved yet never matches a rule on destination
+// networks
+func (rule *Rule) Match(request *Request) (bool) {
+    return rule.match(request) == MATCH_YES
+}
+
+func (rule *Rule) match(request *Request) (int) {
+
+    if ((len(rule.clients) != 0) && !matchCIDRs(rule.clients, request.Client)) {
+        return MATCH_NO
+    }
+
+    if ((rule.users != nil) && !rule.users[request.User]) {
+        return MATCH_NO
+    }
+
+    if ((rule.commands != nil) && !rule.commands[request.Command]) {
+        return MATCH_NO
+    }
+
+    if (len(rule.domains) != 0) {
+        if ((request.Atyp != socks.SOCKS_V5_ATYP_FQDN) || !matchDomains(rule.domains, request.Host)) {
+            return MATCH_NO
+        }
+    }
+
+    if (len(rule.ports) != 0) {
+        var found bool = false
+        for _, ports := range rule.ports {
+            if ((request.Port >= ports.low) && (request.Port <= ports.high)) {
+                found = true
+                break
+            }
+        }
+        if (!found) {
+            return MATCH_NO
+        }
+    }
+
+    if (len(rule.destinations) != 0) {
+        // A domain name matches by the address it resolved to, not before
+        var ip net.IP = request.Resolved
+        if (request.Atyp != socks.SOCKS_V5_ATYP_FQDN) {
+            ip = net.ParseIP(request.Host)
+        } else if (ip == nil) {
+            return MATCH_UNRESOLVED
+        }
+        if (!matchCIDRs(rule.destinations, ip)) {
+            return MATCH_NO
+        }
+    }
+
+    return MATCH_YES
+}
+
+/*----------------------------------------------------------
+    DeniedError Implementation
+-----------------------------------------------------------*/
+func (err *DeniedError) Error() (string) {
+
+    var name string = err.Rule
+    if (len(name) == 0) {
+        name = "default"
+    }
+
+    return "Connection not allowed by ruleset (" + name + ")"
+}
+
+func (err *DeniedError) ReplyCode() (byte) {
+    return socks.SOCKS_V5_STATUS_NOT_ALLOWED
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+
+// A plain IP is taken as a single host
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+
+    var networks []*net.IPNet
+
+    for _, cidr := range cidrs {
+        if (!strings.Contains(cidr, "/")) {
+            ip := net.ParseIP(cidr)
+            if (ip == nil) {
+                return nil, errors.New("Malformed address: '" + cidr + "'")
+            }
+            if (ip.To4() != nil) {
+                cidr += "/32"
+            } else {
+                cidr += "/128"
+            }
+        }
+        _, network, err := net.ParseCIDR(cidr)
+        if (err != nil) {
+            return nil, errors.New("Malformed CIDR: '" + cidr + "'")
+        }
+        networks = append(networks, network)
+    }
+
+    return networks, nil
+}
+
+func matchCIDRs(networks []*net.IPNet, ip net.IP) (bool) {
+
+    if (ip == nil) {
+        return false
+    }
+
+    for _, network := range networks {
+        if (network.Contains(ip)) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// ".example.com" matches example.com and all its subdomains, anything
+// else is a glob
+func matchDomains(domains []string, host string) (bool) {
+
+    host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+    for _, domain := range domains {
+        if (strings.HasPrefix(domain, ".")) {
+            if ((host == domain[1:]) || strings.HasSuffix(host, domain)) {
+                return true
+            }
+            continue
+        }
+        if matched, _ := path.Match(domain, host); matched {
+            return true
+        }
+    }
+
+    return false
+}
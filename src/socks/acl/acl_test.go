@@ -0,0 +1,200 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package acl
+
+import (
+        "net"
+        "testing"
+        "socks"
+        "socks/config"
+)
+
+// A CONNECT request from a client of the office network
+func testRequest(host string, port int, user string) (*Request) {
+
+    var atyp byte = socks.SOCKS_V5_ATYP_FQDN
+    if ip := net.ParseIP(host); ip != nil {
+        atyp = socks.SOCKS_V5_ATYP_IP4
+        if (ip.To4() == nil) {
+            atyp = socks.SOCKS_V5_ATYP_IP6
+        }
+    }
+
+    return &Request{ Client : net.ParseIP("10.1.0.5"), User : user, Command : socks.SOCKS_COMMAND_CONNECT, Atyp : atyp, Host : host, Port : port }
+}
+
+func testAcl(t *testing.T, conf *config.AclConf) (*Acl) {
+
+    acl, err := New(conf)
+    if (err != nil) {
+        t.Fatalf("acl: %v", err)
+    }
+
+    return acl
+}
+
+func TestEvaluate(t *testing.T) {
+
+    var conf *config.AclConf = &config.AclConf{ Default : ACTION_DENY, Rules : []config.AclRule{
+        { Name : "no-smtp", Action : ACTION_DENY, Ports : []string{ "25" } },
+        { Name : "admins", Action : ACTION_ALLOW, Users : []string{ "root" }, Clients : []string{ "10.1.0.0/16" } },
+        { Name : "intranet", Action : ACTION_ALLOW, Destinations : []string{ "192.0.2.0/24", "2001:db8::/32" } },
+        { Name : "example", Action : ACTION_ALLOW, Domains : []string{ ".example.com" }, Ports : []string{ "443", "8000-8080" } },
+        { Name : "globs", Action : ACTION_ALLOW, Domains : []string{ "*.test" } },
+        { Name : "bind", Action : ACTION_ALLOW, Commands : []string{ "bind" } },
+    } }
+
+    var cases = []struct {
+        name			string
+        request		*Request
+        allowed		bool
+        rule			string
+        decided		bool
+    }{
+        { "port denied first", testRequest("192.0.2.1", 25, "root"), false, "no-smtp", true },
+        { "user and client", testRequest("198.51.100.1", 80, "root"), true, "admins", true },
+        { "destination network", testRequest("192.0.2.1", 80, "alice"), true, "intranet", true },
+        { "destination network v6", testRequest("2001:db8::1", 80, "alice"), true, "intranet", true },
+        { "outside the networks", testRequest("198.51.100.1", 80, "alice"), false, "", true },
+        { "domain suffix", testRequest("www.example.com", 443, "alice"), true, "example", false },
+        { "domain itself", testRequest("example.com", 8080, "alice"), true, "example", false },
+        { "domain case", testRequest("WWW.Example.COM.", 443, "alice"), true, "example", false },
+        { "domain port range", testRequest("www.example.com", 8081, "alice"), false, "", false },
+        { "glob", testRequest("host.test", 80, "alice"), true, "globs", false },
+        // Rules before the destination networks decide a name right away
+        { "user before the networks", testRequest("www.example.com", 80, "root"), true, "admins", true },
+        { "port before the networks", testRequest("www.example.com", 25, "alice"), false, "no-smtp", true },
+    }
+
+    var acl *Acl = testAcl(t, conf)
+
+    for _, test := range cases {
+        allowed, rule, decided := acl.Evaluate(test.request)
+
+        var name string
+        if (rule != nil) {
+            name = rule.Name
+        }
+
+        if ((allowed != test.allowed) || (name != test.rule) || (decided != test.decided)) {
+            t.Errorf("%s: allowed %v by '%s', decided %v, want %v by '%s', decided %v", test.name, allowed, name, decided, test.allowed, test.rule, test.decided)
+        }
+    }
+
+    // A command that isn't listed
+    var bind *Request = testRequest("198.51.100.1", 80, "alice")
+    bind.Command = socks.SOCKS_COMMAND_UDP_ASSOCIATE
+    if allowed, _, _ := acl.Evaluate(bind); allowed {
+        t.Errorf("udp allowed by the bind rule")
+    }
+}
+
+// A name is decided by the addresses it resolves to when a rule on
+// destination networks comes first
+func TestEvaluateResolved(t *testing.T) {
+
+    var conf *config.AclConf = &config.AclConf{ Default : ACTION_DENY, Rules : []config.AclRule{
+        { Name : "no-metadata", Action : ACTION_DENY, Destinations : []string{ "169.254.0.0/16" } },
+        { Name : "intranet", Action : ACTION_ALLOW, Destinations : []string{ "192.0.2.0/24" } },
+        { Name : "example", Action : ACTION_ALLOW, Domains : []string{ ".example.com" } },
+    } }
+
+    var acl *Acl = testAcl(t, conf)
+
+    var cases = []struct {
+        name			string
+        host			string
+        ips			[]string
+        allowed		bool
+        rule			string
+    }{
+        { "intranet address", "wiki.corp", []string{ "192.0.2.10" }, true, "intranet" },
+        { "outside address", "wiki.corp", []string{ "198.51.100.1" }, false, "" },
+        { "denied network", "www.example.com", []string{ "169.254.169.254" }, false, "no-metadata" },
+        { "domain rule after the networks", "www.example.com", []string{ "198.51.100.1" }, true, "example" },
+        { "first allowed address decides", "mixed.corp", []string{ "169.254.1.1", "192.0.2.10" }, true, "intranet" },
+        { "no address allowed", "mixed.corp", []string{ "169.254.1.1", "198.51.100.1" }, false, "no-metadata" },
+        { "no address", "empty.corp", nil, false, "" },
+    }
+
+    for _, test := range cases {
+
+        var request *Request = testRequest(test.host, 80, "alice")
+        if _, _, decided := acl.Evaluate(request); decided {
+            t.Fatalf("%s: decided before the name is resolved", test.name)
+        }
+
+        var ips []net.IP
+        for _, ip := range test.ips {
+            ips = append(ips, net.ParseIP(ip))
+        }
+
+        allowed, rule := acl.EvaluateAddresses(request, ips)
+
+        var name string
+        if (rule != nil) {
+            name = rule.Name
+        }
+
+        if ((allowed != test.allowed) || (name != test.rule)) {
+            t.Errorf("%s: allowed %v by '%s', want %v by '%s'", test.name, allowed, name, test.allowed, test.rule)
+        }
+
+        // A single address gives the same answer on its own
+        if (len(ips) == 1) {
+            if allowed, _ := acl.EvaluateResolved(request, ips[0]); allowed != test.allowed {
+                t.Errorf("%s: resolved to %s allowed %v", test.name, ips[0], allowed)
+            }
+        }
+    }
+}
+
+// Routes can't wait for a name to be resolved, a rule on destination
+// networks doesn't match it
+func TestRuleMatchUnresolved(t *testing.T) {
+
+    rule, err := NewRule(&config.AclRule{ Action : ACTION_ALLOW, Destinations : []string{ "192.0.2.0/24" } })
+    if (err != nil) {
+        t.Fatalf("rule: %v", err)
+    }
+
+    var request *Request = testRequest("wiki.corp", 80, "")
+    if (rule.Match(request)) {
+        t.Fatalf("unresolved name matched")
+    }
+
+    request.Resolved = net.ParseIP("192.0.2.10")
+    if (!rule.Match(request)) {
+        t.Fatalf("resolved name didn't match")
+    }
+}
+
+func TestNewRuleErrors(t *testing.T) {
+
+    var cases = []config.AclRule{
+        { Action : "permit" },
+        { Action : ACTION_ALLOW, Clients : []string{ "10.0.0.0/33" } },
+        { Action : ACTION_ALLOW, Destinations : []string{ "not-an-address" } },
+        { Action : ACTION_ALLOW, Commands : []string{ "listen" } },
+        { Action : ACTION_ALLOW, Domains : []string{ "[example.com" } },
+        { Action : ACTION_ALLOW, Ports : []string{ "80-" } },
+        { Action : ACTION_ALLOW, Ports : []string{ "8080-80" } },
+        { Action : ACTION_ALLOW, Ports : []string{ "70000" } },
+        { Action : ACTION_ALLOW, Upload : -1 },
+    }
+
+    for _, conf := range cases {
+        if _, err := NewRule(&conf); err == nil {
+            t.Errorf("%+v compiled", conf)
+        }
+    }
+
+    if _, err := New(&config.AclConf{ Default : "maybe" }); err == nil {
+        t.Errorf("unknown default compiled")
+    }
+}
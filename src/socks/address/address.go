@@ -38,7 +38,8 @@ func New(atyp byte, dstAddr string, dstPort int) (Address) {
             address = NewAddress("tcp4", atyp, dstAddr, dstPort)
             break
         case socks.SOCKS_V5_ATYP_FQDN:
-            address = NewAddress("tcp4", atyp, dstAddr, dstPort)
+            // Either family, the dialer races them
+            address = NewAddress("tcp", atyp, dstAddr, dstPort)
             break
         case socks.SOCKS_V5_ATYP_IP6:
             address = NewAddress("tcp6", atyp, dstAddr, dstPort)
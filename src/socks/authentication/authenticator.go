@@ -9,7 +9,10 @@ package authentication
 
 import (
         "errors"
+        "io"
         "socks"
+        "socks/log"
+        "socks/config"
         "socks/context"
 )
 
@@ -58,9 +61,8 @@ type UserPasswordAuthentication struct {
     password		string
 }
 
-type GssAPIAuthentication struct {
-    
-}
+// RFC 1929 subnegotiation version
+const SUBNEGOTIATION_VERSION = byte(0x01)
 
 var AUTHENTICATORS map[byte]Authenticator
 
@@ -75,6 +77,72 @@ func init () {
     AUTHENTICATORS[socks.SOCKS_AUTH_USERPASSWORD] 		= NewUserPasswordAuthentication()
 }
 
+/*----------------------------------------------------------
+    Enabled methods
+-----------------------------------------------------------*/
+
+// Method names used in the config
+var METHOD_NAMES map[string]byte = map[string]byte {
+    "noauth"		: socks.SOCKS_AUTH_NOAUTHENTICATION,
+    "gssapi"		: socks.SOCKS_AUTH_GSSAPI,
+    "userpass"	: socks.SOCKS_AUTH_USERPASSWORD,
+}
+
+// Returns the enabled methods in server preferred order. The listener
+// list wins over the global one, when neither is configured user/password
+// is required as soon as credentials are configured.
+func Methods(conf *config.Config, listener *config.ListenerConf) ([]byte) {
+
+    var names []string = listener.Methods
+    if (len(names) == 0) {
+        names = conf.Auth.Methods
+    }
+
+    if (len(names) == 0) {
+        if ((len(conf.Auth.Userfile) != 0) || (len(conf.Auth.Username) != 0)) {
+            return []byte{ socks.SOCKS_AUTH_USERPASSWORD }
+        }
+        return []byte{ socks.SOCKS_AUTH_NOAUTHENTICATION }
+    }
+
+    var methods []byte
+
+    for _, name := range names {
+        method, found := METHOD_NAMES[name]
+        if (!found) {
+            log.Warnf("Unknown authentication method: '%s'\n", name)
+            continue
+        }
+        methods = append(methods, method)
+    }
+
+    return methods
+}
+
+// Returns an error when a method name is unknown
+func CheckMethods(names []string) (error) {
+
+    for _, name := range names {
+        if _, found := METHOD_NAMES[name]; !found {
+            return errors.New("Unknown authentication method: '" + name + "'")
+        }
+    }
+
+    return nil
+}
+
+// The config name of a method, empty for an unknown one
+func MethodName(method byte) (string) {
+
+    for name, value := range METHOD_NAMES {
+        if (value == method) {
+            return name
+        }
+    }
+
+    return ""
+}
+
 /*----------------------------------------------------------
     NoAuthentication Implementation
 -----------------------------------------------------------*/
@@ -94,16 +162,39 @@ func NewUserPasswordAuthentication() (*UserPasswordAuthentication){
     return &UserPasswordAuthentication{}
 }
 
+/* RFC 1929
+   Once the SOCKS V5 server has started, and the client has selected the
+   Username/Password Authentication protocol, the Username/Password
+   subnegotiation begins.  This begins with the client producing a
+   Username/Password request:
+
+           +----+------+----------+------+----------+
+           |VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+           +----+------+----------+------+----------+
+           | 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+           +----+------+----------+------+----------+
+
+   The VER field contains the current version of the subnegotiation,
+   which is X'01'.
+
+   The server verifies the supplied UNAME and PASSWD, and sends the
+   following response:
+
+                        +----+--------+
+                        |VER | STATUS |
+                        +----+--------+
+                        | 1  |   1    |
+                        +----+--------+
+
+   A STATUS field of X'00' indicates success. If the server returns a
+   `failure' (STATUS value other than X'00') status, it MUST close the
+   connection.
+*/
 func (auth *UserPasswordAuthentication) Authenticate(context *context.Context) (bool, error) {
 
     var statuscode byte = socks.SOCKS_AUTH_NOACCEPTABLE
     
-    defer response(statuscode, context)
-    
-    // check of the server config correctly    
-    if ((len(context.Config().Auth.Username) == 0) || (len(context.Config().Auth.Password) == 0)) {
-        return false, errors.New("Socks server doesn't config authentication correctly")
-    }
+    defer func() { response(statuscode, context) }()
     
     // Read the version
     _, err := context.Reader().ReadByte()
@@ -111,61 +202,56 @@ func (auth *UserPasswordAuthentication) Authenticate(context *context.Context) (
         return false, err
     }
     
-    length, err := context.Reader().ReadByte()
+    username, err := readField(context)
     if (err != nil) {
         return false, err
     }
     
-    bytes := make([]byte, length)
-    count, err := context.Reader().Read(bytes)
+    password, err := readField(context)
     if (err != nil) {
         return false, err
     }
     
-    username := string(bytes[:count])
-    
-    // Read password
-    length, err = context.Reader().ReadByte()
-    if (err != nil) {
-        return false, err
-    }
-    count, err = context.Reader().Read(bytes)
-    if (err != nil){
-        return false, err        
-    }
-    password := string(bytes[:count])
-    
     // check if the username and password provided
     if ((len(username) == 0) || (len(password) == 0)) {
         return false, errors.New("Authentication failed")
     }
     
-    if ((username != context.Config().Auth.Username) || (password != context.Config().Auth.Password)) {
-        return false, errors.New("Authentication failed")
+    if (!NewCredentialStore(&context.Config().Auth).Verify(username, password)) {
+        return false, errors.New("Authentication failed for user: " + username)
     }
 
+    context.SetUsername(username)
+
     statuscode = socks.SOCKS_V5_STATUS_SUCCESS
 
     return true, nil
 }
 
-/*----------------------------------------------------------
-    UserPasswordAuthentication Implementation
------------------------------------------------------------*/
-func NewGssAPIAuthentication() (*GssAPIAuthentication){
-    return &GssAPIAuthentication{}
-}
+// Read a length prefixed field
+func readField(context *context.Context) (string, error) {
 
-func (auth *GssAPIAuthentication) Authenticate(context *context.Context) (bool, error) {
-    return true, nil
+    length, err := context.Reader().ReadByte()
+    if (err != nil) {
+        return "", err
+    }
+
+    bytes := make([]byte, length)
+    _, err = io.ReadFull(context.Reader(), bytes)
+    if (err != nil) {
+        return "", err
+    }
+
+    return string(bytes), nil
 }
 
 /*----------------------------------------------------------
     public methods Implementation
 -----------------------------------------------------------*/
 
+// Subnegotiation response, VER is X'01' rather than the Socks version
 func response(code byte, context *context.Context) {
-    context.Writer().WriteByte(context.Version())
+    context.Writer().WriteByte(SUBNEGOTIATION_VERSION)
     context.Writer().WriteByte(code)
     context.Writer().Flush()
-}
\ No newline at end of file
+}
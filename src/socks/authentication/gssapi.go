@@ -0,0 +1,358 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package authentication
+
+import (
+        "bufio"
+        "errors"
+        "io"
+        "net"
+        "sync"
+        "socks/log"
+        "socks/config"
+        "socks/context"
+)
+
+/* RFC 1961
+   GSS-API Authentication Method for SOCKS Version 5
+
+   All GSS-API messages exchanged during the subnegotiation are framed
+   as follows:
+
+          +------+------+------+.......................+
+          + ver  | mtyp | len  |       token           |
+          +------+------+------+.......................+
+          + 0x01 | 0x01 | 0x02 | up to 2^16 - 1 octets |
+          +------+------+------+.......................+
+
+   Where:
+
+   - "ver" is the protocol version number, here 1 to represent the
+     first version of the SOCKS/GSS-API protocol
+
+   - "mtyp" is the message type, here 1 to represent an
+     authentication message, 2 a protection level negotiation message
+     and 3 an encapsulated message
+
+   - "len" is the length of the "token" field in octets
+
+   - "token" is the opaque authentication token emitted by GSS-API
+
+   If gss_accept_sec_context fails, the server MUST close the connection
+   after sending an abort message (mtyp X'ff', no len and token).
+*/
+const (
+        GSSAPI_VERSION			= byte(0x01)
+        GSSAPI_MTYP_AUTH			= byte(0x01)
+        GSSAPI_MTYP_PROTECTION	= byte(0x02)
+        GSSAPI_MTYP_ENCAPSULATION	= byte(0x03)
+        GSSAPI_MTYP_ABORT		= byte(0xFF)
+)
+
+/* RFC 1961
+   The security context protection level sent by client and server MUST
+   be one of the following values:
+
+         1 required per-message integrity
+         2 required per-message integrity and confidentiality
+         3 selective per-message integrity or confidentiality based on
+           local client and server configurations
+*/
+const (
+        GSSAPI_PROTECTION_INTEGRITY		= byte(0x01)
+        GSSAPI_PROTECTION_CONFIDENTIALITY	= byte(0x02)
+        GSSAPI_PROTECTION_SELECTIVE		= byte(0x03)
+)
+
+// Largest token a message can carry
+const GSSAPI_MAX_TOKEN = 0xFFFF
+
+// GssAcceptor is the acceptor side of one GSS-API security context
+type GssAcceptor interface {
+    // Process a token from the client (gss_accept_sec_context), returns
+    // the token to send back, if any, and whether the context is complete
+    Accept (token []byte) ([]byte, bool, error)
+    // The authenticated client principal
+    Principal () (string)
+    // gss_wrap, with or without confidentiality
+    Wrap (data []byte, confidential bool) ([]byte, error)
+    // gss_unwrap
+    Unwrap (token []byte) ([]byte, error)
+}
+
+// GssMechanism creates the acceptor for a new session from client,
+// usually loading the acceptor credentials from the keytab in the config
+type GssMechanism func (conf *config.GssapiConf, client net.Addr) (GssAcceptor, error)
+
+type GssAPIAuthentication struct {
+
+}
+
+// Wraps the client connection once a protection level is negotiated,
+// every message is then encapsulated.
+type gssConn struct {
+        net.Conn
+        reader			*bufio.Reader
+        acceptor			GssAcceptor
+        confidential		bool
+        pending			[]byte
+        mutex			sync.Mutex
+}
+
+// Kerberos V5 is built in, another mechanism may be registered instead
+var gssMechanism GssMechanism = NewKerberosAcceptor
+
+/*----------------------------------------------------------
+    GssAPIAuthentication Implementation
+-----------------------------------------------------------*/
+
+// Register the GSS-API mechanism used by the GSSAPI method
+func RegisterGssMechanism(mechanism GssMechanism) {
+    gssMechanism = mechanism
+}
+
+func NewGssAPIAuthentication() (*GssAPIAuthentication){
+    return &GssAPIAuthentication{}
+}
+
+func (auth *GssAPIAuthentication) Authenticate(context *context.Context) (bool, error) {
+
+    // No mechanism, nobody gets in
+    if (gssMechanism == nil) {
+        gssAbort(context)
+        return false, errors.New("No GSS-API mechanism available")
+    }
+
+    acceptor, err := gssMechanism(&context.Config().Gssapi, (*context.Connection()).RemoteAddr())
+    if (err != nil) {
+        gssAbort(context)
+        return false, err
+    }
+
+    // Context establishment
+    for {
+        mtyp, token, err := gssRead(context.Reader())
+        if (err != nil) {
+            return false, err
+        }
+
+        if (mtyp == GSSAPI_MTYP_ABORT) {
+            return false, errors.New("GSS-API authentication aborted by client")
+        }
+
+        if (mtyp != GSSAPI_MTYP_AUTH) {
+            gssAbort(context)
+            return false, errors.New("Unexpected GSS-API message type")
+        }
+
+        output, complete, err := acceptor.Accept(token)
+        if (err != nil) {
+            gssAbort(context)
+            return false, err
+        }
+
+        if (len(output) != 0) {
+            err = gssWrite(context.Writer(), GSSAPI_MTYP_AUTH, output)
+            if (err != nil) {
+                return false, err
+            }
+        }
+
+        if (complete) {
+            break
+        }
+    }
+
+    // Protection level negotiation
+    level, err := gssProtection(context, acceptor)
+    if (err != nil) {
+        gssAbort(context)
+        return false, err
+    }
+
+    context.SetUsername(acceptor.Principal())
+
+    log.Infof("GSS-API authenticated: %s, protection level: %d\n", acceptor.Principal(), level)
+
+    // From now on every message is encapsulated
+    context.Encapsulate(&gssConn{ Conn : *context.Connection(), reader : context.Reader(), acceptor : acceptor, confidential : level != GSSAPI_PROTECTION_INTEGRITY })
+
+    return true, nil
+}
+
+/* RFC 1961
+   Upon successful establishment of a GSS-API security context, the
+   client's GSS-API implementation sends the required security context
+   protection level to the server.  The server then returns the security
+   context protection level which it agrees to - which may or may not
+   take the the client's request into account.
+
+   The security context protection level is sent as a single octet,
+   encapsulated (gss_wrap) with integrity.
+*/
+func gssProtection(context *context.Context, acceptor GssAcceptor) (byte, error) {
+
+    mtyp, token, err := gssRead(context.Reader())
+    if (err != nil) {
+        return 0, err
+    }
+
+    if (mtyp != GSSAPI_MTYP_PROTECTION) {
+        return 0, errors.New("Unexpected GSS-API message type")
+    }
+
+    data, err := acceptor.Unwrap(token)
+    if (err != nil) {
+        return 0, err
+    }
+
+    if (len(data) != 1) {
+        return 0, errors.New("Malformed GSS-API protection level")
+    }
+
+    var level byte = data[0]
+    if ((level < GSSAPI_PROTECTION_INTEGRITY) || (level > GSSAPI_PROTECTION_SELECTIVE)) {
+        return 0, errors.New("Unknown GSS-API protection level")
+    }
+
+    // Selective is served as confidentiality, then cap it with the config
+    if (level == GSSAPI_PROTECTION_SELECTIVE) {
+        level = GSSAPI_PROTECTION_CONFIDENTIALITY
+    }
+    if (context.Config().Gssapi.Protection == "integrity") {
+        level = GSSAPI_PROTECTION_INTEGRITY
+    }
+
+    token, err = acceptor.Wrap([]byte{ level }, false)
+    if (err != nil) {
+        return 0, err
+    }
+
+    err = gssWrite(context.Writer(), GSSAPI_MTYP_PROTECTION, token)
+
+    return level, err
+}
+
+/*----------------------------------------------------------
+    gssConn Implementation
+-----------------------------------------------------------*/
+func (conn *gssConn) Read(buffer []byte) (int, error) {
+
+    // Unwrap the next encapsulated message
+    for (len(conn.pending) == 0) {
+        mtyp, token, err := gssRead(conn.reader)
+        if (err != nil) {
+            return 0, err
+        }
+
+        if (mtyp == GSSAPI_MTYP_ABORT) {
+            return 0, io.EOF
+        }
+
+        if (mtyp != GSSAPI_MTYP_ENCAPSULATION) {
+            return 0, errors.New("Unexpected GSS-API message type")
+        }
+
+        conn.pending, err = conn.acceptor.Unwrap(token)
+        if (err != nil) {
+            return 0, err
+        }
+    }
+
+    count := copy(buffer, conn.pending)
+    conn.pending = conn.pending[count:]
+
+    return count, nil
+}
+
+func (conn *gssConn) Write(data []byte) (int, error) {
+
+    conn.mutex.Lock()
+    defer conn.mutex.Unlock()
+
+    var writer *bufio.Writer = bufio.NewWriter(conn.Conn)
+    var written int = 0
+
+    // Leave room for the wrap overhead in each message
+    for (written < len(data)) {
+        var end int = len(data)
+        if (end - written > GSSAPI_MAX_TOKEN / 2) {
+            end = written + GSSAPI_MAX_TOKEN / 2
+        }
+
+        token, err := conn.acceptor.Wrap(data[written:end], conn.confidential)
+        if (err != nil) {
+            return written, err
+        }
+
+        err = gssWrite(writer, GSSAPI_MTYP_ENCAPSULATION, token)
+        if (err != nil) {
+            return written, err
+        }
+
+        written = end
+    }
+
+    return written, nil
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+func gssRead(reader *bufio.Reader) (byte, []byte, error) {
+
+    var header []byte = make([]byte, 2)
+    _, err := io.ReadFull(reader, header)
+    if (err != nil) {
+        return 0, nil, err
+    }
+
+    if (header[0] != GSSAPI_VERSION) {
+        return 0, nil, errors.New("Unsupported GSS-API message version")
+    }
+
+    // Abort has no len and token
+    if (header[1] == GSSAPI_MTYP_ABORT) {
+        return GSSAPI_MTYP_ABORT, nil, nil
+    }
+
+    var length []byte = make([]byte, 2)
+    _, err = io.ReadFull(reader, length)
+    if (err != nil) {
+        return 0, nil, err
+    }
+
+    var token []byte = make([]byte, (int(length[0]) << 8) | int(length[1]))
+    _, err = io.ReadFull(reader, token)
+    if (err != nil) {
+        return 0, nil, err
+    }
+
+    return header[1], token, nil
+}
+
+func gssWrite(writer *bufio.Writer, mtyp byte, token []byte) (error) {
+
+    if (len(token) > GSSAPI_MAX_TOKEN) {
+        return errors.New("GSS-API token is too large")
+    }
+
+    writer.WriteByte(GSSAPI_VERSION)
+    writer.WriteByte(mtyp)
+    writer.WriteByte(byte(len(token) >> 8))
+    writer.WriteByte(byte(len(token) & 0xFF))
+    writer.Write(token)
+
+    return writer.Flush()
+}
+
+func gssAbort(context *context.Context) {
+    context.Writer().WriteByte(GSSAPI_VERSION)
+    context.Writer().WriteByte(GSSAPI_MTYP_ABORT)
+    context.Writer().Flush()
+}
@@ -0,0 +1,456 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package authentication
+
+import (
+        "bytes"
+        "crypto/rand"
+        "encoding/binary"
+        "errors"
+        "fmt"
+        "net"
+        "sync/atomic"
+        "socks/config"
+        "github.com/jcmturner/gofork/encoding/asn1"
+        "github.com/jcmturner/gokrb5/v8/asn1tools"
+        "github.com/jcmturner/gokrb5/v8/crypto"
+        "github.com/jcmturner/gokrb5/v8/iana"
+        "github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+        "github.com/jcmturner/gokrb5/v8/iana/etypeID"
+        "github.com/jcmturner/gokrb5/v8/iana/flags"
+        "github.com/jcmturner/gokrb5/v8/iana/keyusage"
+        "github.com/jcmturner/gokrb5/v8/iana/msgtype"
+        "github.com/jcmturner/gokrb5/v8/keytab"
+        "github.com/jcmturner/gokrb5/v8/messages"
+        "github.com/jcmturner/gokrb5/v8/service"
+        "github.com/jcmturner/gokrb5/v8/types"
+)
+
+/* RFC 1964, RFC 4121
+   The Kerberos V5 GSS-API mechanism. The initiator's first token is
+   an AP-REQ framed as
+
+        [APPLICATION 0] IMPLICIT SEQUENCE {
+                thisMech        MechType,   -- 1.2.840.113554.1.2.2
+                innerToken      ANY         -- TOK_ID || KRB_AP_REQ
+        }
+
+   the acceptor answers with an AP-REP the same way when mutual
+   authentication is requested. Messages are then protected with the
+   RFC 4121 Wrap tokens:
+
+        Octet no   Name        Description
+        --------------------------------------------------------------
+         0..1     TOK_ID     0x05 0x04
+         2        Flags      SentByAcceptor, Sealed, AcceptorSubkey
+         3        Filler     0xFF
+         4..5     EC         "extra count"
+         6..7     RRC        "right rotation count"
+         8..15    SND_SEQ    sender's sequence number
+
+   Only the enctypes of RFC 4121 (AES) are served, the older RFC 1964
+   tokens of DES and RC4 are not.
+*/
+var KRB5_MECHANISM asn1.ObjectIdentifier = asn1.ObjectIdentifier{ 1, 2, 840, 113554, 1, 2, 2 }
+
+const (
+        KRB5_TOK_AP_REQ		= uint16(0x0100)
+        KRB5_TOK_AP_REP		= uint16(0x0200)
+        KRB5_TOK_WRAP		= uint16(0x0504)
+)
+
+const (
+        KRB5_WRAP_SENT_BY_ACCEPTOR	= byte(0x01)
+        KRB5_WRAP_SEALED			= byte(0x02)
+        KRB5_WRAP_ACCEPTOR_SUBKEY	= byte(0x04)
+)
+
+const KRB5_WRAP_HEADER = 16
+
+/* RFC 4121
+   The authenticator checksum of type 0x8003 carries the context flags
+   requested by the initiator, in little endian order at octets 20..23.
+*/
+const (
+        KRB5_GSS_CHECKSUM		= int32(0x8003)
+        KRB5_GSS_MUTUAL_FLAG		= uint32(0x02)
+)
+
+// Accepts Kerberos V5 contexts with the keys of a keytab
+type KerberosAcceptor struct {
+        conf			*config.GssapiConf
+        keytab		*keytab.Keytab
+        client		net.Addr
+        principal	string
+        key			types.EncryptionKey
+        sequence		uint64
+        expected		uint64
+        complete		bool
+}
+
+/*----------------------------------------------------------
+    KerberosAcceptor Implementation
+-----------------------------------------------------------*/
+
+// The GssMechanism of Kerberos V5, the keytab is loaded for every session
+// so that a rotated keytab is picked up without a reload
+func NewKerberosAcceptor(conf *config.GssapiConf, client net.Addr) (GssAcceptor, error) {
+
+    if (len(conf.Keytab) == 0) {
+        return nil, errors.New("No keytab configured for GSS-API")
+    }
+
+    kt, err := keytab.Load(conf.Keytab)
+    if (err != nil) {
+        return nil, errors.New("Loading keytab: " + err.Error())
+    }
+
+    return &KerberosAcceptor{ conf : conf, keytab : kt, client : client }, nil
+}
+
+// Verifies the AP-REQ of the initiator, with the ticket of the configured
+// service. Answers with an AP-REP when mutual authentication is asked.
+func (acceptor *KerberosAcceptor) Accept(token []byte) ([]byte, bool, error) {
+
+    if (acceptor.complete) {
+        return nil, false, errors.New("Kerberos context is already established")
+    }
+
+    id, inner, err := krb5Unframe(token)
+    if (err != nil) {
+        return nil, false, err
+    }
+
+    if (id != KRB5_TOK_AP_REQ) {
+        return nil, false, errors.New("Expected a Kerberos AP-REQ")
+    }
+
+    var apReq messages.APReq
+    if err = apReq.Unmarshal(inner); err != nil {
+        return nil, false, errors.New("Malformed Kerberos AP-REQ: " + err.Error())
+    }
+
+    // Only the tickets of our service
+    var sname types.PrincipalName = apReq.Ticket.SName
+    if ((len(acceptor.conf.Service) != 0) && ((len(sname.NameString) == 0) || (sname.NameString[0] != acceptor.conf.Service))) {
+        return nil, false, errors.New("Kerberos ticket is for '" + sname.PrincipalNameString() + "', not the '" + acceptor.conf.Service + "' service")
+    }
+
+    var settings []func(*service.Settings) = []func(*service.Settings){ service.DecodePAC(false) }
+    if addr, ok := acceptor.client.(*net.TCPAddr); ok {
+        settings = append(settings, service.ClientAddress(types.HostAddressFromNetIP(addr.IP)))
+    }
+
+    valid, _, err := service.VerifyAPREQ(&apReq, service.NewSettings(acceptor.keytab, settings...))
+    if (err != nil) {
+        return nil, false, errors.New("Kerberos AP-REQ rejected: " + err.Error())
+    }
+    if (!valid) {
+        return nil, false, errors.New("Kerberos AP-REQ rejected")
+    }
+
+    var authenticator types.Authenticator = apReq.Authenticator
+    var session types.EncryptionKey = apReq.Ticket.DecryptedEncPart.Key
+
+    // The initiator's subkey wins over the ticket's session key
+    acceptor.key = session
+    if (len(authenticator.SubKey.KeyValue) != 0) {
+        acceptor.key = authenticator.SubKey
+    }
+
+    if !krb5Wrappable(acceptor.key.KeyType) {
+        return nil, false, fmt.Errorf("Kerberos encryption type %d is not supported", acceptor.key.KeyType)
+    }
+
+    acceptor.principal = authenticator.CName.PrincipalNameString() + "@" + authenticator.CRealm
+    acceptor.complete = true
+
+    // The initiator numbers its tokens from the authenticator's number.
+    // Without an AP-REP the acceptor starts from it too.
+    acceptor.expected = uint64(authenticator.SeqNumber)
+    acceptor.sequence = acceptor.expected
+
+    if (!krb5Mutual(&apReq)) {
+        return nil, true, nil
+    }
+
+    acceptor.sequence, err = krb5Sequence()
+    if (err != nil) {
+        return nil, false, err
+    }
+
+    apRep, err := krb5APRep(authenticator, session, acceptor.sequence)
+    if (err != nil) {
+        return nil, false, err
+    }
+
+    return krb5Frame(KRB5_TOK_AP_REP, apRep), true, nil
+}
+
+func (acceptor *KerberosAcceptor) Principal() (string) {
+    return acceptor.principal
+}
+
+// A Wrap token, sealed with confidentiality, signed otherwise
+func (acceptor *KerberosAcceptor) Wrap(data []byte, confidential bool) ([]byte, error) {
+
+    if (!acceptor.complete) {
+        return nil, errors.New("Kerberos context is not established")
+    }
+
+    etype, err := crypto.GetEtype(acceptor.key.KeyType)
+    if (err != nil) {
+        return nil, err
+    }
+
+    var header []byte = make([]byte, KRB5_WRAP_HEADER)
+    binary.BigEndian.PutUint16(header[0:2], KRB5_TOK_WRAP)
+    header[2] = KRB5_WRAP_SENT_BY_ACCEPTOR
+    header[3] = 0xFF
+    binary.BigEndian.PutUint64(header[8:16], atomic.AddUint64(&acceptor.sequence, 1) - 1)
+
+    // EC and RRC are 0 in the checksummed or encrypted copy of the header
+    var message []byte = make([]byte, 0, len(data) + KRB5_WRAP_HEADER)
+    message = append(append(message, data...), header...)
+
+    if (confidential) {
+        header[2] |= KRB5_WRAP_SEALED
+        message[len(data) + 2] = header[2]
+
+        _, sealed, err := etype.EncryptMessage(acceptor.key.KeyValue, message, keyusage.GSSAPI_ACCEPTOR_SEAL)
+        if (err != nil) {
+            return nil, err
+        }
+
+        return append(header, sealed...), nil
+    }
+
+    checksum, err := etype.GetChecksumHash(acceptor.key.KeyValue, message, keyusage.GSSAPI_ACCEPTOR_SEAL)
+    if (err != nil) {
+        return nil, err
+    }
+
+    binary.BigEndian.PutUint16(header[4:6], uint16(len(checksum)))
+
+    var token []byte = make([]byte, 0, KRB5_WRAP_HEADER + len(data) + len(checksum))
+
+    return append(append(append(token, header...), data...), checksum...), nil
+}
+
+// Verifies and opens a Wrap token of the initiator. The tokens come
+// over the TCP connection, each has to carry the next sequence number:
+// a replayed, dropped or reordered token is an error.
+func (acceptor *KerberosAcceptor) Unwrap(token []byte) ([]byte, error) {
+
+    if (!acceptor.complete) {
+        return nil, errors.New("Kerberos context is not established")
+    }
+
+    if ((len(token) < KRB5_WRAP_HEADER) || (binary.BigEndian.Uint16(token[0:2]) != KRB5_TOK_WRAP) || (token[3] != 0xFF)) {
+        return nil, errors.New("Malformed Kerberos Wrap token")
+    }
+
+    var flags byte = token[2]
+    if ((flags & (KRB5_WRAP_SENT_BY_ACCEPTOR | KRB5_WRAP_ACCEPTOR_SUBKEY)) != 0) {
+        return nil, errors.New("Kerberos Wrap token was not sent by the initiator")
+    }
+
+    etype, err := crypto.GetEtype(acceptor.key.KeyType)
+    if (err != nil) {
+        return nil, err
+    }
+
+    var ec int = int(binary.BigEndian.Uint16(token[4:6]))
+    var rrc int = int(binary.BigEndian.Uint16(token[6:8]))
+    var body []byte = krb5Unrotate(token[KRB5_WRAP_HEADER:], rrc)
+
+    if ((flags & KRB5_WRAP_SEALED) != 0) {
+        plain, err := etype.DecryptMessage(acceptor.key.KeyValue, body, keyusage.GSSAPI_INITIATOR_SEAL)
+        if (err != nil) {
+            return nil, errors.New("Kerberos Wrap token: " + err.Error())
+        }
+        if (len(plain) < ec + KRB5_WRAP_HEADER) {
+            return nil, errors.New("Malformed Kerberos Wrap token")
+        }
+
+        // The encrypted header is the one sent, but for RRC
+        var inner []byte = plain[len(plain) - KRB5_WRAP_HEADER:]
+        if (!bytes.Equal(inner[0:6], token[0:6]) || !bytes.Equal(inner[8:16], token[8:16])) {
+            return nil, errors.New("Kerberos Wrap token header was modified")
+        }
+
+        if err = acceptor.next(token); err != nil {
+            return nil, err
+        }
+
+        return plain[:len(plain) - KRB5_WRAP_HEADER - ec], nil
+    }
+
+    if (len(body) < ec) {
+        return nil, errors.New("Malformed Kerberos Wrap token")
+    }
+
+    var data []byte = body[:len(body) - ec]
+    var message []byte = make([]byte, 0, len(data) + KRB5_WRAP_HEADER)
+    message = append(append(message, data...), token[:KRB5_WRAP_HEADER]...)
+
+    // EC and RRC are not covered by the checksum
+    copy(message[len(data) + 4:len(data) + 8], []byte{ 0, 0, 0, 0 })
+
+    if (!etype.VerifyChecksum(acceptor.key.KeyValue, message, body[len(body) - ec:], keyusage.GSSAPI_INITIATOR_SEAL)) {
+        return nil, errors.New("Kerberos Wrap token checksum mismatch")
+    }
+
+    if err = acceptor.next(token); err != nil {
+        return nil, err
+    }
+
+    return data, nil
+}
+
+/* RFC 4121
+   The receiver should check the sequence number field against the
+   expected value, and provide indications of duplicate, out of
+   sequence, or gap tokens.
+
+   Any of them on a TCP connection means a replayed or dropped token, it
+   is an error. Only a verified token moves the expected number on.
+*/
+func (acceptor *KerberosAcceptor) next(token []byte) (error) {
+
+    var sequence uint64 = binary.BigEndian.Uint64(token[8:16])
+
+    if (sequence != acceptor.expected) {
+        return fmt.Errorf("Kerberos Wrap token out of sequence: %d, expected %d", sequence, acceptor.expected)
+    }
+
+    acceptor.expected++
+
+    return nil
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+
+// The token ID and the Kerberos message of an initial context token
+func krb5Unframe(token []byte) (uint16, []byte, error) {
+
+    var outer asn1.RawValue
+    if _, err := asn1.Unmarshal(token, &outer); err != nil {
+        return 0, nil, errors.New("Malformed GSS-API token: " + err.Error())
+    }
+
+    if ((outer.Class != asn1.ClassApplication) || (outer.Tag != 0)) {
+        return 0, nil, errors.New("Malformed GSS-API token")
+    }
+
+    var mechanism asn1.ObjectIdentifier
+    inner, err := asn1.Unmarshal(outer.Bytes, &mechanism)
+    if (err != nil) {
+        return 0, nil, errors.New("Malformed GSS-API token: " + err.Error())
+    }
+
+    if (!mechanism.Equal(KRB5_MECHANISM)) {
+        return 0, nil, errors.New("Unsupported GSS-API mechanism: " + mechanism.String())
+    }
+
+    if (len(inner) < 2) {
+        return 0, nil, errors.New("Malformed GSS-API token")
+    }
+
+    return binary.BigEndian.Uint16(inner[0:2]), inner[2:], nil
+}
+
+func krb5Frame(id uint16, message []byte) ([]byte) {
+
+    mechanism, _ := asn1.Marshal(KRB5_MECHANISM)
+
+    var content []byte = append(mechanism, byte(id >> 8), byte(id & 0xFF))
+    content = append(content, message...)
+
+    token, _ := asn1.Marshal(asn1.RawValue{ Class : asn1.ClassApplication, Tag : 0, IsCompound : true, Bytes : content })
+
+    return token
+}
+
+// Mutual authentication is asked by the AP options or the context flags
+func krb5Mutual(apReq *messages.APReq) (bool) {
+
+    if (types.IsFlagSet(&apReq.APOptions, flags.APOptionMutualRequired)) {
+        return true
+    }
+
+    var checksum types.Checksum = apReq.Authenticator.Cksum
+    if ((checksum.CksumType != KRB5_GSS_CHECKSUM) || (len(checksum.Checksum) < 24)) {
+        return false
+    }
+
+    return (binary.LittleEndian.Uint32(checksum.Checksum[20:24]) & KRB5_GSS_MUTUAL_FLAG) != 0
+}
+
+// The AP-REP echoing the authenticator's time, with the acceptor's
+// initial sequence number
+func krb5APRep(authenticator types.Authenticator, session types.EncryptionKey, sequence uint64) ([]byte, error) {
+
+    encPart, err := asn1.Marshal(messages.EncAPRepPart{ CTime : authenticator.CTime, Cusec : authenticator.Cusec, SequenceNumber : int64(sequence) })
+    if (err != nil) {
+        return nil, err
+    }
+
+    encrypted, err := crypto.GetEncryptedData(asn1tools.AddASNAppTag(encPart, asnAppTag.EncAPRepPart), session, keyusage.AP_REP_ENCPART, 0)
+    if (err != nil) {
+        return nil, err
+    }
+
+    apRep, err := asn1.Marshal(messages.APRep{ PVNO : iana.PVNO, MsgType : msgtype.KRB_AP_REP, EncPart : encrypted })
+    if (err != nil) {
+        return nil, err
+    }
+
+    return asn1tools.AddASNAppTag(apRep, asnAppTag.APREP), nil
+}
+
+// A random initial sequence number, never 0 which the AP-REP can't carry
+func krb5Sequence() (uint64, error) {
+
+    var random []byte = make([]byte, 4)
+    if _, err := rand.Read(random); err != nil {
+        return 0, err
+    }
+
+    return uint64(binary.BigEndian.Uint32(random) & 0x3FFFFFFF) | 1, nil
+}
+
+// Undo the right rotation of RRC octets
+func krb5Unrotate(data []byte, rrc int) ([]byte) {
+
+    if (len(data) == 0) {
+        return data
+    }
+
+    rrc = rrc % len(data)
+    if (rrc == 0) {
+        return data
+    }
+
+    var unrotated []byte = make([]byte, 0, len(data))
+
+    return append(append(unrotated, data[rrc:]...), data[:rrc]...)
+}
+
+// The enctypes of RFC 4121 tokens
+func krb5Wrappable(keyType int32) (bool) {
+
+    switch (keyType) {
+        case etypeID.AES128_CTS_HMAC_SHA1_96, etypeID.AES256_CTS_HMAC_SHA1_96, etypeID.AES128_CTS_HMAC_SHA256_128, etypeID.AES256_CTS_HMAC_SHA384_192:
+            return true
+    }
+
+    return false
+}
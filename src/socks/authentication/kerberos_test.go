@@ -0,0 +1,471 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package authentication
+
+import (
+        "bufio"
+        "bytes"
+        "encoding/binary"
+        "io"
+        "net"
+        "os"
+        "path/filepath"
+        "testing"
+        "time"
+        "socks/config"
+        "socks/context"
+        "github.com/jcmturner/gokrb5/v8/crypto"
+        "github.com/jcmturner/gokrb5/v8/gssapi"
+        "github.com/jcmturner/gokrb5/v8/iana/etypeID"
+        "github.com/jcmturner/gokrb5/v8/iana/keyusage"
+        "github.com/jcmturner/gokrb5/v8/iana/nametype"
+        "github.com/jcmturner/gokrb5/v8/keytab"
+        "github.com/jcmturner/gokrb5/v8/messages"
+        "github.com/jcmturner/gokrb5/v8/types"
+)
+
+/* The KDC is played by the test: the service keytab is made from a
+   password, the tickets are issued with it the way a KDC would, and the
+   AP-REQs are built from them the way the client's GSS-API library does.
+*/
+const (
+        TEST_REALM		= "EXAMPLE.COM"
+        TEST_SERVICE		= "rcmd/proxy.example.com"
+        TEST_CLIENT		= "alice"
+        TEST_ETYPE		= etypeID.AES256_CTS_HMAC_SHA1_96
+)
+
+// What the client knows after building an AP-REQ
+type testInitiator struct {
+        token		[]byte
+        session		types.EncryptionKey
+        key			types.EncryptionKey
+        authenticator	types.Authenticator
+}
+
+func testKeytab(t *testing.T, password string) (*keytab.Keytab, string) {
+
+    kt := keytab.New()
+    if err := kt.AddEntry(TEST_SERVICE, TEST_REALM, password, time.Now(), 1, TEST_ETYPE); err != nil {
+        t.Fatalf("keytab: %v", err)
+    }
+
+    data, err := kt.Marshal()
+    if (err != nil) {
+        t.Fatalf("keytab: %v", err)
+    }
+
+    var path string = filepath.Join(t.TempDir(), "krb5.keytab")
+    if err = os.WriteFile(path, data, 0600); err != nil {
+        t.Fatalf("keytab: %v", err)
+    }
+
+    return kt, path
+}
+
+// An AP-REQ for service issued with the keys of kt, with a subkey when
+// asked, and the mutual flag in the GSS checksum
+func testAPReq(t *testing.T, kt *keytab.Keytab, service string, mutual bool, subkey bool) (*testInitiator) {
+
+    var now time.Time = time.Now().UTC()
+    var cname types.PrincipalName = types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, TEST_CLIENT)
+    var sname types.PrincipalName = types.NewPrincipalName(nametype.KRB_NT_SRV_INST, service)
+
+    ticket, session, err := messages.NewTicket(cname, TEST_REALM, sname, TEST_REALM, types.NewKrbFlags(), kt, TEST_ETYPE, 1, now, now, now.Add(time.Hour), now.Add(time.Hour))
+    if (err != nil) {
+        t.Fatalf("ticket: %v", err)
+    }
+
+    authenticator, err := types.NewAuthenticator(TEST_REALM, cname)
+    if (err != nil) {
+        t.Fatalf("authenticator: %v", err)
+    }
+
+    var initiator *testInitiator = &testInitiator{ session : session, key : session }
+
+    if (subkey) {
+        etype, _ := crypto.GetEtype(TEST_ETYPE)
+        authenticator.GenerateSeqNumberAndSubKey(TEST_ETYPE, etype.GetKeyByteSize())
+        initiator.key = authenticator.SubKey
+    }
+
+    // Lgth, Bnd, Flags
+    var checksum []byte = make([]byte, 24)
+    binary.LittleEndian.PutUint32(checksum[0:4], 16)
+    if (mutual) {
+        binary.LittleEndian.PutUint32(checksum[20:24], KRB5_GSS_MUTUAL_FLAG)
+    }
+    authenticator.Cksum = types.Checksum{ CksumType : KRB5_GSS_CHECKSUM, Checksum : checksum }
+
+    apReq, err := messages.NewAPReq(ticket, session, authenticator)
+    if (err != nil) {
+        t.Fatalf("AP-REQ: %v", err)
+    }
+
+    data, err := apReq.Marshal()
+    if (err != nil) {
+        t.Fatalf("AP-REQ: %v", err)
+    }
+
+    initiator.token = krb5Frame(KRB5_TOK_AP_REQ, data)
+    initiator.authenticator = authenticator
+
+    return initiator
+}
+
+func testAcceptor(t *testing.T, path string, service string) (*KerberosAcceptor) {
+
+    acceptor, err := NewKerberosAcceptor(&config.GssapiConf{ Keytab : path, Service : service }, &net.TCPAddr{ IP : net.IPv4(127, 0, 0, 1), Port : 40000 })
+    if (err != nil) {
+        t.Fatalf("acceptor: %v", err)
+    }
+
+    return acceptor.(*KerberosAcceptor)
+}
+
+// A signed Wrap token of the initiator
+func testSign(t *testing.T, key types.EncryptionKey, data []byte, sequence uint64) ([]byte) {
+
+    etype, _ := crypto.GetEtype(key.KeyType)
+
+    var wrap gssapi.WrapToken = gssapi.WrapToken{ EC : uint16(etype.GetHMACBitLength() / 8), SndSeqNum : sequence, Payload : data }
+    if err := wrap.SetCheckSum(key, keyusage.GSSAPI_INITIATOR_SEAL); err != nil {
+        t.Fatalf("sign: %v", err)
+    }
+
+    token, err := wrap.Marshal()
+    if (err != nil) {
+        t.Fatalf("sign: %v", err)
+    }
+
+    return token
+}
+
+// A sealed Wrap token of the initiator, rotated by rrc
+func testSeal(t *testing.T, key types.EncryptionKey, data []byte, sequence uint64, rrc int) ([]byte) {
+
+    var header []byte = []byte{ 0x05, 0x04, KRB5_WRAP_SEALED, 0xFF, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0 }
+    binary.BigEndian.PutUint64(header[8:16], sequence)
+
+    etype, _ := crypto.GetEtype(key.KeyType)
+    _, sealed, err := etype.EncryptMessage(key.KeyValue, append(append([]byte{}, data...), header...), keyusage.GSSAPI_INITIATOR_SEAL)
+    if (err != nil) {
+        t.Fatalf("seal: %v", err)
+    }
+
+    binary.BigEndian.PutUint16(header[6:8], uint16(rrc))
+    sealed = append(append([]byte{}, sealed[len(sealed) - rrc:]...), sealed[:len(sealed) - rrc]...)
+
+    return append(header, sealed...)
+}
+
+// Opens a Wrap token of the acceptor, sealed or not
+func testOpen(t *testing.T, key types.EncryptionKey, token []byte) ([]byte, uint64) {
+
+    if ((token[2] & KRB5_WRAP_SENT_BY_ACCEPTOR) == 0) {
+        t.Fatalf("token flags 0x%02x: not sent by the acceptor", token[2])
+    }
+
+    if ((token[2] & KRB5_WRAP_SEALED) == 0) {
+        var wrap gssapi.WrapToken
+        if err := wrap.Unmarshal(token, true); err != nil {
+            t.Fatalf("unmarshal: %v", err)
+        }
+        if _, err := wrap.Verify(key, keyusage.GSSAPI_ACCEPTOR_SEAL); err != nil {
+            t.Fatalf("verify: %v", err)
+        }
+        return wrap.Payload, wrap.SndSeqNum
+    }
+
+    etype, _ := crypto.GetEtype(key.KeyType)
+    plain, err := etype.DecryptMessage(key.KeyValue, token[KRB5_WRAP_HEADER:], keyusage.GSSAPI_ACCEPTOR_SEAL)
+    if (err != nil) {
+        t.Fatalf("unseal: %v", err)
+    }
+
+    var ec int = int(binary.BigEndian.Uint16(token[4:6]))
+    if (!bytes.Equal(plain[len(plain) - KRB5_WRAP_HEADER:], token[:KRB5_WRAP_HEADER])) {
+        t.Fatalf("sealed header differs")
+    }
+
+    return plain[:len(plain) - KRB5_WRAP_HEADER - ec], binary.BigEndian.Uint64(token[8:16])
+}
+
+/*----------------------------------------------------------
+    Context establishment
+-----------------------------------------------------------*/
+
+func TestKerberosMutualAuthentication(t *testing.T) {
+
+    kt, path := testKeytab(t, "service secret")
+    initiator := testAPReq(t, kt, TEST_SERVICE, true, false)
+    acceptor := testAcceptor(t, path, "rcmd")
+
+    output, complete, err := acceptor.Accept(initiator.token)
+    if (err != nil) {
+        t.Fatalf("Accept: %v", err)
+    }
+    if (!complete) {
+        t.Fatalf("context not complete after the AP-REQ")
+    }
+    if principal := acceptor.Principal(); principal != TEST_CLIENT + "@" + TEST_REALM {
+        t.Errorf("Principal() = %q", principal)
+    }
+
+    id, inner, err := krb5Unframe(output)
+    if ((err != nil) || (id != KRB5_TOK_AP_REP)) {
+        t.Fatalf("output is not an AP-REP: %04x %v", id, err)
+    }
+
+    var apRep messages.APRep
+    if err = apRep.Unmarshal(inner); err != nil {
+        t.Fatalf("AP-REP: %v", err)
+    }
+
+    plain, err := crypto.DecryptEncPart(apRep.EncPart, initiator.session, keyusage.AP_REP_ENCPART)
+    if (err != nil) {
+        t.Fatalf("AP-REP with the session key: %v", err)
+    }
+
+    var encPart messages.EncAPRepPart
+    if err = encPart.Unmarshal(plain); err != nil {
+        t.Fatalf("AP-REP part: %v", err)
+    }
+
+    if (!encPart.CTime.Equal(initiator.authenticator.CTime.Truncate(time.Second)) || (encPart.Cusec != initiator.authenticator.Cusec)) {
+        t.Errorf("AP-REP time %v/%d, authenticator %v/%d", encPart.CTime, encPart.Cusec, initiator.authenticator.CTime, initiator.authenticator.Cusec)
+    }
+
+    if (encPart.SequenceNumber == 0) {
+        t.Errorf("AP-REP has no sequence number")
+    }
+
+    // The acceptor numbers its tokens from the AP-REP
+    token, err := acceptor.Wrap([]byte("first"), false)
+    if (err != nil) {
+        t.Fatalf("Wrap: %v", err)
+    }
+    if _, sequence := testOpen(t, initiator.key, token); sequence != uint64(encPart.SequenceNumber) {
+        t.Errorf("first token sequence %d, AP-REP %d", sequence, encPart.SequenceNumber)
+    }
+}
+
+func TestKerberosWithoutMutualAuthentication(t *testing.T) {
+
+    kt, path := testKeytab(t, "service secret")
+    initiator := testAPReq(t, kt, TEST_SERVICE, false, true)
+    acceptor := testAcceptor(t, path, "")
+
+    output, complete, err := acceptor.Accept(initiator.token)
+    if ((err != nil) || !complete || (output != nil)) {
+        t.Fatalf("Accept = %d bytes, %v, %v; want no output, complete", len(output), complete, err)
+    }
+
+    // Without an AP-REP the initiator's sequence number is used
+    token, err := acceptor.Wrap([]byte("first"), false)
+    if (err != nil) {
+        t.Fatalf("Wrap: %v", err)
+    }
+    if _, sequence := testOpen(t, initiator.key, token); sequence != uint64(initiator.authenticator.SeqNumber) {
+        t.Errorf("first token sequence %d, authenticator %d", sequence, initiator.authenticator.SeqNumber)
+    }
+}
+
+func TestKerberosRejects(t *testing.T) {
+
+    kt, path := testKeytab(t, "service secret")
+    other, _ := testKeytab(t, "another secret")
+
+    replayed := testAPReq(t, kt, TEST_SERVICE, true, false)
+    if _, _, err := testAcceptor(t, path, "").Accept(replayed.token); err != nil {
+        t.Fatalf("first AP-REQ: %v", err)
+    }
+
+    var mechanism []byte = krb5Frame(KRB5_TOK_AP_REQ, nil)
+    mechanism[len(mechanism) - 3]++
+
+    tests := []struct {
+        name		string
+        service		string
+        token		[]byte
+    }{
+        { "wrong service", "ftp", testAPReq(t, kt, TEST_SERVICE, true, false).token },
+        { "other service key", "", testAPReq(t, other, TEST_SERVICE, true, false).token },
+        { "replay", "", replayed.token },
+        { "not a GSS token", "", []byte{ 0x30, 0x03, 0x02, 0x01, 0x05 } },
+        { "other mechanism", "", mechanism },
+        { "truncated", "", replayed.token[:len(replayed.token) / 2] },
+        { "AP-REP", "", krb5Frame(KRB5_TOK_AP_REP, nil) },
+    }
+
+    for _, test := range tests {
+        acceptor := testAcceptor(t, path, test.service)
+        if _, complete, err := acceptor.Accept(test.token); (err == nil) || complete {
+            t.Errorf("%s: Accept = %v, %v; want an error", test.name, complete, err)
+        }
+        if _, err := acceptor.Wrap([]byte("data"), true); err == nil {
+            t.Errorf("%s: Wrap without a context", test.name)
+        }
+    }
+
+    if _, err := NewKerberosAcceptor(&config.GssapiConf{ Keytab : filepath.Join(t.TempDir(), "missing") }, nil); err == nil {
+        t.Errorf("missing keytab accepted")
+    }
+}
+
+/*----------------------------------------------------------
+    Per-message protection
+-----------------------------------------------------------*/
+
+func TestKerberosWrap(t *testing.T) {
+
+    kt, path := testKeytab(t, "service secret")
+    initiator := testAPReq(t, kt, TEST_SERVICE, true, true)
+    acceptor := testAcceptor(t, path, "")
+
+    if _, _, err := acceptor.Accept(initiator.token); err != nil {
+        t.Fatalf("Accept: %v", err)
+    }
+
+    var message []byte = []byte("GET / HTTP/1.0\r\n\r\n")
+
+    for _, confidential := range []bool{ false, true } {
+        token, err := acceptor.Wrap(message, confidential)
+        if (err != nil) {
+            t.Fatalf("Wrap(%v): %v", confidential, err)
+        }
+        if sealed := (token[2] & KRB5_WRAP_SEALED) != 0; sealed != confidential {
+            t.Errorf("Wrap(%v) sealed flag %v", confidential, sealed)
+        }
+        if (confidential && bytes.Contains(token, message)) {
+            t.Errorf("sealed token carries the plain text")
+        }
+        if data, _ := testOpen(t, initiator.key, token); !bytes.Equal(data, message) {
+            t.Errorf("Wrap(%v) = %q", confidential, data)
+        }
+    }
+
+    // The initiator numbers its tokens from the authenticator's number
+    var first uint64 = uint64(initiator.authenticator.SeqNumber)
+    signedToken := testSign(t, initiator.key, message, first)
+
+    tests := []struct {
+        name		string
+        token		[]byte
+    }{
+        { "signed", signedToken },
+        { "sealed", testSeal(t, initiator.key, message, first + 1, 0) },
+        { "sealed and rotated", testSeal(t, initiator.key, message, first + 2, 28) },
+    }
+
+    for _, test := range tests {
+        data, err := acceptor.Unwrap(test.token)
+        if ((err != nil) || !bytes.Equal(data, message)) {
+            t.Errorf("%s: Unwrap = %q, %v", test.name, data, err)
+        }
+    }
+
+    // Tampered, reflected, malformed, replayed and skipping tokens
+    tampered := testSeal(t, initiator.key, message, first + 3, 0)
+    tampered[len(tampered) - 1] ^= 0x01
+
+    modified := testSign(t, initiator.key, message, first + 3)
+    modified[KRB5_WRAP_HEADER] ^= 0x01
+
+    reflected, _ := acceptor.Wrap(message, true)
+
+    for name, token := range map[string][]byte{ "tampered sealed": tampered,
+                                                "tampered signed": modified,
+                                                "reflected": reflected,
+                                                "short": signedToken[:10],
+                                                "replayed signed": signedToken,
+                                                "replayed sealed": testSeal(t, initiator.key, message, first + 1, 0),
+                                                "gap": testSeal(t, initiator.key, message, first + 4, 0) } {
+        if data, err := acceptor.Unwrap(token); err == nil {
+            t.Errorf("%s: Unwrap = %q, want an error", name, data)
+        }
+    }
+
+    // None of them moved the expected number on
+    if data, err := acceptor.Unwrap(testSign(t, initiator.key, message, first + 3)); (err != nil) || !bytes.Equal(data, message) {
+        t.Errorf("next token: Unwrap = %q, %v", data, err)
+    }
+}
+
+// The whole RFC 1961 subnegotiation, then an encapsulated message
+func TestGssAPIAuthenticate(t *testing.T) {
+
+    kt, path := testKeytab(t, "service secret")
+    initiator := testAPReq(t, kt, TEST_SERVICE, true, false)
+
+    client, server := net.Pipe()
+    defer client.Close()
+
+    var done chan error = make(chan error, 1)
+
+    go func() {
+        defer server.Close()
+
+        conf := &config.Config{ Gssapi : config.GssapiConf{ Keytab : path, Service : "rcmd" } }
+        contxt, err := context.New(server, conf, &config.ListenerConf{})
+        if (err != nil) {
+            done <- err
+            return
+        }
+        contxt.Reader().ReadByte()
+
+        if _, err = NewGssAPIAuthentication().Authenticate(contxt); err != nil {
+            done <- err
+            return
+        }
+
+        if (contxt.Username() != TEST_CLIENT + "@" + TEST_REALM) {
+            t.Errorf("username %q", contxt.Username())
+        }
+
+        _, err = (*contxt.Connection()).Write([]byte("hello"))
+        done <- err
+    }()
+
+    var reader *bufio.Reader = bufio.NewReader(client)
+    var writer *bufio.Writer = bufio.NewWriter(client)
+
+    writer.WriteByte(0x05)
+    gssWrite(writer, GSSAPI_MTYP_AUTH, initiator.token)
+
+    if mtyp, _, err := gssRead(reader); (err != nil) || (mtyp != GSSAPI_MTYP_AUTH) {
+        t.Fatalf("AP-REP message: %d %v", mtyp, err)
+    }
+
+    // Ask for confidentiality, the protection message is only signed
+    token := testSign(t, initiator.key, []byte{ GSSAPI_PROTECTION_CONFIDENTIALITY }, uint64(initiator.authenticator.SeqNumber))
+    gssWrite(writer, GSSAPI_MTYP_PROTECTION, token)
+
+    mtyp, token, err := gssRead(reader)
+    if ((err != nil) || (mtyp != GSSAPI_MTYP_PROTECTION)) {
+        t.Fatalf("protection message: %d %v", mtyp, err)
+    }
+    if level, _ := testOpen(t, initiator.key, token); !bytes.Equal(level, []byte{ GSSAPI_PROTECTION_CONFIDENTIALITY }) {
+        t.Fatalf("protection level %v", level)
+    }
+
+    mtyp, token, err = gssRead(reader)
+    if ((err != nil) || (mtyp != GSSAPI_MTYP_ENCAPSULATION)) {
+        t.Fatalf("encapsulated message: %d %v", mtyp, err)
+    }
+    if ((token[2] & KRB5_WRAP_SEALED) == 0) {
+        t.Errorf("encapsulated message is not sealed")
+    }
+    if data, _ := testOpen(t, initiator.key, token); string(data) != "hello" {
+        t.Errorf("encapsulated message %q", data)
+    }
+
+    if err = <-done; (err != nil) && (err != io.EOF) {
+        t.Fatalf("server: %v", err)
+    }
+}
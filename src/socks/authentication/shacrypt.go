@@ -0,0 +1,207 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package authentication
+
+import (
+        "crypto/sha256"
+        "crypto/sha512"
+        "errors"
+        "hash"
+        "strconv"
+        "strings"
+)
+
+/* SHA-crypt ("Unix crypt using SHA-256 and SHA-512", U. Drepper)
+   Hashes look like:
+
+        $5$rounds=<N>$<salt>$<hash>        (SHA-256)
+        $6$rounds=<N>$<salt>$<hash>        (SHA-512)
+
+   'rounds=<N>$' is optional, the default is 5000 rounds.
+*/
+const (
+        SHACRYPT_DEFAULT_ROUNDS	= 5000
+        SHACRYPT_MIN_ROUNDS		= 1000
+        SHACRYPT_MAX_ROUNDS		= 999999999
+        SHACRYPT_MAX_SALT		= 16
+)
+
+const shacryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Byte order of the final digest when it is encoded
+var shacrypt256Order = [][]int{ {0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+                                {15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29} }
+
+var shacrypt512Order = [][]int{ {0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+                                {47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+                                {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+                                {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+                                {62, 20, 41} }
+
+/*----------------------------------------------------------
+    SHA-crypt Implementation
+-----------------------------------------------------------*/
+
+// Compute the SHA-crypt hash of password using the settings (id, rounds
+// and salt) found in hashed, returns the full hash string.
+func shaCrypt(password string, hashed string) (string, error) {
+
+    var newHash func() hash.Hash
+    var order [][]int
+
+    switch {
+        case strings.HasPrefix(hashed, "$5$"):
+            newHash, order = sha256.New, shacrypt256Order
+            break
+        case strings.HasPrefix(hashed, "$6$"):
+            newHash, order = sha512.New, shacrypt512Order
+            break
+        default:
+            return "", errors.New("Not a SHA-crypt hash")
+    }
+
+    var prefix string = hashed[:3]
+    var rest string = hashed[3:]
+    var rounds int = SHACRYPT_DEFAULT_ROUNDS
+    var customRounds bool = false
+
+    if (strings.HasPrefix(rest, "rounds=")) {
+        index := strings.IndexByte(rest, '$')
+        if (index < 0) {
+            return "", errors.New("Malformed SHA-crypt rounds")
+        }
+        value, err := strconv.Atoi(rest[len("rounds="):index])
+        if (err != nil) {
+            return "", errors.New("Malformed SHA-crypt rounds")
+        }
+        if (value < SHACRYPT_MIN_ROUNDS) {
+            value = SHACRYPT_MIN_ROUNDS
+        }
+        if (value > SHACRYPT_MAX_ROUNDS) {
+            value = SHACRYPT_MAX_ROUNDS
+        }
+        rounds, customRounds = value, true
+        rest = rest[index + 1:]
+    }
+
+    // Salt ends at the next '$', at most 16 characters
+    var salt string = rest
+    if index := strings.IndexByte(rest, '$'); index >= 0 {
+        salt = rest[:index]
+    }
+    if (len(salt) > SHACRYPT_MAX_SALT) {
+        salt = salt[:SHACRYPT_MAX_SALT]
+    }
+
+    var pw []byte = []byte(password)
+    var sl []byte = []byte(salt)
+
+    // Digest B
+    digest := newHash()
+    digest.Write(pw)
+    digest.Write(sl)
+    digest.Write(pw)
+    var b []byte = digest.Sum(nil)
+
+    var size int = len(b)
+
+    // Digest A
+    digest = newHash()
+    digest.Write(pw)
+    digest.Write(sl)
+    for i := len(pw); i > 0; i -= size {
+        digest.Write(b[:min(i, size)])
+    }
+    for i := len(pw); i > 0; i >>= 1 {
+        if ((i & 1) != 0) {
+            digest.Write(b)
+        } else {
+            digest.Write(pw)
+        }
+    }
+    var a []byte = digest.Sum(nil)
+
+    // Byte sequence P
+    digest = newHash()
+    for i := 0; i < len(pw); i++ {
+        digest.Write(pw)
+    }
+    var p []byte = repeat(digest.Sum(nil), len(pw))
+
+    // Byte sequence S
+    digest = newHash()
+    for i := 0; i < 16 + int(a[0]); i++ {
+        digest.Write(sl)
+    }
+    var s []byte = repeat(digest.Sum(nil), len(sl))
+
+    // The rounds
+    var c []byte = a
+    for i := 0; i < rounds; i++ {
+        digest = newHash()
+        if ((i & 1) != 0) {
+            digest.Write(p)
+        } else {
+            digest.Write(c)
+        }
+        if ((i % 3) != 0) {
+            digest.Write(s)
+        }
+        if ((i % 7) != 0) {
+            digest.Write(p)
+        }
+        if ((i & 1) != 0) {
+            digest.Write(c)
+        } else {
+            digest.Write(p)
+        }
+        c = digest.Sum(nil)
+    }
+
+    // Encode the result
+    var builder strings.Builder
+    builder.WriteString(prefix)
+    if (customRounds) {
+        builder.WriteString("rounds=" + strconv.Itoa(rounds) + "$")
+    }
+    builder.WriteString(salt)
+    builder.WriteByte('$')
+
+    for _, v := range order {
+        encode64(&builder, c[v[0]], c[v[1]], c[v[2]], 4)
+    }
+    if (size == sha256.Size) {
+        encode64(&builder, 0, c[31], c[30], 3)
+    } else {
+        encode64(&builder, 0, 0, c[63], 2)
+    }
+
+    return builder.String(), nil
+}
+
+func encode64(builder *strings.Builder, b2 byte, b1 byte, b0 byte, n int) {
+
+    var w uint = (uint(b2) << 16) | (uint(b1) << 8) | uint(b0)
+
+    for ; n > 0; n-- {
+        builder.WriteByte(shacryptAlphabet[w & 0x3f])
+        w >>= 6
+    }
+}
+
+// Repeat digest until length bytes are filled
+func repeat(digest []byte, length int) ([]byte) {
+
+    var bytes []byte = make([]byte, 0, length)
+
+    for len(bytes) < length {
+        bytes = append(bytes, digest[:min(length - len(bytes), len(digest))]...)
+    }
+
+    return bytes
+}
@@ -0,0 +1,63 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package authentication
+
+import (
+        "testing"
+)
+
+// The test vectors of the SHA-crypt specification
+func TestShaCrypt(t *testing.T) {
+
+    var cases = []struct {
+        settings		string
+        password		string
+        hashed		string
+    }{
+        { "$5$saltstring", "Hello world!",
+          "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5" },
+        { "$5$rounds=10000$saltstringsaltstring", "Hello world!",
+          "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA" },
+        { "$5$rounds=5000$toolongsaltstring", "This is just a test",
+          "$5$rounds=5000$toolongsaltstrin$Un/5jzAHMgOGZ5.mWJpuVolil07guHPvOW8mGRcvxa5" },
+        { "$5$rounds=10$roundstoolow", "the minimum number is still observed",
+          "$5$rounds=1000$roundstoolow$yfvwcWrQ8l/K0DAWyuPMDNHpIVlTQebY9l/gL972bIC" },
+        { "$6$saltstring", "Hello world!",
+          "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1" },
+        { "$6$rounds=10000$saltstringsaltstring", "Hello world!",
+          "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v." },
+        { "$6$rounds=1400$anotherlongsaltstring", "a very much longer text to encrypt.  This one even stretches over morethan one line.",
+          "$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1" },
+        { "$6$rounds=10$roundstoolow", "the minimum number is still observed",
+          "$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX." },
+        { "$6$salt", "",
+          "$6$salt$r6qPcj2UeIkfklWHvleGJk8OKTInFYR/fxyuwcC656IWiZBpIFZ9.hMRG2ZQnnyMFrKOe461f9iT9Ljn0wJ5l." },
+    }
+
+    for _, test := range cases {
+
+        hashed, err := shaCrypt(test.password, test.settings)
+        if ((err != nil) || (hashed != test.hashed)) {
+            t.Errorf("%s: %s %v, want %s", test.settings, hashed, err, test.hashed)
+        }
+
+        // The full hash gives back the same settings
+        if hashed, _ = shaCrypt(test.password, test.hashed); hashed != test.hashed {
+            t.Errorf("%s: %s from the full hash", test.settings, hashed)
+        }
+    }
+}
+
+func TestShaCryptErrors(t *testing.T) {
+
+    for _, hashed := range []string{ "$1$salt$hash", "{SHA}hash", "$5$rounds=many$salt$hash", "$6$rounds=5000" } {
+        if _, err := shaCrypt("password", hashed); err == nil {
+            t.Errorf("%s: computed", hashed)
+        }
+    }
+}
@@ -0,0 +1,236 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package authentication
+
+import (
+        "bufio"
+        "crypto/sha1"
+        "crypto/subtle"
+        "encoding/base64"
+        "os"
+        "strings"
+        "sync"
+        "time"
+        "socks/log"
+        "socks/config"
+        "golang.org/x/crypto/bcrypt"
+)
+
+/* User database file, htpasswd style, one user per line:
+
+        # comment
+        alice:$6$rounds=5000$salt$hash
+        bob:$5$salt$hash
+        dave:$2y$10$salthash
+        carol:{SHA}base64-of-sha1
+
+   Supported hashes are SHA-crypt ($5$ SHA-256, $6$ SHA-512), bcrypt
+   ($2a$, $2b$, $2y$, the htpasswd -B default) and the htpasswd {SHA}
+   scheme. {SHA} is unsalted and only kept for old files, its users are
+   loaded with a warning. Lines using any other scheme (argon2, MD5,
+   ...) are skipped with a warning.
+*/
+
+// CredentialStore verifies a username/password pair
+type CredentialStore interface {
+    Verify (username string, password string) (bool)
+}
+
+// Single username/password pair from the config
+type StaticStore struct {
+    username		string
+    password		string
+}
+
+// Users loaded from a file, reloaded whenever the file changes
+type FileStore struct {
+    mutex		sync.RWMutex
+    path			string
+    modTime		time.Time
+    size			int64
+    users		map[string]string
+}
+
+// FileStores are shared by all the sessions, keyed by path
+var fileStores		map[string]*FileStore = make(map[string]*FileStore)
+var fileStoresLock	sync.Mutex
+
+/*----------------------------------------------------------
+    CredentialStore
+-----------------------------------------------------------*/
+
+// Returns the credential store for the config: the user database when
+// Auth.Userfile is set, otherwise the single configured user.
+func NewCredentialStore(conf *config.AuthConf) (CredentialStore) {
+
+    if (len(conf.Userfile) == 0) {
+        return &StaticStore{ username : conf.Username, password : conf.Password }
+    }
+
+    fileStoresLock.Lock()
+    defer fileStoresLock.Unlock()
+
+    store := fileStores[conf.Userfile]
+    if (store == nil) {
+        store = NewFileStore(conf.Userfile)
+        fileStores[conf.Userfile] = store
+    }
+
+    return store
+}
+
+/*----------------------------------------------------------
+    StaticStore Implementation
+-----------------------------------------------------------*/
+func (store *StaticStore) Verify(username string, password string) (bool) {
+
+    // Server is not configured for authentication
+    if ((len(store.username) == 0) || (len(store.password) == 0)) {
+        return false
+    }
+
+    var userOk int = subtle.ConstantTimeCompare([]byte(username), []byte(store.username))
+    var passOk int = subtle.ConstantTimeCompare([]byte(password), []byte(store.password))
+
+    return (userOk & passOk) == 1
+}
+
+/*----------------------------------------------------------
+    FileStore Implementation
+-----------------------------------------------------------*/
+func NewFileStore(path string) (*FileStore) {
+
+    store := &FileStore{ path : path, users : make(map[string]string) }
+    store.reload()
+
+    return store
+}
+
+func (store *FileStore) Verify(username string, password string) (bool) {
+
+    store.reload()
+
+    store.mutex.RLock()
+    hashed, found := store.users[username]
+    store.mutex.RUnlock()
+
+    if (!found) {
+        return false
+    }
+
+    return verifyHash(password, hashed)
+}
+
+// Re-read the file if its modification time or size has changed
+func (store *FileStore) reload() {
+
+    fileinfo, err := os.Stat(store.path)
+    if (err != nil) {
+        log.Errorf("Stat user file: %s\n", err.Error())
+        return
+    }
+
+    store.mutex.RLock()
+    var changed bool = !fileinfo.ModTime().Equal(store.modTime) || (fileinfo.Size() != store.size)
+    store.mutex.RUnlock()
+
+    if (!changed) {
+        return
+    }
+
+    file, err := os.Open(store.path)
+    if (err != nil) {
+        log.Errorf("Open user file: %s\n", err.Error())
+        return
+    }
+
+    defer file.Close()
+
+    var users map[string]string = make(map[string]string)
+    var scanner *bufio.Scanner = bufio.NewScanner(file)
+    var line int = 0
+
+    for scanner.Scan() {
+
+        line++
+
+        var text string = strings.TrimSpace(scanner.Text())
+
+        // Skip empty lines and comments
+        if ((len(text) == 0) || strings.HasPrefix(text, "#")) {
+            continue
+        }
+
+        index := strings.IndexByte(text, ':')
+        if (index <= 0) {
+            log.Warnf("User file %s line %d: malformed entry\n", store.path, line)
+            continue
+        }
+
+        var username string = text[:index]
+        var hashed string = text[index + 1:]
+
+        if (!supportedHash(hashed)) {
+            log.Warnf("User file %s line %d: unsupported hash for user '%s'\n", store.path, line, username)
+            continue
+        }
+
+        if (strings.HasPrefix(hashed, "{SHA}")) {
+            log.Warnf("User file %s line %d: user '%s' has a weak unsalted {SHA} hash, rehash it with bcrypt or SHA-crypt\n", store.path, line, username)
+        }
+
+        users[username] = hashed
+    }
+
+    if err = scanner.Err(); err != nil {
+        log.Errorf("Reading user file: %s\n", err.Error())
+        return
+    }
+
+    store.mutex.Lock()
+    store.users   = users
+    store.modTime = fileinfo.ModTime()
+    store.size    = fileinfo.Size()
+    store.mutex.Unlock()
+
+    log.Infof("User file %s loaded, %d users\n", store.path, len(users))
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+func supportedHash(hashed string) (bool) {
+    return strings.HasPrefix(hashed, "$5$") || strings.HasPrefix(hashed, "$6$") || bcryptHash(hashed) || strings.HasPrefix(hashed, "{SHA}")
+}
+
+func bcryptHash(hashed string) (bool) {
+    return strings.HasPrefix(hashed, "$2a$") || strings.HasPrefix(hashed, "$2b$") || strings.HasPrefix(hashed, "$2y$")
+}
+
+func verifyHash(password string, hashed string) (bool) {
+
+    var computed string
+
+    // bcrypt compares in constant time itself
+    if (bcryptHash(hashed)) {
+        return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) == nil
+    }
+
+    if (strings.HasPrefix(hashed, "{SHA}")) {
+        digest := sha1.Sum([]byte(password))
+        computed = "{SHA}" + base64.StdEncoding.EncodeToString(digest[:])
+    } else {
+        var err error
+        computed, err = shaCrypt(password, hashed)
+        if (err != nil) {
+            return false
+        }
+    }
+
+    return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1
+}
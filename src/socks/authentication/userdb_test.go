@@ -0,0 +1,138 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package authentication
+
+import (
+        "os"
+        "path/filepath"
+        "testing"
+        "time"
+        "socks/config"
+        "golang.org/x/crypto/bcrypt"
+)
+
+func TestFileStore(t *testing.T) {
+
+    dave, err := bcrypt.GenerateFromPassword([]byte("dave secret"), bcrypt.MinCost)
+    if (err != nil) {
+        t.Fatalf("bcrypt: %v", err)
+    }
+
+    var path string = writeUsers(t, filepath.Join(t.TempDir(), "users"), `
+# comment
+alice:$6$rounds=5000$alicesalt$Gm7u34MFYFK8wJ9I38bT0rFuJHuSryEKXSTLfXYmUYwfLjZgscuxlAMggc1/Wp2ilQVgntSrWXD5uqTdm6lcy0
+   bob:$5$bobsalt$QMAGR5R2KsJyqKGzzUgqU5/5wezRsL7DHctbZw58ep/
+
+carol:{SHA}yZcf4F42xqoI5dtSck2ebFx4o0c=
+dave:` + string(dave) + `
+erin:$1$md5salt$hash
+malformed line
+:$5$nobody$hash
+`)
+
+    var cases = []struct {
+        username		string
+        password		string
+        verified		bool
+    }{
+        { "alice", "alice secret", true },
+        { "alice", "bob secret", false },
+        { "bob", "bob secret", true },
+        { "carol", "carol secret", true },
+        { "carol", "carol", false },
+        { "dave", "dave secret", true },
+        { "dave", "dave", false },
+        // Skipped lines
+        { "erin", "", false },
+        { "", "", false },
+        { "mallory", "alice secret", false },
+    }
+
+    var store *FileStore = NewFileStore(path)
+
+    for _, test := range cases {
+        if verified := store.Verify(test.username, test.password); verified != test.verified {
+            t.Errorf("%s/%s: verified %v", test.username, test.password, verified)
+        }
+    }
+
+    if (len(store.users) != 4) {
+        t.Errorf("%d users loaded", len(store.users))
+    }
+}
+
+// A changed file is read again on the next Verify
+func TestFileStoreReload(t *testing.T) {
+
+    var path string = writeUsers(t, filepath.Join(t.TempDir(), "users"), "bob:$5$bobsalt$QMAGR5R2KsJyqKGzzUgqU5/5wezRsL7DHctbZw58ep/\n")
+    var store *FileStore = NewFileStore(path)
+
+    if (!store.Verify("bob", "bob secret")) {
+        t.Fatalf("bob not loaded")
+    }
+
+    writeUsers(t, path, "# bob left\n")
+    os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+
+    if (store.Verify("bob", "bob secret")) {
+        t.Fatalf("bob still verified")
+    }
+
+    // A missing file keeps the users last loaded
+    os.Remove(path)
+    if (store.Verify("bob", "bob secret") || (store.users == nil)) {
+        t.Fatalf("users after the file went")
+    }
+}
+
+func TestStaticStore(t *testing.T) {
+
+    var cases = []struct {
+        conf			config.AuthConf
+        username		string
+        password		string
+        verified		bool
+    }{
+        { config.AuthConf{ Username : "test", Password : "secret" }, "test", "secret", true },
+        { config.AuthConf{ Username : "test", Password : "secret" }, "test", "Secret", false },
+        { config.AuthConf{ Username : "test", Password : "secret" }, "tester", "secret", false },
+        // Nobody gets in without a configured user
+        { config.AuthConf{}, "", "", false },
+        { config.AuthConf{ Username : "test" }, "test", "", false },
+    }
+
+    for _, test := range cases {
+        if verified := NewCredentialStore(&test.conf).Verify(test.username, test.password); verified != test.verified {
+            t.Errorf("%+v %s/%s: verified %v", test.conf, test.username, test.password, verified)
+        }
+    }
+}
+
+// The sessions share the store of a user file
+func TestCredentialStoreShared(t *testing.T) {
+
+    var path string = writeUsers(t, filepath.Join(t.TempDir(), "users"), "")
+    var conf *config.AuthConf = &config.AuthConf{ Userfile : path }
+
+    if (NewCredentialStore(conf) != NewCredentialStore(&config.AuthConf{ Userfile : path })) {
+        t.Fatalf("user file loaded twice")
+    }
+}
+
+/*----------------------------------------------------------
+    Helpers
+-----------------------------------------------------------*/
+
+func writeUsers(t *testing.T, path string, content string) (string) {
+
+    if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+        t.Fatalf("user file: %v", err)
+    }
+
+    return path
+}
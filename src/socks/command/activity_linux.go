@@ -0,0 +1,48 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+//go:build linux
+
+package command
+
+import (
+        "net"
+        "syscall"
+        "time"
+        "unsafe"
+)
+
+// The kernel tells when a TCP connection last received data
+const KERNEL_ACTIVITY = true
+
+// How long ago conn last received data, from TCP_INFO. False when conn
+// is not a TCP connection or the kernel doesn't say.
+func lastReceived(conn net.Conn) (time.Duration, bool) {
+
+    tcp, ok := conn.(*net.TCPConn)
+    if (!ok) {
+        return 0, false
+    }
+
+    raw, err := tcp.SyscallConn()
+    if (err != nil) {
+        return 0, false
+    }
+
+    var info syscall.TCPInfo
+    var size uint32 = uint32(unsafe.Sizeof(info))
+    var errno syscall.Errno
+
+    err = raw.Control(func(fd uintptr) {
+        _, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO, uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+    })
+    if ((err != nil) || (errno != 0)) {
+        return 0, false
+    }
+
+    return time.Duration(info.Last_data_recv) * time.Millisecond, true
+}
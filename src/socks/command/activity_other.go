@@ -0,0 +1,23 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+//go:build !linux
+
+package command
+
+import (
+        "net"
+        "time"
+)
+
+// The kernel doesn't tell when a connection last received data, the
+// copies have to go through a buffer to be watched
+const KERNEL_ACTIVITY = false
+
+func lastReceived(conn net.Conn) (time.Duration, bool) {
+    return 0, false
+}
@@ -0,0 +1,208 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package command
+
+import (
+        "bufio"
+        "errors"
+        "net"
+        "sync/atomic"
+        "time"
+        "socks"
+        "socks/log"
+        "socks/access"
+        "socks/address"
+        "socks/context"
+        "socks/resolver"
+)
+
+type CommandBind struct {
+        address		*address.Address
+        context		*context.Context
+}
+
+/*----------------------------------------------------------
+    Bind Command
+-----------------------------------------------------------*/
+/* RFC 1928
+   The BIND request is used in protocols which require the client to
+   accept connections from the server.  FTP is a well-known example,
+   which uses the primary client-to-server connection for commands and
+   status reports, but may use a server-to-client connection for
+   transferring data on demand (e.g. LS, GET, PUT).
+
+   Two replies are sent from the SOCKS server to the client during a
+   BIND operation.  The first is sent after the server creates and binds
+   a new socket.  The BND.PORT field contains the port number that the
+   SOCKS server assigned to listen for an incoming connection.  The
+   BND.ADDR field contains the associated IP address.  The client will
+   typically use these pieces of information to notify (via the primary
+   or control connection) the application server of the rendezvous
+   address.  The second reply occurs only after the anticipated incoming
+   connection succeeds or fails.
+
+   In the second reply, the BND.PORT and BND.ADDR fields contain the
+   address and port number of the connecting host.
+*/
+func NewCommandBind (address *address.Address, context *context.Context) (*CommandBind) {
+        
+    return &CommandBind {  address : address, context : context }
+}
+
+func (command *CommandBind) Execute () {
+
+    // Listen on the same interface the client connected to, so the
+    // address in the first reply is reachable by the application server
+    var local *net.TCPAddr = &net.TCPAddr{}
+    if addr, ok := (*command.context.Connection()).LocalAddr().(*net.TCPAddr); ok {
+        local.IP = addr.IP
+    }
+
+    listener, err := net.ListenTCP("tcp", local)
+    if (err != nil) {
+        command.response(socks.SOCKS_V5_STATUS_SERVER_FAILURE, nil)
+        command.context.Record().End(access.REASON_FAILED, err)
+        log.Errorf("Bind listener failed: %s\n", err.Error())
+        return
+    }
+
+    defer listener.Close()
+
+    log.Infof("Bind listening on: %s\n", listener.Addr().String())
+
+    // First reply: the address the server is listening on
+    command.response(socks.SOCKS_V5_STATUS_SUCCESS, listener.Addr())
+
+    // Accept exactly one incoming connection, unless the client goes away
+    // in the meantime
+    if timeout := command.context.Config().Timeouts.BindTimeout(); timeout > 0 {
+        listener.SetDeadline(time.Now().Add(timeout))
+    }
+    stop, gone := command.watchControl(listener)
+    connection, err := listener.AcceptTCP()
+    listener.Close()
+    stop()
+
+    if ((err != nil) && gone()) {
+        command.context.Record().End(access.REASON_CLIENT, nil)
+        log.Infof("Bind aborted, the client closed the control connection\n")
+        return
+    }
+
+    if (err != nil) {
+        var statuscode byte = socks.SOCKS_V5_STATUS_SERVER_FAILURE
+        if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+            statuscode = socks.SOCKS_V5_STATUS_TTL_EXPIRED
+        }
+        command.response(statuscode, nil)
+        command.context.Record().End(access.REASON_FAILED, err)
+        log.Errorf("Bind accept failed: %s\n", err.Error())
+        return
+    }
+
+    // Make sure the incoming connection comes from the requested host
+    err = command.verify(connection.RemoteAddr().(*net.TCPAddr))
+    if (err != nil) {
+        command.response(socks.SOCKS_V5_STATUS_NOT_ALLOWED, nil)
+        command.context.Record().End(access.REASON_DENIED, err)
+        connection.Close()
+        log.Errorf("Bind rejected %s: %s\n", connection.RemoteAddr().String(), err.Error())
+        return
+    }
+
+    log.Infof("Bind accepted: %s\n", connection.RemoteAddr().String())
+
+    // Second reply: the address of the connecting host
+    command.response(socks.SOCKS_V5_STATUS_SUCCESS, connection.RemoteAddr())
+
+    // Relay the traffic the same way as the Connect command
+    relay := &CommandConnect{ address : command.address, context : command.context }
+    relay.proxy(connection)
+
+    // Done
+    return
+}
+
+// Check the connecting host against DST.ADDR in the request. An
+// unspecified address (0.0.0.0 or ::) accepts any host.
+func (command *CommandBind) verify(peer *net.TCPAddr) (error) {
+
+    var dstAddr string = (*command.address).DstAddr()
+    var ips []net.IP
+
+    switch ((*command.address).Atyp()) {
+        case socks.SOCKS_V5_ATYP_FQDN:
+            addrs, err := resolver.Get(&command.context.Config().Resolver).LookupIP("ip", dstAddr)
+            if (err != nil) {
+                return err
+            }
+            ips = addrs
+            break
+        default:
+            ip := net.ParseIP(dstAddr)
+            if ((ip == nil) || ip.IsUnspecified()) {
+                return nil
+            }
+            ips = []net.IP{ip}
+            break
+    }
+
+    for _, ip := range ips {
+        if (ip.Equal(peer.IP)) {
+            return nil
+        }
+    }
+
+    return errors.New("Incoming connection doesn't match the requested address")
+}
+
+// While the listener waits, closes it when the client closes the control
+// connection. What the client sends early stays in the connection's
+// reader and is relayed once the peer is connected, the watch goes on
+// past it until the reader's buffer is full. stop ends the watch, gone
+// tells whether the client went away.
+func (command *CommandBind) watchControl(listener *net.TCPListener) (stop func(), gone func() (bool)) {
+
+    var closed int32
+    var done chan bool = make(chan bool)
+
+    var conn net.Conn = *command.context.Connection()
+    var reader *bufio.Reader = command.context.Reader()
+
+    go func() {
+        defer close(done)
+        for (reader.Buffered() < reader.Size()) {
+            // Wait for one more byte than already buffered
+            _, err := reader.Peek(reader.Buffered() + 1)
+            if (err == nil) {
+                continue
+            }
+            // A deadline is a stop, anything else means the client is gone
+            if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+                return
+            }
+            atomic.StoreInt32(&closed, 1)
+            listener.Close()
+            return
+        }
+    }()
+
+    stop = func() {
+        // Wake the read up, the relay sets its own deadlines
+        conn.SetReadDeadline(time.Now())
+        <-done
+        conn.SetReadDeadline(time.Time{})
+    }
+    gone = func() (bool) { return atomic.LoadInt32(&closed) != 0 }
+
+    return stop, gone
+}
+
+func (command *CommandBind) response(statuscode byte, addr net.Addr) {
+    responseAddr(command.context, statuscode, addr)
+}
@@ -0,0 +1,139 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package command
+
+import (
+        "encoding/binary"
+        "io"
+        "net"
+        "strconv"
+        "testing"
+        "time"
+        "socks"
+        "socks/access"
+        "socks/address"
+        "socks/config"
+        "socks/context"
+)
+
+// Data the client sends before the peer connects is relayed to the peer
+func TestBindEarlyData(t *testing.T) {
+
+    control, command, done := bindSession(t)
+    port := bindReply(t, control)
+
+    control.Write([]byte("early"))
+    time.Sleep(50 * time.Millisecond)
+
+    peer, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+    if (err != nil) {
+        t.Fatalf("peer dial: %v", err)
+    }
+    defer peer.Close()
+
+    bindReply(t, control)
+
+    var early []byte = make([]byte, 5)
+    peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, err := io.ReadFull(peer, early); err != nil || string(early) != "early" {
+        t.Fatalf("peer read %q: %v", early, err)
+    }
+
+    control.Close()
+    peer.Close()
+    <-done
+
+    if (command.context.Record().Up != 5) {
+        t.Fatalf("relayed up: %d bytes", command.context.Record().Up)
+    }
+}
+
+// Closing the control connection after sending early data still aborts
+// the wait for the peer
+func TestBindClosedAfterEarlyData(t *testing.T) {
+
+    control, command, done := bindSession(t)
+    bindReply(t, control)
+
+    control.Write([]byte("early"))
+    time.Sleep(50 * time.Millisecond)
+    control.Close()
+
+    select {
+        case <-done:
+            break
+        case <-time.After(5 * time.Second):
+            t.Fatalf("bind still waiting for the peer")
+    }
+
+    if (command.context.Record().Reason != access.REASON_CLIENT) {
+        t.Fatalf("end reason: %s", command.context.Record().Reason)
+    }
+}
+
+/*----------------------------------------------------------
+    Helpers
+-----------------------------------------------------------*/
+
+// A BIND for any peer on a loopback control connection, past the
+// handshake. done is closed when the command returns.
+func bindSession(t *testing.T) (net.Conn, *CommandBind, chan bool) {
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if (err != nil) {
+        t.Fatalf("listen: %v", err)
+    }
+    defer listener.Close()
+
+    control, err := net.Dial("tcp", listener.Addr().String())
+    if (err != nil) {
+        t.Fatalf("dial: %v", err)
+    }
+    t.Cleanup(func() { control.Close() })
+
+    server, err := listener.Accept()
+    if (err != nil) {
+        t.Fatalf("accept: %v", err)
+    }
+    t.Cleanup(func() { server.Close() })
+
+    control.Write([]byte{ socks.SOCKS_VERSION_V5 })
+
+    contxt, err := context.New(server, &config.Config{ Timeouts : config.TimeoutConf{ Bind : 10 } }, &config.ListenerConf{})
+    if (err != nil) {
+        t.Fatalf("context: %v", err)
+    }
+    // The handshake would have read the version
+    contxt.Reader().ReadByte()
+
+    var any address.Address = address.New(socks.SOCKS_V5_ATYP_IP4, "0.0.0.0", 0)
+    var command *CommandBind = NewCommandBind(&any, contxt)
+    var done chan bool = make(chan bool)
+
+    go func() {
+        defer close(done)
+        command.Execute()
+    }()
+
+    return control, command, done
+}
+
+// Reads a successful IPv4 reply, returns its port
+func bindReply(t *testing.T, control net.Conn) (int) {
+
+    var reply []byte = make([]byte, 10)
+    control.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, err := io.ReadFull(control, reply); err != nil {
+        t.Fatalf("reply: %v", err)
+    }
+    if (reply[1] != socks.SOCKS_V5_STATUS_SUCCESS) {
+        t.Fatalf("reply code: %d", reply[1])
+    }
+
+    return int(binary.BigEndian.Uint16(reply[8:]))
+}
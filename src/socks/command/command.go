@@ -8,16 +8,17 @@
 package command
 
 import (
-        "bufio"
-        "io"
         "net"
         "strconv"
-        "sync"
         "socks"
+        "socks/acl"
         "socks/log"
+        "socks/access"
         "socks/address"
         "socks/context"
-        
+        "socks/quota"
+        "socks/shaping"
+        "socks/upstream"
 )
 
 type Command interface {
@@ -26,29 +27,10 @@ type Command interface {
 
 type CommandConnect struct {
         connection		net.Conn
-        waiter			sync.WaitGroup
-        upstream			chan []byte
-        downstream		chan	 []byte
-        upstop			chan bool
-        downstop			chan bool
         address			*address.Address
         context			*context.Context
 }
 
-type CommandBind struct {
-        connection	net.Conn
-        waiter		sync.WaitGroup    
-        address		*address.Address
-        context		*context.Context
-}
-
-type CommandUDPAssociation struct {
-        connection	net.Conn
-        waiter		sync.WaitGroup    
-        address		*address.Address
-        context		*context.Context
-}
-
 /*----------------------------------------------------------
     Connect Command
 -----------------------------------------------------------*/
@@ -61,28 +43,87 @@ func (command *CommandConnect) Execute () {
 
     // Reply the response with success code
     // try to connect to upstream/target host first
-    connection, err := net.Dial((*command.address).GetNetwork(), net.JoinHostPort((*command.address).DstAddr(), strconv.Itoa((*command.address).DstPort())))    
+    // directly or through the upstream proxies
+    var request *acl.Request = acl.NewRequest(command.context, socks.SOCKS_COMMAND_CONNECT, *command.address)
+    connection, err := upstream.Dial(command.context, request, (*command.address).GetNetwork(), net.JoinHostPort((*command.address).DstAddr(), strconv.Itoa((*command.address).DstPort())))
     
     // Is there any error?
     if ( err != nil) {
         
-        // Error happened, send error code back
-        command.response(socks.SOCKS_V5_STATUS_HOST_UNREACHABLE, nil)
-        log.Errorf("Connect to target: %s:%d failed\n", (*command.address).DstAddr(), (*command.address).DstPort())
+        // Error happened, send the matching error code back
+        responseAddr(command.context, ReplyCode(err), nil)
+        command.context.Record().End(dialReason(err), err)
+        log.Errorf("Connect to target: %s:%d failed: %s\n", (*command.address).DstAddr(), (*command.address).DstPort(), err.Error())
         return 
     }
 
     log.Infof("Target host connected: %s via %s\n", connection.RemoteAddr().String(), connection.RemoteAddr().Network())
     
+    /* RFC 1928
+       In the reply to a CONNECT, BND.PORT contains the port number that the
+       server assigned to connect to the target host, while BND.ADDR
+       contains the associated IP address.
+    */
+    if (command.context.Listener().EchoDestination) {
+        if (!command.echo()) {
+            connection.Close()
+            command.context.Record().End(access.REASON_FAILED, nil)
+            return
+        }
+    } else {
+        responseAddr(command.context, socks.SOCKS_V5_STATUS_SUCCESS, connection.LocalAddr())
+    }
+          
+    // start to proxy
+    command.proxy(connection)
+
+    // Done
+    return 
+}
+
+func (command *CommandConnect) proxy(connection net.Conn) {
+
+    command.connection = connection
+
+    if addr, ok := connection.RemoteAddr().(*net.TCPAddr); ok {
+        command.context.Record().Resolved = addr.IP.String()
+    }
+
+    // The bandwidth of the session
+    shaper := shaping.Get(&command.context.Config().Shaping).Open(command.context)
+    defer shaper.Close()
+
+    // The traffic of the user
+    account := quota.Open(command.context)
+    defer account.Close()
+
+    relay := newRelay(*command.context.Connection(), command.context.Reader(), connection, command.context.Config().Timeouts.IdleTimeout(), shaper, account)
+    relay.run()
+
+    connection.Close()
+
+    up, down := relay.counts()
+    command.context.Record().Up, command.context.Record().Down = up, down
+    command.context.Record().End(relay.result())
+
+    log.Infof("Proxying finished: %s <-> %s, up: %d bytes, down: %d bytes\n", (*command.context.Connection()).RemoteAddr().String(), connection.RemoteAddr().String(), up, down)
+
+    // Done
+    return
+}
+
+// Compatibility reply echoing DST.ADDR/DST.PORT with the request's ATYP
+func (command *CommandConnect) echo() (bool) {
+
     var ipBytes []byte
     
     // check the atyp
     switch ((*command.address).Atyp()) {
         case socks.SOCKS_V5_ATYP_IP4:
-            ipBytes = net.ParseIP((*command.address).DstAddr())
+            ipBytes = net.ParseIP((*command.address).DstAddr()).To4()
             break
         case socks.SOCKS_V5_ATYP_IP6:
-            ipBytes = net.ParseIP((*command.address).DstAddr())
+            ipBytes = net.ParseIP((*command.address).DstAddr()).To16()
             break
         case socks.SOCKS_V5_ATYP_FQDN:
             ipBytes = append([]byte{byte(len((*command.address).DstAddr()))}, (*command.address).DstAddr()...)
@@ -92,10 +133,9 @@ func (command *CommandConnect) Execute () {
     // Check if there is any error
     if (ipBytes == nil) {
         command.response(socks.SOCKS_V5_STATUS_ADDR_UNSUPPORTED, nil)
-        connection.Close()
         
         log.Errorf("Target host IP is incorrect: %s\n", (*command.address).DstAddr())
-        return 
+        return false
     }
         
     ipBytes = append(ipBytes, byte((*command.address).DstPort() >> 8))
@@ -103,233 +143,142 @@ func (command *CommandConnect) Execute () {
         
     // Send response
     command.response(socks.SOCKS_V5_STATUS_SUCCESS, ipBytes)
-          
-    // start to proxy
-    command.connection 	= connection
-    command.upstream 	= make(chan []byte)
-    command.downstream	= make(chan []byte)
-    command.upstop		= make(chan bool)
-    command.downstop		= make(chan bool)
- 
-    // Start the proxy
-    command.waiter.Add(4)
-    
-    go command.listenUpstream()
-    go command.listenDownstream()
-
-    // start the upstream proxy
-    go command.upstreamProxy()
-    
-    //start the downstream proxy
-    go command.downstreamProxy()
-        
-    log.Infof("Waiting for proxying to finish\n")
-    
-    // wait for proxying being done
-    command.waiter.Wait()
- 
-    connection.Close()
-    
-    log.Infof("Proxying finished\n")
 
-    // Done
-    return 
+    return true
 }
 
-func (command *CommandConnect) listenUpstream() {
+func (command *CommandConnect) response(statuscode byte, rest []byte) {
     
-    log.Infof("Entering listenUpstream\n")
-
-    //command.waiter.Add(1)
-    defer command.waiter.Done()
+    // Socks V4 reply has its own format, DSTPORT and DSTIP are
+    // ignored by the client for CONNECT
+    if (command.context.Version() == socks.SOCKS_VERSION_V4) {
+        responseV4(command.context, statuscode, nil)
+        return
+    }
     
-    var writer *bufio.Writer = command.context.Writer()
+    command.context.Record().Reply = int(statuscode)
+
+    // Send response back
+    command.context.Writer().WriteByte(command.context.Version())
+    command.context.Writer().WriteByte(statuscode)
+    command.context.Writer().WriteByte(0x00)
+    command.context.Writer().WriteByte((*command.address).Atyp())
     
-    // Wait for data coming
-    var status bool = false
-    for {
-        select {
-            case data := <-command.upstream :
-                writer.Write(data)
-                writer.Flush()
-                log.Infof("Sending data to downstream(%s) - bytes: %d\n", (*command.context.Connection()).RemoteAddr().String(), len(data))   
-            case status = <-command.upstop :
-                log.Infof("Received upstream stop signal\n")
-                break
-        }
-        if (status == true) {
-            break
-        }
+    // In case there is an error, don't care the rest
+    if ((rest != nil) && (len(rest) != 0)) {
+        command.context.Writer().Write(rest)
     }
     
-    log.Infof("Leaving listenUpstream\n")
+    // Flush the response
+    command.context.Writer().Flush()
+    
     // Done
     return 
 }
 
-func (command *CommandConnect) listenDownstream() {
 
-    log.Infof("Entering listenDownstream\n")
-    
-    defer command.waiter.Done()
-    
-    var writer *bufio.Writer = bufio.NewWriter(command.connection)
-    
-    // Wait for data coming
-    var status bool = false
-    for {
-        
-        select {
-            case data := <-command.downstream :
-                writer.Write(data)
-                writer.Flush()
-                log.Infof("Sending data to upstream(%s) - bytes: %d\n", command.connection.RemoteAddr().String(), len(data))  
-            case status = <-command.downstop :
-                log.Infof("Received downstream stop signal\n")
-                break
-        }
-        
-        if (status == true) {
-            break
-        }
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+
+// Why a dial failed, for the access log: the ACL may deny a name once
+// its addresses are known
+func dialReason(err error) (string) {
+
+    if _, denied := err.(*acl.DeniedError); denied {
+        return access.REASON_DENIED
     }
 
-    log.Infof("Leaving listenDownstream\n")
-    
-    // Done
-    return     
+    return access.REASON_DIAL
 }
 
-func (command *CommandConnect) upstreamProxy() {
+// Convert a socket address into the ATYP and the BND.ADDR/BND.PORT
+// bytes used in a reply
+func bindAddress(addr net.Addr) (byte, []byte) {
 
-    log.Infof("Entering upstreamProxy\n")
-    
-    defer command.waiter.Done()
-    
-    //io.Copy((*command.context.Connection()), command.connection)
-    
-    var reader *bufio.Reader = bufio.NewReader(command.connection)
+    var ip		net.IP
+    var port		int
 
-    // Read data from upstream
-    for {
-        // clear the buffer
-        var buffer []byte = make([]byte, reader.Size())
-        
-        // read the data from stream
-        count, err := reader.Read(buffer)
-        
-        log.Infof("Reading data from upstream(%s): - bytes: %d, err: %#v\n", command.connection.RemoteAddr().String(), count, err)
-        log.DebugBinary(buffer[:count])
-       
-        // any data read?
-        if (count != 0) {
-            command.upstream <- buffer[:count]
-            
-            log.Infof("Sending data to downstream(%s): - bytes: %d, err: %#v\n", (*command.context.Connection()).RemoteAddr().String(), count, err)
-        }
-        
-        // Reach end of stream?
-        if (err == io.EOF) {
-            log.Infof("Sending upstream stop signal\n")
-            command.upstop <- true
+    switch v := addr.(type) {
+        case *net.TCPAddr:
+            ip, port = v.IP, v.Port
+            break
+        case *net.UDPAddr:
+            ip, port = v.IP, v.Port
             break
-        }
     }
-    
-    log.Infof("Leaving upstreamProxy\n")
 
-    // Done
-    return
+    var atyp byte = socks.SOCKS_V5_ATYP_IP4
+    var bytes []byte
+
+    if (ip.To4() != nil) {
+        bytes = append(bytes, ip.To4()...)
+    } else if (ip.To16() != nil) {
+        atyp  = socks.SOCKS_V5_ATYP_IP6
+        bytes = append(bytes, ip.To16()...)
+    } else {
+        bytes = append(bytes, net.IPv4zero.To4()...)
+    }
+
+    bytes = append(bytes, byte(port >> 8), byte(port & 0xFF))
+
+    return atyp, bytes
 }
 
-func (command *CommandConnect) downstreamProxy() {
+// Send a reply carrying a socket address as BND.ADDR/BND.PORT, a nil
+// address is sent as 0.0.0.0:0
+func responseAddr(context *context.Context, statuscode byte, addr net.Addr) {
 
-    log.Infof("Entering downstreamProxy\n")
+    if (context.Version() == socks.SOCKS_VERSION_V4) {
+        responseV4(context, statuscode, addr)
+        return
+    }
 
-    defer command.waiter.Done()
-    
-    //io.Copy(command.connection, (*command.context.Connection()))
-    
-    // Using the io.Copy to accomplish the data transfering is totally fine too.
-    var reader *bufio.Reader	= command.context.Reader()
-    
-    // Read data from upstream
-    for {       
-        var buffer []byte = make([]byte, reader.Size())
-        
-        // read the data from stream
-        count, err := reader.Read(buffer)
-        
-        log.Infof("Reading data from downstream(%s): - bytes: %d, err: %#v\n", (*command.context.Connection()).RemoteAddr().String(), count, err)
-        log.DebugBinary(buffer[:count])
-        
-        // any data read?
-        if (count != 0) {
-            command.downstream <- buffer[:count]
-            
-            log.Infof("Sending data to upstream(%s): - bytes: %d, err: %#v\n", command.connection.RemoteAddr().String(), count, err)
-        }
-        
-        // Reach at the end of stream?
-        if (err == io.EOF) {
-            log.Infof("Sending downstream stop signal\n")
-            command.downstop <- true
-            break
-        }
+    var atyp byte = socks.SOCKS_V5_ATYP_IP4
+    var rest []byte = []byte{0, 0, 0, 0, 0, 0}
+
+    if (addr != nil) {
+        atyp, rest = bindAddress(addr)
     }
-    
-    log.Infof("Leaving downstreamProxy\n")
 
-    // Done
-    return
-    
-}
+    context.Record().Reply = int(statuscode)
 
-func (command *CommandConnect) response(statuscode byte, rest []byte) {
-    
     // Send response back
-    command.context.Writer().WriteByte(command.context.Version())
-    command.context.Writer().WriteByte(statuscode)
-    command.context.Writer().WriteByte(0x00)
-    command.context.Writer().WriteByte((*command.address).Atyp())
-    
-    // In case there is an error, don't care the rest
-    if ((rest != nil) && (len(rest) != 0)) {
-        command.context.Writer().Write(rest)
-    }
-    
+    context.Writer().WriteByte(context.Version())
+    context.Writer().WriteByte(statuscode)
+    context.Writer().WriteByte(0x00)
+    context.Writer().WriteByte(atyp)
+    context.Writer().Write(rest)
+
     // Flush the response
-    command.context.Writer().Flush()
-    
-    // Done
-    return 
+    context.Writer().Flush()
 }
 
+// Send a Socks V4 reply, the V5 status code is mapped to granted or
+// rejected. Only an IPv4 address can be carried in DSTIP.
+func responseV4(context *context.Context, statuscode byte, addr net.Addr) {
 
-/*----------------------------------------------------------
-    Bind Command
------------------------------------------------------------*/
-func NewCommandBind (address *address.Address, context *context.Context) (*CommandBind) {
-        
-    return &CommandBind {  address : address, context : context }
-}
+    var code byte = socks.SOCKS_V4_STATUS_REJECTED
+    if (statuscode == socks.SOCKS_V5_STATUS_SUCCESS) {
+        code = socks.SOCKS_V4_STATUS_GRANTED
+    }
 
-func (command *CommandBind) Execute () {
-    
-    log.Errorf("Bind Command is not supported now\n")
-    return 
-}
+    var rest []byte = []byte{0, 0, 0, 0, 0, 0}
 
-/*----------------------------------------------------------
-    Bind Command
------------------------------------------------------------*/
-func NewCommandUDPAssociation (address *address.Address, context *context.Context) (*CommandUDPAssociation) {
-    return &CommandUDPAssociation {  address : address, context : context }
-}
+    if (addr != nil) {
+        atyp, bytes := bindAddress(addr)
+        if (atyp == socks.SOCKS_V5_ATYP_IP4) {
+            // DSTPORT goes first in V4
+            rest = []byte{bytes[4], bytes[5], bytes[0], bytes[1], bytes[2], bytes[3]}
+        }
+    }
 
-func (command *CommandUDPAssociation) Execute () {
-    
-    log.Errorf("UDP Assoication Command is not supported now\n")
-    
-    return 
+    context.Record().Reply = int(code)
+
+    context.Writer().WriteByte(socks.SOCKS_V4_REPLY_VERSION)
+    context.Writer().WriteByte(code)
+    context.Writer().Write(rest)
+
+    // Flush the response
+    context.Writer().Flush()
 }
@@ -0,0 +1,65 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package command
+
+import (
+        "errors"
+        "net"
+        "syscall"
+        "socks"
+)
+
+/*----------------------------------------------------------
+    Error to reply code mapping
+-----------------------------------------------------------*/
+
+// ReplyCode maps an error to the RFC 1928 reply code sent back to the
+// client, X'01' general failure when nothing more specific applies
+func ReplyCode(err error) (byte) {
+
+    if (err == nil) {
+        return socks.SOCKS_V5_STATUS_SUCCESS
+    }
+
+    // The error knows its code (ACL deny, parent proxy reply)
+    var replier socks.Replier
+    if (errors.As(err, &replier)) {
+        return replier.ReplyCode()
+    }
+
+    switch {
+        case errors.Is(err, socks.ERR_COMMAND_UNSUPPORTED):
+            return socks.SOCKS_V5_STATUS_COMMAND_UNSUPPORTED
+        case errors.Is(err, socks.ERR_ADDRESS_UNSUPPORTED):
+            return socks.SOCKS_V5_STATUS_ADDR_UNSUPPORTED
+    }
+
+    // Name resolution failed, NXDOMAIN or no answer
+    var dnsError *net.DNSError
+    if (errors.As(err, &dnsError)) {
+        return socks.SOCKS_V5_STATUS_HOST_UNREACHABLE
+    }
+
+    switch {
+        case errors.Is(err, syscall.ECONNREFUSED):
+            return socks.SOCKS_V5_STATUS_CONN_REFUSED
+        case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.ENETDOWN):
+            return socks.SOCKS_V5_STATUS_NETWORK_UNREACHABLE
+        case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.EHOSTDOWN):
+            return socks.SOCKS_V5_STATUS_HOST_UNREACHABLE
+        case errors.Is(err, syscall.ETIMEDOUT):
+            return socks.SOCKS_V5_STATUS_TTL_EXPIRED
+    }
+
+    var netError net.Error
+    if (errors.As(err, &netError) && netError.Timeout()) {
+        return socks.SOCKS_V5_STATUS_TTL_EXPIRED
+    }
+
+    return socks.SOCKS_V5_STATUS_SERVER_FAILURE
+}
@@ -0,0 +1,261 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package command
+
+import (
+        "errors"
+        "io"
+        "net"
+        "strconv"
+        "syscall"
+        "testing"
+        "socks"
+        "socks/acl"
+        "socks/address"
+        "socks/config"
+        "socks/context"
+        "socks/upstream"
+)
+
+/* Each case dials a target through upstream.Dial, the way CONNECT does,
+   against listeners and servers run by the test, and checks the reply
+   code the error maps to.
+*/
+type replyCase struct {
+        name			string
+        setup		func(t *testing.T, conf *config.Config) (string)
+        codes		[]byte
+}
+
+func TestReplyCode(t *testing.T) {
+
+    var cases []replyCase = []replyCase{
+        { name : "refused", codes : []byte{ socks.SOCKS_V5_STATUS_CONN_REFUSED },
+          setup : func(t *testing.T, conf *config.Config) (string) {
+              return closedPort(t)
+          } },
+        { name : "unreachable", codes : []byte{ socks.SOCKS_V5_STATUS_NETWORK_UNREACHABLE, socks.SOCKS_V5_STATUS_HOST_UNREACHABLE },
+          setup : func(t *testing.T, conf *config.Config) (string) {
+              conf.Timeouts.Dial = 2
+              // Linux has no route for TCP to a multicast group
+              return "224.0.0.1:80"
+          } },
+        { name : "timeout", codes : []byte{ socks.SOCKS_V5_STATUS_TTL_EXPIRED },
+          setup : func(t *testing.T, conf *config.Config) (string) {
+              conf.Timeouts.Dial = 1
+              conf.Upstream = config.UpstreamConf{ Default : "parent", Chains : map[string][]config.ProxyConf{ "parent" : { { Type : upstream.PROXY_SOCKS5, Address : silentServer(t) } } } }
+              return "192.0.2.1:80"
+          } },
+        { name : "nxdomain", codes : []byte{ socks.SOCKS_V5_STATUS_HOST_UNREACHABLE },
+          setup : func(t *testing.T, conf *config.Config) (string) {
+              conf.Resolver.Upstream = "udp://" + nxdomainServer(t)
+              return "missing.example:80"
+          } },
+        { name : "acl deny", codes : []byte{ socks.SOCKS_V5_STATUS_NOT_ALLOWED },
+          setup : func(t *testing.T, conf *config.Config) (string) {
+              conf.Resolver.Hosts = map[string][]string{ "loopback.example" : { "127.0.0.1" } }
+              conf.Acl = config.AclConf{ Rules : []config.AclRule{ { Name : "no-loopback", Action : acl.ACTION_DENY, Destinations : []string{ "127.0.0.0/8" } } } }
+              return net.JoinHostPort("loopback.example", portOf(closedPort(t)))
+          } },
+        { name : "parent reply", codes : []byte{ socks.SOCKS_V5_STATUS_NETWORK_UNREACHABLE },
+          setup : func(t *testing.T, conf *config.Config) (string) {
+              conf.Upstream = config.UpstreamConf{ Default : "parent", Chains : map[string][]config.ProxyConf{ "parent" : { { Type : upstream.PROXY_SOCKS5, Address : parentServer(t, socks.SOCKS_V5_STATUS_NETWORK_UNREACHABLE) } } } }
+              return "192.0.2.1:80"
+          } },
+    }
+
+    for _, test := range cases {
+        t.Run(test.name, func(t *testing.T) {
+
+            var conf *config.Config = &config.Config{}
+            target := test.setup(t, conf)
+
+            _, err := upstream.Dial(testContext(t, conf), testRequest(t, conf, target), "tcp", target)
+            if (err == nil) {
+                t.Fatalf("dial to %s succeeded", target)
+            }
+
+            // Other systems may let the dial time out
+            if ((test.name == "unreachable") && !errors.Is(err, syscall.ENETUNREACH) && !errors.Is(err, syscall.EHOSTUNREACH)) {
+                t.Skipf("no unreachable network here: %v", err)
+            }
+
+            var code byte = ReplyCode(err)
+            for _, want := range test.codes {
+                if (code == want) {
+                    return
+                }
+            }
+            t.Fatalf("reply code of %v: %d, want one of %v", err, code, test.codes)
+        })
+    }
+}
+
+func TestReplyCodeWrapped(t *testing.T) {
+
+    var wrapped error = &net.OpError{ Op : "dial", Net : "tcp", Err : &acl.DeniedError{ Rule : "rule" } }
+    if code := ReplyCode(wrapped); code != socks.SOCKS_V5_STATUS_NOT_ALLOWED {
+        t.Fatalf("reply code of a wrapped deny: %d", code)
+    }
+
+    if code := ReplyCode(nil); code != socks.SOCKS_V5_STATUS_SUCCESS {
+        t.Fatalf("reply code of no error: %d", code)
+    }
+
+    if code := ReplyCode(errors.New("anything")); code != socks.SOCKS_V5_STATUS_SERVER_FAILURE {
+        t.Fatalf("reply code of an unknown error: %d", code)
+    }
+}
+
+/*----------------------------------------------------------
+    Helpers
+-----------------------------------------------------------*/
+
+// A session context over a pipe, the client side only sent the version
+func testContext(t *testing.T, conf *config.Config) (*context.Context) {
+
+    client, server := net.Pipe()
+    t.Cleanup(func() { client.Close(); server.Close() })
+
+    go client.Write([]byte{ socks.SOCKS_VERSION_V5 })
+
+    contxt, err := context.New(server, conf, &config.ListenerConf{})
+    if (err != nil) {
+        t.Fatalf("context: %v", err)
+    }
+
+    return contxt
+}
+
+// The CONNECT request of target, as the session builds it
+func testRequest(t *testing.T, conf *config.Config, target string) (*acl.Request) {
+
+    host, port, _ := net.SplitHostPort(target)
+    number, _ := strconv.Atoi(port)
+
+    var atyp byte = socks.SOCKS_V5_ATYP_FQDN
+    if ip := net.ParseIP(host); ip != nil {
+        atyp = socks.SOCKS_V5_ATYP_IP4
+        if (ip.To4() == nil) {
+            atyp = socks.SOCKS_V5_ATYP_IP6
+        }
+    }
+
+    return acl.NewRequest(testContext(t, conf), socks.SOCKS_COMMAND_CONNECT, address.New(atyp, host, number))
+}
+
+// A local address nothing listens on
+func closedPort(t *testing.T) (string) {
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if (err != nil) {
+        t.Fatalf("listen: %v", err)
+    }
+    listener.Close()
+
+    return listener.Addr().String()
+}
+
+func portOf(addr string) (string) {
+    _, port, _ := net.SplitHostPort(addr)
+    return port
+}
+
+// Accepts and never answers
+func silentServer(t *testing.T) (string) {
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if (err != nil) {
+        t.Fatalf("listen: %v", err)
+    }
+    t.Cleanup(func() { listener.Close() })
+
+    go func() {
+        var conns []net.Conn
+        for {
+            conn, err := listener.Accept()
+            if (err != nil) {
+                break
+            }
+            conns = append(conns, conn)
+        }
+        for _, conn := range conns {
+            conn.Close()
+        }
+    }()
+
+    return listener.Addr().String()
+}
+
+// A Socks V5 parent without authentication refusing every request with
+// code
+func parentServer(t *testing.T, code byte) (string) {
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if (err != nil) {
+        t.Fatalf("listen: %v", err)
+    }
+    t.Cleanup(func() { listener.Close() })
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if (err != nil) {
+                return
+            }
+            go func() {
+                defer conn.Close()
+                var greeting []byte = make([]byte, 3)
+                if _, err := io.ReadFull(conn, greeting); err != nil {
+                    return
+                }
+                conn.Write([]byte{ socks.SOCKS_VERSION_V5, socks.SOCKS_AUTH_NOAUTHENTICATION })
+                // VER CMD RSV ATYP(IPv4) ADDR PORT
+                var request []byte = make([]byte, 10)
+                if _, err := io.ReadFull(conn, request); err != nil {
+                    return
+                }
+                conn.Write([]byte{ socks.SOCKS_VERSION_V5, code, 0x00, socks.SOCKS_V5_ATYP_IP4, 0, 0, 0, 0, 0, 0 })
+            }()
+        }
+    }()
+
+    return listener.Addr().String()
+}
+
+// A DNS server over UDP answering NXDOMAIN to every question
+func nxdomainServer(t *testing.T) (string) {
+
+    conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if (err != nil) {
+        t.Fatalf("listen: %v", err)
+    }
+    t.Cleanup(func() { conn.Close() })
+
+    go func() {
+        var buffer []byte = make([]byte, 512)
+        for {
+            count, addr, err := conn.ReadFrom(buffer)
+            if (err != nil) {
+                return
+            }
+            if (count < 12) {
+                continue
+            }
+            // ID, QR RD RA and NXDOMAIN, the question echoed, no record
+            var response []byte = append([]byte{}, buffer[:2]...)
+            response = append(response, 0x81, 0x83)
+            response = append(response, buffer[4:6]...)
+            response = append(response, 0, 0, 0, 0, 0, 0)
+            response = append(response, buffer[12:count]...)
+            conn.WriteTo(response, addr)
+        }
+    }()
+
+    return conn.LocalAddr().String()
+}
@@ -0,0 +1,209 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package command
+
+import (
+        "net"
+        "sync"
+        "sync/atomic"
+        "time"
+        "socks/log"
+        "socks/config"
+)
+
+/* RFC 1928
+   The FRAG field indicates whether or not this datagram is one of a
+   number of fragments.  If implemented, the high-order bit indicates
+   end-of-fragment sequence, while a value of X'00' indicates that this
+   datagram is standalone.  Values between 1 and 127 indicate the
+   fragment position within a fragment sequence.  Each receiver will
+   have a REASSEMBLY QUEUE and a REASSEMBLY TIMER associated with these
+   fragments.  The reassembly queue must be reinitialized and the
+   associated fragments abandoned whenever the REASSEMBLY TIMER expires,
+   or a new datagram arrives carrying a FRAG field whose value is less
+   than the highest FRAG value processed for this fragment sequence.
+   The reassembly timer MUST be no less than 5 seconds.
+*/
+const (
+        UDP_FRAG_END_OF_SEQUENCE	= byte(0x80)
+        UDP_FRAG_MIN_TIMEOUT		= 5 * time.Second
+        UDP_FRAG_DEFAULT_QUEUE	= UDP_MAX_DATAGRAM
+)
+
+// Totals over all the associations
+var (
+        fragOutOfOrder		uint64
+        fragTimeout			uint64
+        fragOverflow			uint64
+)
+
+type reassembler struct {
+        mutex			sync.Mutex
+        timeout			time.Duration
+        limit			int
+        highest			byte
+        size				int
+        target			*net.UDPAddr
+        queue			[][]byte
+        timer			*time.Timer
+        sequence			uint64
+        outOfOrder		uint64
+        expired			uint64
+        overflow			uint64
+}
+
+/*----------------------------------------------------------
+    Fragment reassembly
+-----------------------------------------------------------*/
+func newReassembler(conf *config.UdpConf) (*reassembler) {
+
+    var timeout time.Duration = time.Duration(conf.Timeout) * time.Second
+    if (timeout < UDP_FRAG_MIN_TIMEOUT) {
+        timeout = UDP_FRAG_MIN_TIMEOUT
+    }
+
+    var limit int = conf.Queue
+    if (limit <= 0) {
+        limit = UDP_FRAG_DEFAULT_QUEUE
+    }
+
+    return &reassembler{ timeout : timeout, limit : limit }
+}
+
+// Queue a fragment. A sequence starts at position 1 and goes up one
+// position at a time, any gap, repeat or change of target abandons it.
+// When the last fragment of the sequence arrives the reassembled data
+// and its target are returned, otherwise data is nil.
+func (queue *reassembler) add(frag byte, target *net.UDPAddr, data []byte) (*net.UDPAddr, []byte) {
+
+    queue.mutex.Lock()
+    defer queue.mutex.Unlock()
+
+    var position byte = frag &^ UDP_FRAG_END_OF_SEQUENCE
+
+    // Position 1 always starts a new sequence, abandoning the current one
+    if ((position == 1) && (queue.highest != 0)) {
+        queue.abandon("UDP fragment 1 restarts the sequence (highest: %d), sequence abandoned\n", queue.highest)
+    }
+
+    // Every other fragment has to follow the highest one processed
+    if ((position == 0) || (position != queue.highest + 1)) {
+        queue.abandon("UDP fragment %d out of order (highest: %d), sequence abandoned\n", position, queue.highest)
+        return nil, nil
+    }
+
+    // The fragments of a sequence all go to the same target
+    if ((queue.target != nil) && !(queue.target.IP.Equal(target.IP) && (queue.target.Port == target.Port))) {
+        queue.abandon("UDP fragment %d for %s instead of %s, sequence abandoned\n", position, target.String(), queue.target.String())
+        return nil, nil
+    }
+
+    // Too much data buffered
+    if (queue.size + len(data) > queue.limit) {
+        queue.overflow++
+        atomic.AddUint64(&fragOverflow, 1)
+        log.Debugf("UDP fragment queue exceeds %d bytes, sequence abandoned\n", queue.limit)
+        queue.reset()
+        return nil, nil
+    }
+
+    // First fragment of a sequence starts the timer
+    if (queue.highest == 0) {
+        queue.sequence++
+
+        var sequence uint64 = queue.sequence
+
+        queue.target = target
+        queue.timer  = time.AfterFunc(queue.timeout, func() { queue.expire(sequence) })
+    }
+
+    // Keep a copy, the caller reuses its buffer
+    queue.queue   = append(queue.queue, append([]byte(nil), data...))
+    queue.size   += len(data)
+    queue.highest = position
+
+    // Not the end of the sequence yet
+    if ((frag & UDP_FRAG_END_OF_SEQUENCE) == 0) {
+        return nil, nil
+    }
+
+    var reassembled []byte = make([]byte, 0, queue.size)
+    for _, fragment := range queue.queue {
+        reassembled = append(reassembled, fragment...)
+    }
+
+    target = queue.target
+    queue.reset()
+
+    return target, reassembled
+}
+
+// Called by the reassembly timer
+func (queue *reassembler) expire(sequence uint64) {
+
+    queue.mutex.Lock()
+    defer queue.mutex.Unlock()
+
+    // The sequence has already been completed or abandoned
+    if ((queue.highest == 0) || (sequence != queue.sequence)) {
+        return
+    }
+
+    queue.expired++
+    atomic.AddUint64(&fragTimeout, 1)
+    log.Debugf("UDP fragment reassembly timed out, sequence abandoned\n")
+
+    queue.reset()
+}
+
+// Drop the current sequence, counted as out of order
+func (queue *reassembler) abandon(format string, args ...interface{}) {
+
+    queue.outOfOrder++
+    atomic.AddUint64(&fragOutOfOrder, 1)
+    log.Debugf(format, args...)
+
+    queue.reset()
+}
+
+func (queue *reassembler) reset() {
+
+    if (queue.timer != nil) {
+        queue.timer.Stop()
+        queue.timer = nil
+    }
+
+    queue.queue   = nil
+    queue.size    = 0
+    queue.highest = 0
+    queue.target  = nil
+}
+
+func (queue *reassembler) close() {
+
+    queue.mutex.Lock()
+    defer queue.mutex.Unlock()
+
+    queue.reset()
+}
+
+// Returns the dropped counters of this association:
+// out of order, timed out and overflow
+func (queue *reassembler) stats() (uint64, uint64, uint64) {
+
+    queue.mutex.Lock()
+    defer queue.mutex.Unlock()
+
+    return queue.outOfOrder, queue.expired, queue.overflow
+}
+
+// Returns the dropped fragment counters of all the associations:
+// out of order, timed out and overflow
+func FragmentStats() (uint64, uint64, uint64) {
+    return atomic.LoadUint64(&fragOutOfOrder), atomic.LoadUint64(&fragTimeout), atomic.LoadUint64(&fragOverflow)
+}
@@ -0,0 +1,132 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package command
+
+import (
+        "net"
+        "testing"
+        "socks/config"
+)
+
+// A fragment as the client sends it
+type testFragment struct {
+        frag			byte
+        target		string
+        data			string
+}
+
+func TestReassembly(t *testing.T) {
+
+    const A, B = "192.0.2.1:53", "192.0.2.2:53"
+    const END = UDP_FRAG_END_OF_SEQUENCE
+
+    var cases = []struct {
+        name			string
+        queue		int
+        fragments	[]testFragment
+        // What each fragment gives, "" for nothing yet
+        results		[]string
+        outOfOrder	uint64
+        overflow		uint64
+    }{
+        { name : "in order",
+          fragments : []testFragment{ { 1, A, "ab" }, { 2, A, "cd" }, { 3 | END, A, "ef" } },
+          results : []string{ "", "", "abcdef" } },
+        { name : "single fragment",
+          fragments : []testFragment{ { 1 | END, A, "ab" } },
+          results : []string{ "ab" } },
+        { name : "two sequences",
+          fragments : []testFragment{ { 1, A, "ab" }, { 2 | END, A, "cd" }, { 1, B, "ef" }, { 2 | END, B, "gh" } },
+          results : []string{ "", "abcd", "", "efgh" } },
+        { name : "not starting at 1",
+          fragments : []testFragment{ { 2, A, "ab" }, { 3 | END, A, "cd" } },
+          results : []string{ "", "" },
+          outOfOrder : 2 },
+        { name : "gap",
+          fragments : []testFragment{ { 1, A, "ab" }, { 3 | END, A, "cd" } },
+          results : []string{ "", "" },
+          outOfOrder : 1 },
+        { name : "repeat",
+          fragments : []testFragment{ { 1, A, "ab" }, { 2, A, "cd" }, { 2, A, "cd" }, { 3 | END, A, "ef" } },
+          results : []string{ "", "", "", "" },
+          outOfOrder : 2 },
+        { name : "lower position",
+          fragments : []testFragment{ { 1, A, "ab" }, { 2, A, "cd" }, { 3, A, "ef" }, { 2 | END, A, "gh" } },
+          results : []string{ "", "", "", "" },
+          outOfOrder : 1 },
+        { name : "restart",
+          fragments : []testFragment{ { 1, A, "ab" }, { 2, A, "cd" }, { 1, A, "ef" }, { 2 | END, A, "gh" } },
+          results : []string{ "", "", "", "efgh" },
+          outOfOrder : 1 },
+        { name : "target changed",
+          fragments : []testFragment{ { 1, A, "ab" }, { 2 | END, B, "cd" }, { 1 | END, B, "ef" } },
+          results : []string{ "", "", "ef" },
+          outOfOrder : 1 },
+        { name : "end without position",
+          fragments : []testFragment{ { END, A, "ab" } },
+          results : []string{ "" },
+          outOfOrder : 1 },
+        { name : "overflow", queue : 5,
+          fragments : []testFragment{ { 1, A, "abc" }, { 2 | END, A, "def" }, { 1 | END, A, "abcde" } },
+          results : []string{ "", "", "abcde" },
+          overflow : 1 },
+    }
+
+    for _, test := range cases {
+        t.Run(test.name, func(t *testing.T) {
+
+            queue := newReassembler(&config.UdpConf{ Queue : test.queue })
+            defer queue.close()
+
+            for index, fragment := range test.fragments {
+                target, _ := net.ResolveUDPAddr("udp", fragment.target)
+                to, data := queue.add(fragment.frag, target, []byte(fragment.data))
+
+                if (string(data) != test.results[index]) {
+                    t.Fatalf("fragment %d: %q, want %q", index, data, test.results[index])
+                }
+                if ((data != nil) && (to.String() != fragment.target)) {
+                    t.Fatalf("fragment %d: sent to %s, want %s", index, to, fragment.target)
+                }
+            }
+
+            outOfOrder, _, overflow := queue.stats()
+            if ((outOfOrder != test.outOfOrder) || (overflow != test.overflow)) {
+                t.Fatalf("dropped: %d out of order, %d overflow, want %d and %d", outOfOrder, overflow, test.outOfOrder, test.overflow)
+            }
+        })
+    }
+}
+
+// The reassembly timer abandons the sequence it was started for only
+func TestReassemblyExpiry(t *testing.T) {
+
+    queue := newReassembler(&config.UdpConf{})
+    defer queue.close()
+
+    target, _ := net.ResolveUDPAddr("udp", "192.0.2.1:53")
+
+    queue.add(1, target, []byte("ab"))
+    var first uint64 = queue.sequence
+
+    queue.expire(first)
+    if _, data := queue.add(2 | UDP_FRAG_END_OF_SEQUENCE, target, []byte("cd")); data != nil {
+        t.Fatalf("expired sequence completed: %q", data)
+    }
+
+    // The timer of an older sequence leaves the current one alone
+    queue.add(1, target, []byte("ef"))
+    queue.expire(first)
+    if _, data := queue.add(2 | UDP_FRAG_END_OF_SEQUENCE, target, []byte("gh")); string(data) != "efgh" {
+        t.Fatalf("current sequence: %q", data)
+    }
+
+    if _, expired, _ := queue.stats(); expired != 1 {
+        t.Fatalf("expired: %d", expired)
+    }
+}
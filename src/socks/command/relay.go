@@ -0,0 +1,293 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package command
+
+import (
+        "bufio"
+        "errors"
+        "io"
+        "net"
+        "sync"
+        "sync/atomic"
+        "time"
+        "socks/log"
+        "socks/access"
+        "socks/quota"
+        "socks/shaping"
+)
+
+// Size of the pooled relay buffers
+const RELAY_BUFFER_SIZE = 32 * 1024
+
+// How many times per idle timeout the watchdog looks at the relay
+const RELAY_WATCHDOG_TICKS = 4
+
+// Buffers used when the copy can't be done by the kernel
+var bufferPool = sync.Pool { New : func() interface{} { buffer := make([]byte, RELAY_BUFFER_SIZE); return &buffer } }
+
+// Relays the traffic between the client and the target with one copy
+// per direction. Up is client -> target, down is target -> client.
+// With an idle timeout a watchdog closes both connections once neither
+// direction moved for that long. Each direction is held to the buckets
+// of its limiter and counted to the user's quota.
+type relay struct {
+        client		net.Conn
+        reader		*bufio.Reader
+        target		net.Conn
+        idle			time.Duration
+        upload		shaping.Limiter
+        download		shaping.Limiter
+        account		*quota.Session
+        active		int64
+        up			int64
+        down			int64
+        waiter		sync.WaitGroup
+        done			chan bool
+        closeOnce	sync.Once
+        endOnce		sync.Once
+        reason		string
+        cause		error
+}
+
+// Connections able to shut down their writing side only
+type closeWriter interface {
+    CloseWrite () (error)
+}
+
+/*----------------------------------------------------------
+    Relay Implementation
+-----------------------------------------------------------*/
+
+// reader is the client's buffered reader, anything already buffered
+// in it is sent to the target first. idle is 0 for no idle timeout.
+// shaper holds the bandwidth of the session, account counts its traffic,
+// nil for none.
+func newRelay(client net.Conn, reader *bufio.Reader, target net.Conn, idle time.Duration, shaper *shaping.Session, account *quota.Session) (*relay) {
+
+    var relay *relay = &relay{ client : client, reader : reader, target : target, idle : idle, account : account, active : time.Now().UnixNano(), done : make(chan bool) }
+
+    if (shaper != nil) {
+        relay.upload, relay.download = shaper.Upload, shaper.Download
+    }
+
+    return relay
+}
+
+// Returns when both directions are finished
+func (relay *relay) run() {
+
+    relay.waiter.Add(2)
+
+    go relay.copyUp()
+    go relay.copyDown()
+
+    if (relay.idle != 0) {
+        go relay.watchdog()
+    }
+
+    relay.waiter.Wait()
+    close(relay.done)
+}
+
+// Bytes relayed, up and down
+func (relay *relay) counts() (int64, int64) {
+    return atomic.LoadInt64(&relay.up), atomic.LoadInt64(&relay.down)
+}
+
+// Why the relay ended, the error behind it if any
+func (relay *relay) result() (string, error) {
+    return relay.reason, relay.cause
+}
+
+// Client -> target
+func (relay *relay) copyUp() {
+
+    defer relay.waiter.Done()
+
+    // Bytes the handshake left in the client's buffer
+    if count := relay.reader.Buffered(); count > 0 {
+        buffered, _ := relay.reader.Peek(count)
+        written, err := relay.target.Write(buffered)
+        relay.reader.Discard(count)
+        atomic.AddInt64(&relay.up, int64(written))
+        if (relay.account != nil) {
+            relay.account.Upload.Add(written)
+        }
+        if (err != nil) {
+            relay.finish(relay.target, err)
+            return
+        }
+    }
+
+    // The client connection may have been replaced by an encapsulation,
+    // in that case its reader has to be used
+    var source io.Reader = relay.client
+    if _, ok := relay.client.(*net.TCPConn); !ok {
+        source = relay.reader
+    }
+
+    // Shaped or counted reads can't be spliced
+    source = relay.upload.Reader(source)
+    if (relay.account != nil) {
+        source = relay.account.Upload.Reader(source)
+    }
+
+    _, err := relay.copyStream(relay.target, source, &relay.up)
+
+    relay.finish(relay.target, err)
+}
+
+// Target -> client
+func (relay *relay) copyDown() {
+
+    defer relay.waiter.Done()
+
+    var source io.Reader = relay.download.Reader(relay.target)
+    if (relay.account != nil) {
+        source = relay.account.Download.Reader(source)
+    }
+
+    _, err := relay.copyStream(relay.client, source, &relay.down)
+
+    relay.finish(relay.client, err)
+}
+
+// One direction is done. On EOF only the writing side of dst is shut
+// down so the other direction can go on, on any error both connections
+// are closed.
+func (relay *relay) finish(dst net.Conn, err error) {
+
+    // The first direction to finish tells why the relay ends
+    relay.endOnce.Do(func() {
+        if (dst == relay.target) {
+            relay.reason, relay.cause = endReason(err, access.REASON_CLIENT)
+        } else {
+            relay.reason, relay.cause = endReason(err, access.REASON_TARGET)
+        }
+    })
+
+    if (err == nil) {
+        if writer, ok := dst.(closeWriter); ok {
+            if writer.CloseWrite() == nil {
+                return
+            }
+        }
+    } else {
+        log.Debugf("Relay stopped: %s\n", err.Error())
+    }
+
+    relay.closeOnce.Do(func() {
+        relay.client.Close()
+        relay.target.Close()
+    })
+}
+
+// Closes both connections once neither direction moved for the idle
+// timeout. The spliced copies are watched through the kernel's idea of
+// when the connections last received data.
+func (relay *relay) watchdog() {
+
+    var ticker *time.Ticker = time.NewTicker(relay.idle / RELAY_WATCHDOG_TICKS)
+    defer ticker.Stop()
+
+    for {
+        select {
+            case <-relay.done:
+                return
+            case <-ticker.C:
+                if quiet := relay.quiet(); quiet >= relay.idle {
+                    relay.endOnce.Do(func() {
+                        relay.reason, relay.cause = access.REASON_IDLE, errors.New("No traffic for " + quiet.Round(time.Second).String())
+                    })
+                    relay.closeOnce.Do(func() {
+                        relay.client.Close()
+                        relay.target.Close()
+                    })
+                    return
+                }
+                break
+        }
+    }
+}
+
+// How long neither direction moved
+func (relay *relay) quiet() (time.Duration) {
+
+    var quiet time.Duration = time.Since(time.Unix(0, atomic.LoadInt64(&relay.active)))
+
+    for _, conn := range []net.Conn{ relay.client, relay.target } {
+        if received, ok := lastReceived(conn); ok && received < quiet {
+            quiet = received
+        }
+    }
+
+    return quiet
+}
+
+// Copy src to dst until EOF, counting the bytes written. When dst is a
+// TCP connection its ReadFrom is used, which splices on Linux when src
+// is a TCP connection too; otherwise a pooled buffer is used. A spliced
+// copy is only seen by the watchdog where the kernel tells when the
+// connections last received data.
+func (relay *relay) copyStream(dst net.Conn, src io.Reader, count *int64) (int64, error) {
+
+    var writer io.Writer = &countingWriter{ writer : dst, count : count, active : &relay.active }
+
+    if ((relay.idle == 0) || KERNEL_ACTIVITY) {
+        if tcp, ok := dst.(*net.TCPConn); ok {
+            if _, ok = src.(*net.TCPConn); ok {
+                written, err := tcp.ReadFrom(src)
+                atomic.AddInt64(count, written)
+                return written, err
+            }
+        }
+    }
+
+    buffer := bufferPool.Get().(*[]byte)
+    defer bufferPool.Put(buffer)
+
+    // Hide any ReaderFrom/WriterTo so the pooled buffer is used
+    return io.CopyBuffer(writer, struct{ io.Reader }{ src }, *buffer)
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+
+// Why reading from a peer ended, eof is the reason when the peer closed
+func endReason(err error, eof string) (string, error) {
+
+    var netError net.Error
+
+    switch {
+        case (err == nil) || (err == io.EOF):
+            return eof, nil
+        case errors.Is(err, net.ErrClosed):
+            return access.REASON_CLOSED, nil
+        case errors.As(err, &netError) && netError.Timeout():
+            return access.REASON_IDLE, err
+    }
+
+    return access.REASON_ERROR, err
+}
+
+// Counts the bytes written, and stamps active with the time of the write
+type countingWriter struct {
+        writer		io.Writer
+        count		*int64
+        active		*int64
+}
+
+func (writer *countingWriter) Write(data []byte) (int, error) {
+
+    written, err := writer.writer.Write(data)
+    atomic.AddInt64(writer.count, int64(written))
+    atomic.StoreInt64(writer.active, time.Now().UnixNano())
+
+    return written, err
+}
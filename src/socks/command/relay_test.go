@@ -0,0 +1,315 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package command
+
+import (
+        "bufio"
+        "io"
+        golog "log"
+        "net"
+        "os"
+        "sync"
+        "testing"
+        "time"
+        "socks/log"
+)
+
+// Bytes written at once by the benchmarks' sender
+const BENCH_CHUNK = 64 * 1024
+
+/* Every benchmark pushes the same stream through a relay made of two
+   loopback TCP pairs:
+
+       sender -> client ==relay==> target -> sink
+
+   and the reply stream the other way, so that both directions are busy.
+*/
+
+// A connected loopback TCP pair
+func loopbackPair(b *testing.B) (net.Conn, net.Conn) {
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if (err != nil) {
+        b.Fatalf("listen: %v", err)
+    }
+    defer listener.Close()
+
+    dialed, err := net.Dial("tcp", listener.Addr().String())
+    if (err != nil) {
+        b.Fatalf("dial: %v", err)
+    }
+
+    accepted, err := listener.Accept()
+    if (err != nil) {
+        b.Fatalf("accept: %v", err)
+    }
+
+    return dialed, accepted
+}
+
+// Runs the relay between client and target while b.N chunks go through
+// it each way, then until both ends are closed
+func benchRelay(b *testing.B, relay func(client net.Conn, target net.Conn)) {
+
+    sender, client := loopbackPair(b)
+    target, sink := loopbackPair(b)
+
+    var chunk []byte = make([]byte, BENCH_CHUNK)
+    var total int64 = int64(b.N) * BENCH_CHUNK
+    var waiter sync.WaitGroup
+
+    b.SetBytes(2 * BENCH_CHUNK)
+    b.ResetTimer()
+
+    var done chan bool = make(chan bool)
+    go func() {
+        defer close(done)
+        relay(client, target)
+    }()
+
+    // Each end writes its stream and reads the other end's
+    waiter.Add(4)
+    for _, conn := range []net.Conn{ sender, sink } {
+        go func(conn net.Conn) {
+            defer waiter.Done()
+            for i := 0; i < b.N; i++ {
+                if _, err := conn.Write(chunk); err != nil {
+                    b.Errorf("write: %v", err)
+                    return
+                }
+            }
+        }(conn)
+        go func(conn net.Conn) {
+            defer waiter.Done()
+            if read, err := io.CopyN(io.Discard, conn, total); err != nil {
+                b.Errorf("read %d of %d: %v", read, total, err)
+            }
+        }(conn)
+    }
+    waiter.Wait()
+
+    b.StopTimer()
+
+    sender.Close()
+    sink.Close()
+    <-done
+}
+
+// The relay of CONNECT, spliced by the kernel
+func BenchmarkRelay(b *testing.B) {
+    benchRelay(b, func(client net.Conn, target net.Conn) {
+        newRelay(client, bufio.NewReader(client), target, 0, nil, nil).run()
+    })
+}
+
+// The same with the idle watchdog running
+func BenchmarkRelayIdle(b *testing.B) {
+    benchRelay(b, func(client net.Conn, target net.Conn) {
+        newRelay(client, bufio.NewReader(client), target, time.Hour, nil, nil).run()
+    })
+}
+
+// The relay before it was reworked, at the log level of the shipped
+// conf: the Info lines are formatted, then filtered
+func BenchmarkBaseline(b *testing.B) {
+    benchBaseline(b, log.WarningLevel)
+}
+
+// The same with the Info lines written, the default level
+func BenchmarkBaselineInfo(b *testing.B) {
+    benchBaseline(b, log.InfoLevel)
+}
+
+// A copy through a user space buffer each way, what a shaped or counted
+// session costs
+func BenchmarkBufferedCopy(b *testing.B) {
+    benchRelay(b, func(client net.Conn, target net.Conn) {
+        go func() {
+            io.Copy(struct{ io.Writer }{ client }, struct{ io.Reader }{ target })
+            client.Close()
+        }()
+        io.Copy(struct{ io.Writer }{ target }, struct{ io.Reader }{ client })
+        target.Close()
+    })
+}
+
+/*----------------------------------------------------------
+    The relay before it was reworked
+-----------------------------------------------------------*/
+
+// Its log lines go nowhere, at level
+func benchBaseline(b *testing.B, level log.Level) {
+
+    golog.SetOutput(io.Discard)
+    log.SetLevel(level)
+    defer golog.SetOutput(os.Stderr)
+    defer log.SetLevel(log.InfoLevel)
+
+    benchRelay(b, func(client net.Conn, target net.Conn) {
+        newBaseline(client, target).run()
+    })
+}
+
+// The CONNECT relay of the first release: a reader and a writer
+// goroutine each way handing over a fresh buffer per read through a
+// channel, with Info lines for each of them
+type baseline struct {
+        client			net.Conn
+        connection		net.Conn
+        reader			*bufio.Reader
+        writer			*bufio.Writer
+        upstream			chan []byte
+        downstream		chan	 []byte
+        upstop			chan bool
+        downstop			chan bool
+        waiter			sync.WaitGroup
+}
+
+func newBaseline(client net.Conn, target net.Conn) (*baseline) {
+
+    return &baseline{ client		: client,
+                      connection	: target,
+                      reader		: bufio.NewReader(client),
+                      writer		: bufio.NewWriter(client),
+                      upstream		: make(chan []byte),
+                      downstream	: make(chan []byte),
+                      upstop		: make(chan bool),
+                      downstop		: make(chan bool) }
+}
+
+func (command *baseline) run() {
+
+    command.waiter.Add(4)
+
+    go command.listenUpstream()
+    go command.listenDownstream()
+    go command.upstreamProxy()
+    go command.downstreamProxy()
+
+    log.Infof("Waiting for proxying to finish\n")
+
+    command.waiter.Wait()
+
+    command.connection.Close()
+
+    log.Infof("Proxying finished\n")
+}
+
+func (command *baseline) listenUpstream() {
+
+    log.Infof("Entering listenUpstream\n")
+
+    defer command.waiter.Done()
+
+    var status bool = false
+    for {
+        select {
+            case data := <-command.upstream :
+                command.writer.Write(data)
+                command.writer.Flush()
+                log.Infof("Sending data to downstream(%s) - bytes: %d\n", command.client.RemoteAddr().String(), len(data))
+            case status = <-command.upstop :
+                log.Infof("Received upstream stop signal\n")
+                break
+        }
+        if (status == true) {
+            break
+        }
+    }
+
+    log.Infof("Leaving listenUpstream\n")
+}
+
+func (command *baseline) listenDownstream() {
+
+    log.Infof("Entering listenDownstream\n")
+
+    defer command.waiter.Done()
+
+    var writer *bufio.Writer = bufio.NewWriter(command.connection)
+
+    var status bool = false
+    for {
+        select {
+            case data := <-command.downstream :
+                writer.Write(data)
+                writer.Flush()
+                log.Infof("Sending data to upstream(%s) - bytes: %d\n", command.connection.RemoteAddr().String(), len(data))
+            case status = <-command.downstop :
+                log.Infof("Received downstream stop signal\n")
+                break
+        }
+        if (status == true) {
+            break
+        }
+    }
+
+    log.Infof("Leaving listenDownstream\n")
+}
+
+func (command *baseline) upstreamProxy() {
+
+    log.Infof("Entering upstreamProxy\n")
+
+    defer command.waiter.Done()
+
+    var reader *bufio.Reader = bufio.NewReader(command.connection)
+
+    for {
+        var buffer []byte = make([]byte, reader.Size())
+
+        count, err := reader.Read(buffer)
+
+        log.Infof("Reading data from upstream(%s): - bytes: %d, err: %#v\n", command.connection.RemoteAddr().String(), count, err)
+        log.DebugBinary(buffer[:count])
+
+        if (count != 0) {
+            command.upstream <- buffer[:count]
+
+            log.Infof("Sending data to downstream(%s): - bytes: %d, err: %#v\n", command.client.RemoteAddr().String(), count, err)
+        }
+
+        if (err == io.EOF) {
+            log.Infof("Sending upstream stop signal\n")
+            command.upstop <- true
+            break
+        }
+    }
+
+    log.Infof("Leaving upstreamProxy\n")
+}
+
+func (command *baseline) downstreamProxy() {
+
+    log.Infof("Entering downstreamProxy\n")
+
+    defer command.waiter.Done()
+
+    for {
+        var buffer []byte = make([]byte, command.reader.Size())
+
+        count, err := command.reader.Read(buffer)
+
+        log.Infof("Reading data from downstream(%s): - bytes: %d, err: %#v\n", command.client.RemoteAddr().String(), count, err)
+        log.DebugBinary(buffer[:count])
+
+        if (count != 0) {
+            command.downstream <- buffer[:count]
+
+            log.Infof("Sending data to upstream(%s): - bytes: %d, err: %#v\n", command.connection.RemoteAddr().String(), count, err)
+        }
+
+        if (err == io.EOF) {
+            log.Infof("Sending downstream stop signal\n")
+            command.downstop <- true
+            break
+        }
+    }
+
+    log.Infof("Leaving downstreamProxy\n")
+}
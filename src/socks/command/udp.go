@@ -0,0 +1,493 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package command
+
+import (
+        "errors"
+        "net"
+        "strconv"
+        "sync"
+        "socks"
+        "socks/log"
+        "socks/acl"
+        "socks/access"
+        "socks/address"
+        "socks/config"
+        "socks/context"
+        "socks/quota"
+        "socks/shaping"
+        "socks/upstream"
+)
+
+// Largest datagram the relay handles
+const UDP_MAX_DATAGRAM = 65535
+
+// Most ACL verdicts an association keeps before it starts over
+const UDP_MAX_VERDICTS = 1024
+
+// Most targets an association takes replies from before it starts over
+const UDP_MAX_TARGETS = 1024
+
+type CommandUDPAssociation struct {
+        relay		*net.UDPConn
+        remote		*net.UDPConn
+        client		*net.UDPAddr
+        fragments	*reassembler
+        rules		*acl.Acl
+        verdicts		map[string]bool
+        targets		map[string]bool
+        shaper		*shaping.Session
+        account		*quota.Session
+        up			int64
+        down			int64
+        mutex		sync.Mutex
+        waiter		sync.WaitGroup
+        address		*address.Address
+        context		*context.Context
+}
+
+/*----------------------------------------------------------
+    UDP Association Command
+-----------------------------------------------------------*/
+/* RFC 1928
+7.  Procedure for UDP-based clients
+
+   A UDP-based client MUST send its datagrams to the UDP relay server at
+   the UDP port indicated by BND.PORT in the reply to the UDP ASSOCIATE
+   request.  If the selected authentication method provides
+   encapsulation for the purposes of authenticity, integrity, and/or
+   confidentiality, the datagram MUST be encapsulated using the
+   appropriate encapsulation.  Each UDP datagram carries a UDP request
+   header with it:
+
+      +----+------+------+----------+----------+----------+
+      |RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+      +----+------+------+----------+----------+----------+
+      | 2  |  1   |  1   | Variable |    2     | Variable |
+      +----+------+------+----------+----------+----------+
+
+   The fields in the UDP request header are:
+
+          o  RSV  Reserved X'0000'
+          o  FRAG    Current fragment number
+          o  ATYP    address type of following addresses:
+             o  IP V4 address: X'01'
+             o  DOMAINNAME: X'03'
+             o  IP V6 address: X'04'
+          o  DST.ADDR       desired destination address
+          o  DST.PORT       desired destination port
+          o  DATA     user data
+
+   When a UDP relay server receives a reply datagram from a remote
+   host, it MUST encapsulate that datagram using the above UDP request
+   header, and any authentication-method-dependent encapsulation.
+
+   The UDP relay server MUST acquire from the SOCKS server the expected
+   IP address of the client that will send datagrams to the BND.PORT
+   given in the reply to UDP ASSOCIATE.  It MUST drop any datagrams
+   arriving from any source IP address other than the one recorded for
+   the particular association.
+
+   A UDP association terminates when the TCP connection that the UDP
+   ASSOCIATE request arrived on terminates.
+
+   The datagrams are not encapsulated, so the association is refused
+   when the method encapsulates the control connection (the GSS-API
+   protection levels of RFC 1961): they would go unprotected.
+*/
+func NewCommandUDPAssociation (address *address.Address, context *context.Context) (*CommandUDPAssociation) {
+    return &CommandUDPAssociation {  address : address, context : context }
+}
+
+func (command *CommandUDPAssociation) Execute () {
+
+    var err error
+
+    if (command.context.Encapsulated()) {
+        err = errors.New("UDP datagrams can't be encapsulated for the negotiated method")
+        command.response(socks.SOCKS_V5_STATUS_COMMAND_UNSUPPORTED, nil)
+        command.context.Record().End(access.REASON_REQUEST, err)
+        log.Errorf("UDP association refused: %s\n", err.Error())
+        return
+    }
+
+    // The relay socket faces the client, it listens on the same
+    // interface the client connected to.
+    var local *net.UDPAddr = &net.UDPAddr{}
+    if addr, ok := (*command.context.Connection()).LocalAddr().(*net.TCPAddr); ok {
+        local.IP = addr.IP
+    }
+
+    command.relay, err = net.ListenUDP("udp", local)
+    if (err != nil) {
+        command.response(socks.SOCKS_V5_STATUS_SERVER_FAILURE, nil)
+        command.context.Record().End(access.REASON_FAILED, err)
+        log.Errorf("UDP relay listener failed: %s\n", err.Error())
+        return
+    }
+
+    // The remote socket faces the target hosts
+    command.remote, err = upstream.GetOutbound(&command.context.Config().Outbound).Select(command.context).ListenUDP()
+    if (err != nil) {
+        command.relay.Close()
+        command.response(socks.SOCKS_V5_STATUS_SERVER_FAILURE, nil)
+        command.context.Record().End(access.REASON_FAILED, err)
+        log.Errorf("UDP remote socket failed: %s\n", err.Error())
+        return
+    }
+
+    // Fragment reassembly is optional
+    if (command.context.Config().Udp.Reassembly) {
+        command.fragments = newReassembler(&command.context.Config().Udp)
+    }
+
+    // Every target of the datagrams is checked against the ACL
+    command.rules = acl.Get(command.context.Config().AclProfile(command.context.Listener().Acl))
+    command.verdicts = make(map[string]bool)
+
+    // Replies are taken from the targets the client sent to only
+    command.targets = make(map[string]bool)
+
+    // The bandwidth of the association
+    command.shaper = shaping.Get(&command.context.Config().Shaping).Open(command.context)
+    defer command.shaper.Close()
+
+    // The traffic of the user
+    command.account = quota.Open(command.context)
+    defer command.account.Close()
+
+    // Record the address the client is expected to send from
+    command.client = command.expectedClient()
+
+    log.Infof("UDP relay listening on: %s for client: %s\n", command.relay.LocalAddr().String(), command.client.String())
+
+    // Tell the client where to send its datagrams
+    command.response(socks.SOCKS_V5_STATUS_SUCCESS, command.relay.LocalAddr())
+
+    command.waiter.Add(2)
+
+    go command.upstreamRelay()
+    go command.downstreamRelay()
+
+    // The association lives as long as the control connection
+    command.context.Record().End(endReason(command.waitControl(), access.REASON_CLIENT))
+
+    command.relay.Close()
+    command.remote.Close()
+
+    command.waiter.Wait()
+
+    command.context.Record().Up, command.context.Record().Down = command.up, command.down
+
+    if (command.fragments != nil) {
+        command.fragments.close()
+
+        outOfOrder, expired, overflow := command.fragments.stats()
+        log.Infof("UDP fragments dropped for %s - out of order: %d, timed out: %d, overflow: %d\n", command.client.String(), outOfOrder, expired, overflow)
+    }
+
+    log.Infof("UDP association finished: %s\n", command.client.String())
+
+    // Done
+    return
+}
+
+// The client may announce the address it will send from in DST.ADDR
+// and DST.PORT. Zeros mean it doesn't know yet, in that case the IP of
+// the control connection is used and the port is learned from the first
+// datagram.
+func (command *CommandUDPAssociation) expectedClient() (*net.UDPAddr) {
+
+    var client *net.UDPAddr = &net.UDPAddr{}
+
+    if addr, ok := (*command.context.Connection()).RemoteAddr().(*net.TCPAddr); ok {
+        client.IP = addr.IP
+    }
+
+    if ((*command.address).Atyp() != socks.SOCKS_V5_ATYP_FQDN) {
+        ip := net.ParseIP((*command.address).DstAddr())
+        if ((ip != nil) && !ip.IsUnspecified()) {
+            client.IP = ip
+        }
+    }
+
+    client.Port = (*command.address).DstPort()
+
+    return client
+}
+
+// Check the source of a datagram against the recorded client address
+func (command *CommandUDPAssociation) fromClient(addr *net.UDPAddr) (bool) {
+
+    command.mutex.Lock()
+    defer command.mutex.Unlock()
+
+    if (!command.client.IP.Equal(addr.IP)) {
+        return false
+    }
+
+    // First datagram, learn the port
+    if (command.client.Port == 0) {
+        command.client.Port = addr.Port
+    }
+
+    return command.client.Port == addr.Port
+}
+
+func (command *CommandUDPAssociation) clientAddr() (*net.UDPAddr) {
+
+    command.mutex.Lock()
+    defer command.mutex.Unlock()
+
+    var client net.UDPAddr = *command.client
+
+    return &client
+}
+
+// Block until the control connection is closed, returns the read error
+func (command *CommandUDPAssociation) waitControl() (error) {
+
+    var buffer []byte = make([]byte, 512)
+
+    for {
+        _, err := command.context.Reader().Read(buffer)
+        if (err != nil) {
+            return err
+        }
+    }
+}
+
+// Client -> target
+func (command *CommandUDPAssociation) upstreamRelay() {
+
+    defer command.waiter.Done()
+
+    var buffer []byte = make([]byte, UDP_MAX_DATAGRAM)
+
+    for {
+        count, addr, err := command.relay.ReadFromUDP(buffer)
+        if (err != nil) {
+            break
+        }
+
+        // Drop any datagram not coming from the client
+        if (!command.fromClient(addr)) {
+            log.Debugf("UDP datagram from unexpected source dropped: %s\n", addr.String())
+            continue
+        }
+
+        frag, requested, ips, data, err := parseDatagram(buffer[:count], command.context.Config())
+        if (err != nil) {
+            log.Debugf("UDP datagram from %s dropped: %s\n", addr.String(), err.Error())
+            continue
+        }
+
+        // The first address the ACL allows, in the order a connection
+        // would try them
+        var target *net.UDPAddr
+        for _, ip := range ips {
+            if (command.allowed(requested, ip)) {
+                target = &net.UDPAddr{ IP : ip, Port : requested.DstPort() }
+                break
+            }
+        }
+
+        if (target == nil) {
+            log.Debugf("UDP datagram from %s to %s denied\n", addr.String(), net.JoinHostPort(requested.DstAddr(), strconv.Itoa(requested.DstPort())))
+            continue
+        }
+
+        if (frag != 0) {
+
+            // Fragmentation is not enabled
+            if (command.fragments == nil) {
+                log.Debugf("UDP fragment from %s dropped\n", addr.String())
+                continue
+            }
+
+            // Wait for the rest of the sequence
+            target, data = command.fragments.add(frag, target, data)
+            if (data == nil) {
+                continue
+            }
+        }
+
+        // A datagram waits for its turn, the ones behind it queue up in
+        // the socket buffer
+        command.shaper.Upload.Wait(len(data))
+        command.account.Upload.Add(len(data))
+        command.up += int64(len(data))
+
+        command.sent(target)
+        command.remote.WriteToUDP(data, target)
+    }
+}
+
+// Record a target the client sent to, its replies are relayed
+func (command *CommandUDPAssociation) sent(target *net.UDPAddr) {
+
+    command.mutex.Lock()
+    defer command.mutex.Unlock()
+
+    if (command.targets[target.String()]) {
+        return
+    }
+
+    if (len(command.targets) >= UDP_MAX_TARGETS) {
+        command.targets = make(map[string]bool)
+    }
+
+    command.targets[target.String()] = true
+}
+
+// Whether the client sent to source, the datagrams of any other host
+// are dropped
+func (command *CommandUDPAssociation) repliesFrom(source *net.UDPAddr) (bool) {
+
+    command.mutex.Lock()
+    defer command.mutex.Unlock()
+
+    return command.targets[source.String()]
+}
+
+// Whether the ACL lets datagrams go to requested, which was sent to ip.
+// The verdicts are kept for the association, only the upstream relay
+// calls it.
+func (command *CommandUDPAssociation) allowed(requested address.Address, ip net.IP) (bool) {
+
+    var key string = net.JoinHostPort(requested.DstAddr(), strconv.Itoa(requested.DstPort())) + " " + ip.String()
+
+    if verdict, found := command.verdicts[key]; found {
+        return verdict
+    }
+
+    if (len(command.verdicts) >= UDP_MAX_VERDICTS) {
+        command.verdicts = make(map[string]bool)
+    }
+
+    var request *acl.Request = acl.NewRequest(command.context, socks.SOCKS_COMMAND_UDP_ASSOCIATE, requested)
+    var verdict bool
+
+    // A domain name is matched with the address it resolved to as well
+    if (requested.Atyp() == socks.SOCKS_V5_ATYP_FQDN) {
+        verdict, _ = command.rules.EvaluateResolved(request, ip)
+    } else {
+        verdict, _, _ = command.rules.Evaluate(request)
+    }
+
+    command.verdicts[key] = verdict
+
+    return verdict
+}
+
+// Target -> client
+func (command *CommandUDPAssociation) downstreamRelay() {
+
+    defer command.waiter.Done()
+
+    var buffer []byte = make([]byte, UDP_MAX_DATAGRAM)
+
+    for {
+        count, addr, err := command.remote.ReadFromUDP(buffer)
+        if (err != nil) {
+            break
+        }
+
+        // Only the targets the client sent to may answer
+        if (!command.repliesFrom(addr)) {
+            log.Debugf("UDP datagram from unexpected source dropped: %s\n", addr.String())
+            continue
+        }
+
+        client := command.clientAddr()
+
+        // No datagram from the client yet, nowhere to send the reply
+        if (client.Port == 0) {
+            continue
+        }
+
+        command.shaper.Download.Wait(count)
+        command.account.Download.Add(count)
+        command.down += int64(count)
+
+        command.relay.WriteToUDP(buildDatagram(addr, buffer[:count]), client)
+    }
+}
+
+func (command *CommandUDPAssociation) response(statuscode byte, addr net.Addr) {
+    responseAddr(command.context, statuscode, addr)
+}
+
+/*----------------------------------------------------------
+    UDP request header
+-----------------------------------------------------------*/
+
+// Parse the UDP request header, returns FRAG, the address requested, the
+// addresses it resolved to in the order a connection tries them, and the
+// data
+func parseDatagram(datagram []byte, conf *config.Config) (byte, address.Address, []net.IP, []byte, error) {
+
+    // RSV(2) + FRAG(1) + ATYP(1)
+    if (len(datagram) < 4) {
+        return 0, nil, nil, nil, errors.New("Datagram is too short")
+    }
+
+    var frag byte = datagram[2]
+    var atyp byte = datagram[3]
+    var rest []byte = datagram[4:]
+    var host string
+
+    switch atyp {
+        case socks.SOCKS_V5_ATYP_IP4:
+            if (len(rest) < 4 + 2) {
+                return 0, nil, nil, nil, errors.New("Datagram is too short")
+            }
+            host = net.IP(rest[:4]).String()
+            rest = rest[4:]
+            break
+        case socks.SOCKS_V5_ATYP_IP6:
+            if (len(rest) < 16 + 2) {
+                return 0, nil, nil, nil, errors.New("Datagram is too short")
+            }
+            host = net.IP(rest[:16]).String()
+            rest = rest[16:]
+            break
+        case socks.SOCKS_V5_ATYP_FQDN:
+            if ((len(rest) < 1) || (len(rest) < 1 + int(rest[0]) + 2)) {
+                return 0, nil, nil, nil, errors.New("Datagram is too short")
+            }
+            host = string(rest[1:1 + int(rest[0])])
+            rest = rest[1 + int(rest[0]):]
+            break
+        default:
+            return 0, nil, nil, nil, errors.New("No supported address")
+    }
+
+    var port int = (int(rest[0]) << 8) | int(rest[1])
+
+    ips, err := upstream.Resolve(conf, host)
+    if (err != nil) {
+        return 0, nil, nil, nil, err
+    }
+
+    return frag, address.New(atyp, host, port), ips, rest[2:], nil
+}
+
+// Wrap a reply from the target into the UDP request header
+func buildDatagram(source *net.UDPAddr, data []byte) ([]byte) {
+
+    atyp, addr := bindAddress(source)
+
+    var datagram []byte = make([]byte, 0, 4 + len(addr) + len(data))
+
+    datagram = append(datagram, 0x00, 0x00, 0x00, atyp)
+    datagram = append(datagram, addr...)
+    datagram = append(datagram, data...)
+
+    return datagram
+}
@@ -0,0 +1,241 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package command
+
+import (
+        "bytes"
+        "encoding/binary"
+        "io"
+        "net"
+        "testing"
+        "time"
+        "socks"
+        "socks/address"
+        "socks/config"
+        "socks/context"
+)
+
+func TestParseDatagram(t *testing.T) {
+
+    var hosts map[string][]string = map[string][]string{
+        "dual.test" : { "2001:db8::1", "2001:db8::2", "192.0.2.1" },
+        "v4.test" : { "192.0.2.1", "192.0.2.2" },
+    }
+
+    var cases = []struct {
+        name			string
+        prefer		string
+        datagram		[]byte
+        ips			[]string
+    }{
+        { "ipv4", "", testDatagram(0, "192.0.2.9", 53, "data"), []string{ "192.0.2.9" } },
+        { "ipv6", "", testDatagram(0, "2001:db8::9", 53, "data"), []string{ "2001:db8::9" } },
+        { "name, ipv6 first", "", testDatagram(0, "dual.test", 53, "data"), []string{ "2001:db8::1", "192.0.2.1", "2001:db8::2" } },
+        { "name, ipv4 first", "ipv4", testDatagram(0, "dual.test", 53, "data"), []string{ "192.0.2.1", "2001:db8::1", "2001:db8::2" } },
+        { "name, one family", "", testDatagram(0, "v4.test", 53, "data"), []string{ "192.0.2.1", "192.0.2.2" } },
+        { "short", "", []byte{ 0, 0, 0 }, nil },
+        { "short address", "", []byte{ 0, 0, 0, socks.SOCKS_V5_ATYP_IP4, 192, 0, 2 }, nil },
+        { "short name", "", []byte{ 0, 0, 0, socks.SOCKS_V5_ATYP_FQDN, 9, 'v', '4' }, nil },
+        { "unknown address type", "", []byte{ 0, 0, 0, 0x05, 0, 0, 0, 0, 0, 53 }, nil },
+    }
+
+    for _, test := range cases {
+
+        var conf *config.Config = &config.Config{ Resolver : config.ResolverConf{ Hosts : hosts }, Outbound : config.OutboundConf{ Prefer : test.prefer } }
+
+        _, requested, ips, data, err := parseDatagram(test.datagram, conf)
+
+        if (test.ips == nil) {
+            if (err == nil) {
+                t.Errorf("%s: parsed", test.name)
+            }
+            continue
+        }
+
+        if (err != nil) {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+
+        var got []string
+        for _, ip := range ips {
+            got = append(got, ip.String())
+        }
+
+        if ((len(got) != len(test.ips)) || (string(data) != "data") || (requested.DstPort() != 53)) {
+            t.Errorf("%s: %v %q port %d, want %v", test.name, got, data, requested.DstPort(), test.ips)
+            continue
+        }
+        for index := range got {
+            if (got[index] != test.ips[index]) {
+                t.Errorf("%s: %v, want %v", test.name, got, test.ips)
+                break
+            }
+        }
+    }
+}
+
+// Replies come from the targets the client sent to, not from any host
+// that learned the relay's port
+func TestAssociationReplies(t *testing.T) {
+
+    client, relay := udpSession(t)
+
+    target, err := net.ListenUDP("udp", &net.UDPAddr{ IP : net.IPv4(127, 0, 0, 1) })
+    if (err != nil) {
+        t.Fatalf("target: %v", err)
+    }
+    defer target.Close()
+
+    var port int = target.LocalAddr().(*net.UDPAddr).Port
+    client.WriteToUDP(testDatagram(0, "127.0.0.1", port, "ping"), relay)
+
+    var buffer []byte = make([]byte, 512)
+    target.SetReadDeadline(time.Now().Add(5 * time.Second))
+    count, remote, err := target.ReadFromUDP(buffer)
+    if ((err != nil) || (string(buffer[:count]) != "ping")) {
+        t.Fatalf("target read %q: %v", buffer[:count], err)
+    }
+
+    // A stranger sends to the remote socket first, then the target
+    stranger, err := net.ListenUDP("udp", &net.UDPAddr{ IP : net.IPv4(127, 0, 0, 1) })
+    if (err != nil) {
+        t.Fatalf("stranger: %v", err)
+    }
+    defer stranger.Close()
+
+    stranger.WriteToUDP([]byte("spoofed"), remote)
+    time.Sleep(50 * time.Millisecond)
+    target.WriteToUDP([]byte("pong"), remote)
+
+    client.SetReadDeadline(time.Now().Add(5 * time.Second))
+    count, _, err = client.ReadFromUDP(buffer)
+    if (err != nil) {
+        t.Fatalf("client read: %v", err)
+    }
+
+    if expected := testDatagram(0, "127.0.0.1", port, "pong"); !bytes.Equal(buffer[:count], expected) {
+        t.Fatalf("client got %q, want %q", buffer[:count], expected)
+    }
+}
+
+// The datagrams can't be protected like the control connection, the
+// association is refused
+func TestAssociationEncapsulated(t *testing.T) {
+
+    client, server := net.Pipe()
+    defer client.Close()
+    defer server.Close()
+
+    go client.Write([]byte{ socks.SOCKS_VERSION_V5 })
+
+    contxt, err := context.New(server, &config.Config{}, &config.ListenerConf{})
+    if (err != nil) {
+        t.Fatalf("context: %v", err)
+    }
+    contxt.Reader().ReadByte()
+    contxt.Encapsulate(server)
+
+    var any address.Address = address.New(socks.SOCKS_V5_ATYP_IP4, "0.0.0.0", 0)
+    go NewCommandUDPAssociation(&any, contxt).Execute()
+
+    var reply []byte = make([]byte, 2)
+    client.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, err := io.ReadFull(client, reply); err != nil {
+        t.Fatalf("reply: %v", err)
+    }
+    if (reply[1] != socks.SOCKS_V5_STATUS_COMMAND_UNSUPPORTED) {
+        t.Fatalf("reply code: %d", reply[1])
+    }
+}
+
+/*----------------------------------------------------------
+    Helpers
+-----------------------------------------------------------*/
+
+// A datagram with the UDP request header
+func testDatagram(frag byte, host string, port int, data string) ([]byte) {
+
+    var datagram []byte = []byte{ 0, 0, frag }
+
+    if ip := net.ParseIP(host); ip == nil {
+        datagram = append(datagram, socks.SOCKS_V5_ATYP_FQDN, byte(len(host)))
+        datagram = append(datagram, host...)
+    } else if (ip.To4() != nil) {
+        datagram = append(datagram, socks.SOCKS_V5_ATYP_IP4)
+        datagram = append(datagram, ip.To4()...)
+    } else {
+        datagram = append(datagram, socks.SOCKS_V5_ATYP_IP6)
+        datagram = append(datagram, ip...)
+    }
+
+    datagram = binary.BigEndian.AppendUint16(datagram, uint16(port))
+
+    return append(datagram, data...)
+}
+
+// A UDP ASSOCIATE on a loopback control connection, past the handshake.
+// Returns the client's UDP socket and the relay address of the reply.
+func udpSession(t *testing.T) (*net.UDPConn, *net.UDPAddr) {
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if (err != nil) {
+        t.Fatalf("listen: %v", err)
+    }
+    defer listener.Close()
+
+    control, err := net.Dial("tcp", listener.Addr().String())
+    if (err != nil) {
+        t.Fatalf("dial: %v", err)
+    }
+
+    server, err := listener.Accept()
+    if (err != nil) {
+        t.Fatalf("accept: %v", err)
+    }
+
+    control.Write([]byte{ socks.SOCKS_VERSION_V5 })
+
+    contxt, err := context.New(server, &config.Config{}, &config.ListenerConf{})
+    if (err != nil) {
+        t.Fatalf("context: %v", err)
+    }
+    // The handshake would have read the version
+    contxt.Reader().ReadByte()
+
+    var any address.Address = address.New(socks.SOCKS_V5_ATYP_IP4, "0.0.0.0", 0)
+    var done chan bool = make(chan bool)
+
+    go func() {
+        defer close(done)
+        NewCommandUDPAssociation(&any, contxt).Execute()
+    }()
+
+    t.Cleanup(func() {
+        control.Close()
+        server.Close()
+        <-done
+    })
+
+    var reply []byte = make([]byte, 10)
+    control.SetReadDeadline(time.Now().Add(5 * time.Second))
+    if _, err := io.ReadFull(control, reply); err != nil {
+        t.Fatalf("reply: %v", err)
+    }
+    if (reply[1] != socks.SOCKS_V5_STATUS_SUCCESS) {
+        t.Fatalf("reply code: %d", reply[1])
+    }
+
+    client, err := net.ListenUDP("udp", &net.UDPAddr{ IP : net.IPv4(127, 0, 0, 1) })
+    if (err != nil) {
+        t.Fatalf("client: %v", err)
+    }
+    t.Cleanup(func() { client.Close() })
+
+    return client, &net.UDPAddr{ IP : net.IP(reply[4:8]), Port : int(binary.BigEndian.Uint16(reply[8:])) }
+}
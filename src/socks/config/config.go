@@ -8,32 +8,93 @@
 package config
 
 import (
+        "errors"
         "os"
         "os/user"
         "encoding/json"
         "io/ioutil"
         "path/filepath"
+        "strconv"
+        "time"
         "socks/log"
 )
 
 const	DEFAULT_CONF_FILE = "socks5.conf"
 
 type Config struct {
+    Path		string	`json:"-"`
     Daemon	bool
     Server	ServerConf
+    Listeners	[]ListenerConf
     Auth		AuthConf
     Log		LogConf
+    Udp		UdpConf
+    Gssapi	GssapiConf
+    Acl		AclConf
+    Acls		map[string]*AclConf
+    Upstream	UpstreamConf
+    Resolver	ResolverConf
+    Outbound	OutboundConf
+    Timeouts	TimeoutConf
+    Limits		LimitConf
+    Shaping		ShapingConf
+    Quota		QuotaConf
+    Access		AccessConf
 }
 
+// The main listener.
+//   Methods		overrides Auth.Methods for this listener
+//   Drain		seconds sessions in flight get to finish on shutdown, 0 for 30
+//   EchoDestination	CONNECT replies echo DST.ADDR/DST.PORT instead of the
+//			outgoing socket address, for clients relying on the old behaviour
+//   Egress		the outbound profile of the listener's sessions
 type ServerConf	struct {
     Protocol		string
     Address		string
     Listen		int
+    Methods		[]string
+    Drain		int
+    EchoDestination	bool
+    Egress		string
 }
 
+// One of the listeners, all served by the same process. Transport is
+// "tcp" (default), "tls" or "unix", Address is the socket path for
+// "unix". Methods, EchoDestination and Egress are the same as in the
+// server section. Acl names the ACL profile in acls, empty for the acl
+// section.
+//
+// A "tls" listener serves Certificate and Key (PEM files), MinVersion is
+// "1.0" to "1.3" ("1.2" by default). With ClientCa, a CA bundle, client
+// certificates are verified: ClientAuth "require" (default) refuses
+// clients without one, "optional" accepts them. Identity makes the
+// verified certificate the session's username: "cn" for the subject
+// common name, "subject" for the whole subject.
+type ListenerConf struct {
+    Name			string
+    Transport		string
+    Address		string
+    Listen		int
+    Methods		[]string
+    Acl			string
+    Egress		string
+    EchoDestination	bool
+    Certificate		string
+    Key			string
+    MinVersion		string
+    ClientCa		string
+    ClientAuth		string
+    Identity		string
+}
+
+// Either a single Username/Password pair, or Userfile pointing to
+// an htpasswd style user database. Methods lists the enabled methods
+// ("noauth", "gssapi", "userpass") in server preferred order.
 type AuthConf struct {
     Username		string
     Password		string
+    Userfile		string
+    Methods		[]string
 }
 
 type LogConf	 struct {
@@ -41,42 +102,445 @@ type LogConf	 struct {
     Path		string
 }
 
+// GSSAPI acceptor settings. Keytab holds the Kerberos keys of the
+// service, Service is the first component of the service principal the
+// tickets must be for ("rcmd/proxy.example.com@REALM"), any when empty.
+// Protection is the highest per-message protection granted: "integrity"
+// or "confidentiality" (default). UDP ASSOCIATE is refused to GSSAPI
+// clients, the datagrams would go unprotected.
+type GssapiConf struct {
+    Keytab		string
+    Service		string
+    Protection	string
+}
+
+// The access log, one record per finished session, apart from the
+// diagnostic log. Path is the file it is appended to, empty for none,
+// reopened on SIGHUP for logrotate. Format is "json" (default) for
+// JSON lines, or "text" for lines built by Template, a Go text/template
+// over an access.Record.
+type AccessConf struct {
+    Path			string
+    Format		string
+    Template		string
+}
+
+// Access control, the first matching rule wins. Default is the action
+// when no rule matches ("allow" unless set to "deny").
+type AclConf struct {
+    Default		string
+    Rules		[]AclRule
+}
+
+// Every non-empty field has to match for the rule to match, any entry
+// of a field matches.
+//   Clients		client CIDRs
+//   Users		authenticated usernames
+//   Commands		"connect", "bind", "udp"
+//   Destinations	destination CIDRs
+//   Domains		domain globs ("*.example.com") or suffixes (".example.com")
+//   Ports		ports or port ranges ("80", "8000-8080")
+// A domain name matches Destinations by the addresses it resolves to.
+// When such a rule comes before the one deciding a request the server
+// resolves the name first, also when an upstream proxy connects to it,
+// and the first address allowed decides.
+// Egress is the outbound profile of the requests the rule allows.
+// Upload and Download cap the bandwidth shared by the sessions the rule
+// allows, in bytes per second.
+type AclRule struct {
+    Name			string
+    Action		string
+    Clients		[]string
+    Users		[]string
+    Commands		[]string
+    Destinations	[]string
+    Domains		[]string
+    Ports		[]string
+    Egress		string
+    Upload		int64
+    Download		int64
+}
+
+// Upstream proxies. Chains are lists of parent proxies, used in order.
+// The first matching route picks the chain, Default is used when none
+// matches, an empty chain name means a direct connection.
+type UpstreamConf struct {
+    Chains		map[string][]ProxyConf
+    Routes		[]RouteConf
+    Default		string
+}
+
+// A parent proxy, Type is "socks5", "socks4a" or "http"
+type ProxyConf struct {
+    Type			string
+    Address		string
+    Username		string
+    Password		string
+}
+
+// A route matches the same way as an ACL rule
+type RouteConf struct {
+    Chain		string
+    Clients		[]string
+    Users		[]string
+    Destinations	[]string
+    Domains		[]string
+    Ports		[]string
+}
+
+// Name resolution of domain name destinations. Upstream is empty for the
+// system resolver, or one of "udp://ip[:port]", "tcp://ip[:port]",
+// "tls://host[:port]" (DNS over TLS, the certificate is checked against
+// Servername when set) and an "https://" URL (DNS over HTTPS). Hosts maps
+// names to fixed addresses. Cache is the maximum number of cached answers,
+// negative disables caching. Ttl is how long system resolver answers are
+// kept, NegativeTtl caps how long a missing name is remembered. All times
+// are in seconds, 0 picks the default.
+type ResolverConf struct {
+    Upstream		string
+    Servername		string
+    Timeout		int
+    Hosts		map[string][]string
+    Cache		int
+    Ttl			int
+    NegativeTtl		int
+}
+
+// Connections to the targets. A domain name target is dialed over both
+// address families (RFC 8305 Happy Eyeballs): Prefer is the family tried
+// first, "ipv6" (default) or "ipv4". AttemptDelay is how many milliseconds
+// an attempt gets before the next address is tried in parallel, Timeout
+// the seconds the whole dial may take, 0 for no limit.
+//
+// Profiles are named egress settings. The profile of a connection is the
+// one of the ACL rule that allowed it, else the one Users maps the user
+// to, else the listener's, else Egress. No profile uses the kernel's
+// default source address.
+type OutboundConf struct {
+    Prefer		string
+    AttemptDelay	int
+    Timeout		int
+    Egress		string
+    Profiles		map[string]EgressConf
+    Users		map[string]string
+}
+
+// Source is a pool of local addresses used round-robin, the next one of
+// the target's family is picked. Interface binds to a network device
+// (SO_BINDTODEVICE) and Mark sets SO_MARK, both Linux only.
+type EgressConf struct {
+    Source		[]string
+    Interface		string
+    Mark			int
+}
+
+// Per connection timeouts in seconds, 0 picks the default and a negative
+// value disables one. Handshake bounds everything up to the end of the
+// authentication (TLS included), Request the reading of the request,
+// Dial the connection to the target through the upstream proxies. Idle
+// ends a relay when neither direction saw traffic for that long, a
+// watchdog checks it so the copies can still be spliced. Bind is how
+// long a BIND waits for the application server to connect back.
+type TimeoutConf struct {
+    Handshake		int
+    Request		int
+    Dial			int
+    Idle			int
+    Bind			int
+}
+
+// Admission control, 0 for no limit. Sessions caps the concurrent
+// sessions, Clients the concurrent sessions of one source address and
+// Users the ones of one authenticated user. Rate is how many connections
+// are accepted per second, with bursts up to Burst (Rate by default).
+// A refused client is just disconnected, unless Reply sends it a SOCKS
+// failure reply first.
+type LimitConf struct {
+    Sessions		int
+    Clients		int
+    Users		int
+    Rate			int
+    Burst		int
+    Reply		bool
+}
+
+// Bandwidth shaping of the relayed traffic. Global is shared by all the
+// sessions, Users by the sessions of each user. Clients maps source CIDRs
+// to the rate of each address in them, the most specific CIDR wins. A
+// session is held to every rate that applies to it, ACL rules included.
+type ShapingConf struct {
+    Global		RateConf
+    Users		map[string]RateConf
+    Clients		map[string]RateConf
+}
+
+// Bytes per second, client -> target and target -> client. 0 is no limit.
+type RateConf struct {
+    Upload		int64
+    Download		int64
+}
+
+// Per user traffic accounting and quotas. The sessions' bytes are folded
+// into the counters every Interval seconds (60 by default) and when they
+// end. The counters are kept in the file at Path, saved after each fold
+// and on shutdown, without a path they are lost on restart. Daily and Monthly
+// cap the bytes a user may transfer, up and down together, over the
+// local calendar day and month; Users overrides them per user. 0 is no
+// quota. A user over quota gets its requests refused, Cut also ends its
+// live sessions.
+type QuotaConf struct {
+    Path			string
+    Interval		int
+    Daily		int64
+    Monthly		int64
+    Users		map[string]QuotaLimit
+    Cut			bool
+}
+
+type QuotaLimit struct {
+    Daily		int64
+    Monthly		int64
+}
+
+// UDP relay settings, fragment reassembly is off unless enabled.
+// Timeout is in seconds, Queue is the maximum bytes buffered for
+// one fragment sequence.
+type UdpConf struct {
+    Reassembly		bool
+    Timeout			int
+    Queue			int
+}
+
+/*----------------------------------------------------------
+    Timeouts
+-----------------------------------------------------------*/
+const (
+        DEFAULT_HANDSHAKE_TIMEOUT	= 30 * time.Second
+        DEFAULT_REQUEST_TIMEOUT		= 30 * time.Second
+        DEFAULT_DIAL_TIMEOUT		= 60 * time.Second
+        DEFAULT_IDLE_TIMEOUT		= time.Hour
+        DEFAULT_BIND_TIMEOUT		= 2 * time.Minute
+        DEFAULT_DRAIN_TIMEOUT		= 30 * time.Second
+)
+
+// 0 when there is no limit
+func (timeouts *TimeoutConf) HandshakeTimeout() (time.Duration) {
+    return timeout(timeouts.Handshake, DEFAULT_HANDSHAKE_TIMEOUT)
+}
+
+func (timeouts *TimeoutConf) RequestTimeout() (time.Duration) {
+    return timeout(timeouts.Request, DEFAULT_REQUEST_TIMEOUT)
+}
+
+func (timeouts *TimeoutConf) DialTimeout() (time.Duration) {
+    return timeout(timeouts.Dial, DEFAULT_DIAL_TIMEOUT)
+}
+
+func (timeouts *TimeoutConf) IdleTimeout() (time.Duration) {
+    return timeout(timeouts.Idle, DEFAULT_IDLE_TIMEOUT)
+}
+
+func (timeouts *TimeoutConf) BindTimeout() (time.Duration) {
+    return timeout(timeouts.Bind, DEFAULT_BIND_TIMEOUT)
+}
+
+// How long sessions in flight get to finish on shutdown
+func (server *ServerConf) DrainTimeout() (time.Duration) {
+    return timeout(server.Drain, DEFAULT_DRAIN_TIMEOUT)
+}
+
+func timeout(seconds int, fallback time.Duration) (time.Duration) {
+
+    if (seconds == 0) {
+        return fallback
+    }
+
+    if (seconds < 0) {
+        return 0
+    }
+
+    return time.Duration(seconds) * time.Second
+}
+
+// The listeners to open. Without a listeners section the server section
+// describes the only one.
+func (config *Config) ListenerConfs() ([]ListenerConf) {
+
+    if (len(config.Listeners) != 0) {
+        return config.Listeners
+    }
+
+    var transport string = config.Server.Protocol
+    if (len(transport) == 0) {
+        transport = "tcp"
+    }
+
+    return []ListenerConf{ ListenerConf{ Transport		: transport,
+                                         Address		: config.Server.Address,
+                                         Listen		: config.Server.Listen,
+                                         Methods		: config.Server.Methods,
+                                         Egress		: config.Server.Egress,
+                                         EchoDestination	: config.Server.EchoDestination } }
+}
+
+// The ACL profile called name, the acl section for an empty name and nil
+// when there is no such profile
+func (config *Config) AclProfile(name string) (*AclConf) {
+
+    if (len(name) == 0) {
+        return &config.Acl
+    }
+
+    return config.Acls[name]
+}
+
 func readConf(path string) (*Config) {
 
-    var err		error
-    var config 	Config = Config{}
-    
     // looking for 'socks5.conf' file
     if (len(path) == 0) {
         return nil
     }
-        
+
+    config, err := Load(path)
+    if (err != nil) {
+        log.Errorf("%s\n", err.Error())
+        return nil
+    }
+
+    return config
+}
+
+// Load reads and parses the conf file at path
+func Load(path string) (*Config, error) {
+
+    var config 	Config = Config{}
+
     // check if file exist
     fileinfo, err := os.Stat(path)
-        
+
     if (err != nil) {
-        log.Errorf("Stat conf file: %s\n", err.Error())    
-        return nil
+        return nil, errors.New("Stat conf file: " + err.Error())
     }
-        
+
     if (fileinfo.Mode().IsRegular() != true) {
-        log.Errorf("Conf file is not readable\n")    
-        return nil        
+        return nil, errors.New("Conf file is not readable")
     }
- 
+
     bytes, err := ioutil.ReadFile(path)
-    
+
     if (err != nil) {
-        log.Errorf("Reading conf file: %s\n", err.Error())
-        return nil
+        return nil, errors.New("Reading conf file: " + err.Error())
     }
-    
+
     if err = json.Unmarshal(bytes, &config); err != nil {
-        log.Errorf("Unmarshal conf file: %s\n", err.Error())
-        return nil
-    }       
-    
-    return &config
+        return nil, errors.New("Unmarshal conf file: " + err.Error())
+    }
+
+    // Remember where it comes from, for reloading
+    config.Path = path
+
+    return &config, nil
+}
+
+// Validate checks the settings the config package knows about, the
+// ACL, upstream and authentication sections are checked by their own
+// packages.
+func (config *Config) Validate() (error) {
+
+    if ((config.Server.Listen < 0) || (config.Server.Listen > 65535)) {
+        return errors.New("server.listen: port out of range: " + strconv.Itoa(config.Server.Listen))
+    }
+
+    for index, listener := range config.Listeners {
+        var prefix string = "listeners[" + strconv.Itoa(index) + "]: "
+        switch (listener.Transport) {
+            case "", "tcp", "tcp4", "tcp6", "tls":
+                if ((listener.Listen < 0) || (listener.Listen > 65535)) {
+                    return errors.New(prefix + "port out of range: " + strconv.Itoa(listener.Listen))
+                }
+                break
+            case "unix":
+                if (len(listener.Address) == 0) {
+                    return errors.New(prefix + "a unix listener needs a socket path")
+                }
+                break
+            default:
+                return errors.New(prefix + "unknown transport '" + listener.Transport + "'")
+        }
+        if ((listener.Transport == "tls") && ((len(listener.Certificate) == 0) || (len(listener.Key) == 0))) {
+            return errors.New(prefix + "a tls listener needs a certificate and a key")
+        }
+        switch (listener.MinVersion) {
+            case "", "1.0", "1.1", "1.2", "1.3":
+                break
+            default:
+                return errors.New(prefix + "unknown TLS version '" + listener.MinVersion + "'")
+        }
+        switch (listener.ClientAuth) {
+            case "", "require", "optional":
+                break
+            default:
+                return errors.New(prefix + "clientAuth must be 'require' or 'optional'")
+        }
+        switch (listener.Identity) {
+            case "", "cn", "subject":
+                break
+            default:
+                return errors.New(prefix + "identity must be 'cn' or 'subject'")
+        }
+        if ((len(listener.Identity) != 0) && (len(listener.ClientCa) == 0)) {
+            return errors.New(prefix + "identity needs a clientCa to verify the certificates")
+        }
+        if (config.AclProfile(listener.Acl) == nil) {
+            return errors.New(prefix + "unknown ACL profile '" + listener.Acl + "'")
+        }
+    }
+
+    if (config.Server.Drain < 0) {
+        return errors.New("server.drain: must not be negative")
+    }
+
+    if ((config.Log.Level < 0) || (config.Log.Level > 5)) {
+        return errors.New("log.level: must be between 0 and 5")
+    }
+
+    if ((config.Udp.Timeout < 0) || (config.Udp.Queue < 0)) {
+        return errors.New("udp: timeout and queue must not be negative")
+    }
+
+    if ((config.Limits.Sessions < 0) || (config.Limits.Clients < 0) || (config.Limits.Users < 0) || (config.Limits.Rate < 0) || (config.Limits.Burst < 0)) {
+        return errors.New("limits: must not be negative")
+    }
+
+    if ((config.Quota.Interval < 0) || (config.Quota.Daily < 0) || (config.Quota.Monthly < 0)) {
+        return errors.New("quota: interval, daily and monthly must not be negative")
+    }
+
+    for user, limit := range config.Quota.Users {
+        if ((limit.Daily < 0) || (limit.Monthly < 0)) {
+            return errors.New("quota.users." + user + ": daily and monthly must not be negative")
+        }
+    }
+
+    switch (config.Outbound.Prefer) {
+        case "", "ipv4", "ipv6":
+            break
+        default:
+            return errors.New("outbound.prefer: must be 'ipv4' or 'ipv6'")
+    }
+
+    if ((config.Outbound.AttemptDelay < 0) || (config.Outbound.Timeout < 0)) {
+        return errors.New("outbound: attemptDelay and timeout must not be negative")
+    }
+
+    switch (config.Gssapi.Protection) {
+        case "", "integrity", "confidentiality":
+            break
+        default:
+            return errors.New("gssapi.protection: unknown level '" + config.Gssapi.Protection + "'")
+    }
+
+    return nil
 }
 
 // Initialization always returns a Config
@@ -115,7 +579,7 @@ func Initialize (path string) (*Config) {
     if config == nil {
         // No there is no conf file
         // set it to default value
-        config = &Config { Daemon: false, Server: ServerConf{Protocol: "tcp", Address: "", Listen: 1080}, Auth: AuthConf{Username: "", Password: ""}, Log: LogConf{Level: 1, Path: "~/tmp"}}
+        config = &Config { Daemon: false, Server: ServerConf{Protocol: "tcp", Address: "", Listen: 1080, Drain: 30}, Auth: AuthConf{Username: "", Password: ""}, Log: LogConf{Level: 1, Path: "~/tmp"}, Udp: UdpConf{Reassembly: false, Timeout: 5, Queue: 65535}}
     }
     
     // Done
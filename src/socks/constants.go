@@ -79,3 +79,29 @@ const (
     SOCKS_V5_STATUS_ADDR_UNSUPPORTED		= byte(0x08)
     SOCKS_V5_STATUS_UNASSIGNED			= byte(0xff)
 )
+
+/* SOCKS 4
+   The SOCKS server sends a reply packet:
+
+                +----+----+----+----+----+----+----+----+
+                | VN | CD | DSTPORT |      DSTIP        |
+                +----+----+----+----+----+----+----+----+
+   # of bytes:     1    1      2              4
+
+   VN is the version of the reply code and should be 0. CD is the result
+   code with one of the following values:
+
+        90: request granted
+        91: request rejected or failed
+        92: request rejected becasue SOCKS server cannot connect to
+            identd on the client
+        93: request rejected because the client program and identd
+            report different user-ids
+*/
+const (
+    SOCKS_V4_REPLY_VERSION			= byte(0x00)
+    SOCKS_V4_STATUS_GRANTED			= byte(0x5A)
+    SOCKS_V4_STATUS_REJECTED			= byte(0x5B)
+    SOCKS_V4_STATUS_IDENTD_UNREACHABLE	= byte(0x5C)
+    SOCKS_V4_STATUS_IDENTD_MISMATCH	= byte(0x5D)
+)
@@ -11,8 +11,10 @@ import (
     "bufio"
     "errors"
     "net"
+    "time"
     "socks"
     "socks/log"
+    "socks/access"
     "socks/config"
 )
 
@@ -22,9 +24,16 @@ type Context struct {
     reader		*bufio.Reader
     writer		*bufio.Writer
     config		*config.Config
+    listener		*config.ListenerConf
+    username		string
+    method		byte
+    rule			*config.AclRule
+    record		*access.Record
+    encapsulated	bool
 }
 
-func New(conn net.Conn, config *config.Config) (*Context, error) {
+// listener is the settings of the listener conn was accepted on
+func New(conn net.Conn, config *config.Config, listener *config.ListenerConf) (*Context, error) {
     
     var reader *bufio.Reader = bufio.NewReader(conn)
     var writer *bufio.Writer = bufio.NewWriter(conn)
@@ -54,7 +63,9 @@ func New(conn net.Conn, config *config.Config) (*Context, error) {
                         connection 	: conn,
                         reader		: reader,
                         writer		: writer,
-                        config		: config }, nil
+                        config		: config,
+                        listener		: listener,
+                        record		: access.NewRecord() }, nil
 }
 
 func (context *Context)Connection() (*net.Conn) {
@@ -73,10 +84,76 @@ func (context *Context) Writer() (*bufio.Writer) {
     return context.writer
 }
 
+// Replace the client connection, used when the negotiated method
+// encapsulates all the following traffic
+func (context *Context) Encapsulate(conn net.Conn) {
+    context.connection	= conn
+    context.reader		= bufio.NewReader(conn)
+    context.writer		= bufio.NewWriter(conn)
+    context.encapsulated	= true
+}
+
+// Whether the negotiated method encapsulates the traffic
+func (context *Context) Encapsulated() (bool) {
+    return context.encapsulated
+}
+
+// Bound the following reads and writes on the client connection, 0
+// removes the bound
+func (context *Context) SetTimeout(timeout time.Duration) {
+
+    if (timeout == 0) {
+        context.connection.SetDeadline(time.Time{})
+        return
+    }
+
+    context.connection.SetDeadline(time.Now().Add(timeout))
+}
+
 func (context *Context) LocalAddr() (string) {
     return context.connection.LocalAddr().String()
 }
 
 func (context *Context) Config() (*config.Config) {
     return context.config
-}
\ No newline at end of file
+}
+
+func (context *Context) Listener() (*config.ListenerConf) {
+    return context.listener
+}
+
+// The negotiated authentication method
+func (context *Context) Method() (byte) {
+    return context.method
+}
+
+func (context *Context) SetMethod(method byte) {
+    context.method = method
+}
+
+// The authenticated username, empty when no authentication took place
+func (context *Context) Username() (string) {
+    return context.username
+}
+
+func (context *Context) SetUsername(username string) {
+    context.username = username
+}
+
+// The ACL rule that allowed the request, nil when none matched
+func (context *Context) Rule() (*config.AclRule) {
+    return context.rule
+}
+
+func (context *Context) SetRule(rule *config.AclRule) {
+    context.rule = rule
+}
+
+// The access log record of the session
+func (context *Context) Record() (*access.Record) {
+    return context.record
+}
+
+func (context *Context) SetRecord(record *access.Record) {
+    context.record = record
+}
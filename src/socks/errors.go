@@ -0,0 +1,23 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package socks
+
+import (
+    "errors"
+)
+
+// Request errors with a dedicated reply code
+var (
+    ERR_COMMAND_UNSUPPORTED	= errors.New("Not supported command")
+    ERR_ADDRESS_UNSUPPORTED	= errors.New("No supported address")
+)
+
+// Errors carrying the reply code to send back to the client
+type Replier interface {
+    ReplyCode () (byte)
+}
@@ -9,6 +9,7 @@ package handshake
 
 import (
     "bufio"
+    "bytes"
     "errors"
     "socks"
     "socks/log"
@@ -129,10 +130,15 @@ func (handshake *HandshakeV5)methodNegotiation() (error) {
         return errors.New("No acceptable method")
     }
     
-    // Find out if we support the methods.
+    // Pick the first enabled method, in server preferred order,
+    // the client offers.
     var found byte = socks.SOCKS_AUTH_NOACCEPTABLE
     
-    for _, method := range handshake.methods {
+    for _, method := range authentication.Methods(handshake.context.Config(), handshake.context.Listener()) {
+        
+        if (bytes.IndexByte(handshake.methods, method) < 0) {
+            continue
+        }
         
         var authenticator authentication.Authenticator
         
@@ -146,6 +152,9 @@ func (handshake *HandshakeV5)methodNegotiation() (error) {
         }
     }
     
+    handshake.context.SetMethod(found)
+    handshake.context.Record().Method = authentication.MethodName(found)
+    
     err = nil
     if (found == socks.SOCKS_AUTH_NOACCEPTABLE) {
         err = errors.New("No acceptbale method")
@@ -165,7 +174,19 @@ func (handshake *HandshakeV5)authentication () (bool, error) {
 /*----------------------------------------------------------
     HandshakeV4 Implementation
 -----------------------------------------------------------*/
+// Socks V4 has no method negotiation, the USERID is carried in
+// the request itself. It can't authenticate either, so it is only
+// served where the noauth method is enabled.
 func (handshake *HandshakeV4)Handshake() (error) {
+    
+    methods := authentication.Methods(handshake.context.Config(), handshake.context.Listener())
+    if (bytes.IndexByte(methods, socks.SOCKS_AUTH_NOAUTHENTICATION) < 0) {
+        return errors.New("Socks V4 needs the noauth method")
+    }
+    
+    handshake.context.SetMethod(socks.SOCKS_AUTH_NOAUTHENTICATION)
+    handshake.context.Record().Method = authentication.MethodName(socks.SOCKS_AUTH_NOAUTHENTICATION)
+    
     return nil
 }
 
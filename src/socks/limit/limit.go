@@ -0,0 +1,205 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package limit
+
+import (
+        "sync"
+        "sync/atomic"
+        "time"
+        "socks"
+        "socks/config"
+)
+
+// Why a connection or a session was refused
+const (
+        REFUSED_RATE		= "rate"
+        REFUSED_SESSIONS	= "sessions"
+        REFUSED_CLIENT	= "client"
+        REFUSED_USER		= "user"
+)
+
+// The connection or session went over Limit
+type RefusedError struct {
+    Limit			string
+}
+
+// The admission state of the process, the counts outlive config reloads,
+// the limits are the ones of the config passed in
+type admission struct {
+    mutex		sync.Mutex
+    sessions		int
+    clients		map[string]int
+    users		map[string]int
+    tokens		float64
+    refilled		time.Time
+}
+
+var state *admission = &admission{ clients : make(map[string]int), users : make(map[string]int) }
+
+// Refused counters: by the accept rate, the session count, the client
+// count and the user count
+var refusedRate		uint64
+var refusedSessions	uint64
+var refusedClient	uint64
+var refusedUser		uint64
+
+/*----------------------------------------------------------
+    Admission control
+-----------------------------------------------------------*/
+
+// Accept takes a token of the accept rate, false when there is none left
+func Accept(conf *config.LimitConf) (bool) {
+
+    if (conf.Rate <= 0) {
+        return true
+    }
+
+    state.mutex.Lock()
+    defer state.mutex.Unlock()
+
+    var burst float64 = float64(conf.Burst)
+    if (burst <= 0) {
+        burst = float64(conf.Rate)
+    }
+
+    var now time.Time = time.Now()
+    if (state.refilled.IsZero()) {
+        state.tokens = burst
+    } else {
+        state.tokens += now.Sub(state.refilled).Seconds() * float64(conf.Rate)
+    }
+    if (state.tokens > burst) {
+        state.tokens = burst
+    }
+    state.refilled = now
+
+    if (state.tokens < 1) {
+        atomic.AddUint64(&refusedRate, 1)
+        return false
+    }
+
+    state.tokens--
+
+    return true
+}
+
+// Admit counts a new session from client, an empty client is not
+// counted on its own. Every admitted session is released with Release.
+func Admit(conf *config.LimitConf, client string) (error) {
+
+    state.mutex.Lock()
+    defer state.mutex.Unlock()
+
+    if ((conf.Sessions > 0) && (state.sessions >= conf.Sessions)) {
+        atomic.AddUint64(&refusedSessions, 1)
+        return &RefusedError{ Limit : REFUSED_SESSIONS }
+    }
+
+    if ((len(client) != 0) && (conf.Clients > 0) && (state.clients[client] >= conf.Clients)) {
+        atomic.AddUint64(&refusedClient, 1)
+        return &RefusedError{ Limit : REFUSED_CLIENT }
+    }
+
+    state.sessions++
+    if (len(client) != 0) {
+        state.clients[client]++
+    }
+
+    return nil
+}
+
+func Release(client string) {
+
+    state.mutex.Lock()
+    defer state.mutex.Unlock()
+
+    state.sessions--
+    release(state.clients, client)
+}
+
+// AdmitUser counts a session of an authenticated user, an empty
+// username is not counted. Released with ReleaseUser.
+func AdmitUser(conf *config.LimitConf, user string) (error) {
+
+    if (len(user) == 0) {
+        return nil
+    }
+
+    state.mutex.Lock()
+    defer state.mutex.Unlock()
+
+    if ((conf.Users > 0) && (state.users[user] >= conf.Users)) {
+        atomic.AddUint64(&refusedUser, 1)
+        return &RefusedError{ Limit : REFUSED_USER }
+    }
+
+    state.users[user]++
+
+    return nil
+}
+
+func ReleaseUser(user string) {
+
+    state.mutex.Lock()
+    defer state.mutex.Unlock()
+
+    release(state.users, user)
+}
+
+// Returns the refused connection counters: by the accept rate, the
+// session limit, the per client limit and the per user limit
+func Stats() (uint64, uint64, uint64, uint64) {
+    return atomic.LoadUint64(&refusedRate), atomic.LoadUint64(&refusedSessions), atomic.LoadUint64(&refusedClient), atomic.LoadUint64(&refusedUser)
+}
+
+/*----------------------------------------------------------
+    RefusedError Implementation
+-----------------------------------------------------------*/
+func (err *RefusedError) Error() (string) {
+
+    switch (err.Limit) {
+        case REFUSED_RATE:
+            return "Connection rate limit reached"
+        case REFUSED_CLIENT:
+            return "Too many sessions from this client"
+        case REFUSED_USER:
+            return "Too many sessions of this user"
+    }
+
+    return "Too many sessions"
+}
+
+// The server isn't failing when a user is over its share of sessions,
+// the user is not allowed more
+func (err *RefusedError) ReplyCode() (byte) {
+
+    if (err.Limit == REFUSED_USER) {
+        return socks.SOCKS_V5_STATUS_NOT_ALLOWED
+    }
+
+    return socks.SOCKS_V5_STATUS_SERVER_FAILURE
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+
+// Drop one count of key, the entry goes with the last one
+func release(counts map[string]int, key string) {
+
+    if (len(key) == 0) {
+        return
+    }
+
+    if (counts[key] <= 1) {
+        delete(counts, key)
+        return
+    }
+
+    counts[key]--
+}
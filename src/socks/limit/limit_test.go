@@ -0,0 +1,165 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package limit
+
+import (
+        "testing"
+        "time"
+        "socks"
+        "socks/config"
+)
+
+func TestAdmit(t *testing.T) {
+
+    var conf *config.LimitConf = &config.LimitConf{ Sessions : 3, Clients : 2 }
+
+    var cases = []struct {
+        client		string
+        refused		string
+    }{
+        { "10.0.0.1", "" },
+        { "10.0.0.1", "" },
+        { "10.0.0.1", REFUSED_CLIENT },
+        // Unix socket clients only count towards the total
+        { "", "" },
+        { "10.0.0.2", REFUSED_SESSIONS },
+    }
+
+    resetState()
+
+    for index, test := range cases {
+        if err := Admit(conf, test.client); refusedBy(err) != test.refused {
+            t.Fatalf("session %d from '%s': %v, want refused by '%s'", index, test.client, err, test.refused)
+        }
+    }
+
+    // A released session makes room again
+    Release("10.0.0.1")
+    if err := Admit(conf, "10.0.0.1"); err != nil {
+        t.Fatalf("after release: %v", err)
+    }
+
+    if _, sessions, clients, _ := Stats(); (sessions != 1) || (clients != 1) {
+        t.Fatalf("refused: %d over the sessions, %d over the client", sessions, clients)
+    }
+}
+
+func TestAdmitUser(t *testing.T) {
+
+    var conf *config.LimitConf = &config.LimitConf{ Users : 1 }
+
+    resetState()
+
+    if err := AdmitUser(conf, "alice"); err != nil {
+        t.Fatalf("first session: %v", err)
+    }
+    if err := AdmitUser(conf, "alice"); refusedBy(err) != REFUSED_USER {
+        t.Fatalf("second session: %v", err)
+    }
+    if err := AdmitUser(conf, "bob"); err != nil {
+        t.Fatalf("another user: %v", err)
+    }
+
+    // No username, nothing to count
+    for count := 0; count < 3; count++ {
+        if err := AdmitUser(conf, ""); err != nil {
+            t.Fatalf("anonymous session: %v", err)
+        }
+    }
+
+    ReleaseUser("alice")
+    if err := AdmitUser(conf, "alice"); err != nil {
+        t.Fatalf("after release: %v", err)
+    }
+
+    if (len(state.users) != 2) {
+        t.Fatalf("users counted: %v", state.users)
+    }
+}
+
+func TestAccept(t *testing.T) {
+
+    var cases = []struct {
+        name			string
+        conf			config.LimitConf
+        accepted		int
+    }{
+        { "no rate", config.LimitConf{}, 10 },
+        { "burst of the rate", config.LimitConf{ Rate : 3 }, 3 },
+        { "burst", config.LimitConf{ Rate : 1, Burst : 5 }, 5 },
+    }
+
+    for _, test := range cases {
+
+        resetState()
+
+        var accepted int
+        for count := 0; count < 10; count++ {
+            if (Accept(&test.conf)) {
+                accepted++
+            }
+        }
+
+        if (accepted != test.accepted) {
+            t.Errorf("%s: accepted %d, want %d", test.name, accepted, test.accepted)
+        }
+    }
+
+    // The bucket refills at the rate
+    resetState()
+    var conf *config.LimitConf = &config.LimitConf{ Rate : 100, Burst : 1 }
+    Accept(conf)
+    if (Accept(conf)) {
+        t.Fatalf("accepted over the burst")
+    }
+    time.Sleep(20 * time.Millisecond)
+    if (!Accept(conf)) {
+        t.Fatalf("not refilled")
+    }
+}
+
+func TestReplyCode(t *testing.T) {
+
+    var cases = []struct {
+        limit		string
+        code			byte
+    }{
+        { REFUSED_RATE, socks.SOCKS_V5_STATUS_SERVER_FAILURE },
+        { REFUSED_SESSIONS, socks.SOCKS_V5_STATUS_SERVER_FAILURE },
+        { REFUSED_CLIENT, socks.SOCKS_V5_STATUS_SERVER_FAILURE },
+        { REFUSED_USER, socks.SOCKS_V5_STATUS_NOT_ALLOWED },
+    }
+
+    for _, test := range cases {
+        if code := (&RefusedError{ Limit : test.limit }).ReplyCode(); code != test.code {
+            t.Errorf("%s: reply %d, want %d", test.limit, code, test.code)
+        }
+    }
+}
+
+/*----------------------------------------------------------
+    Helpers
+-----------------------------------------------------------*/
+
+// Start from no session and no refusal
+func resetState() {
+
+    state = &admission{ clients : make(map[string]int), users : make(map[string]int) }
+
+    refusedRate, refusedSessions, refusedClient, refusedUser = 0, 0, 0, 0
+}
+
+// The limit err refused by, empty for none
+func refusedBy(err error) (string) {
+
+    if refused, ok := err.(*RefusedError); ok {
+        return refused.Limit
+    }
+
+    return ""
+}
@@ -0,0 +1,479 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package quota
+
+import (
+        "encoding/json"
+        "errors"
+        "io"
+        "io/ioutil"
+        "net"
+        "os"
+        "sync"
+        "sync/atomic"
+        "time"
+        "socks"
+        "socks/log"
+        "socks/config"
+        "socks/context"
+)
+
+// How often the counters are saved when the config doesn't tell
+const QUOTA_SAVE_INTERVAL = 60 * time.Second
+
+// The quota periods
+const (
+        PERIOD_DAILY		= "daily"
+        PERIOD_MONTHLY	= "monthly"
+)
+
+// User is over the quota of Period
+type QuotaError struct {
+    User			string
+    Period		string
+}
+
+// The byte counters of one user: since the account was created, over
+// the current Day and over the current Month
+type Account struct {
+    Up			int64
+    Down			int64
+    Day			string
+    DayUp		int64
+    DayDown		int64
+    Month		string
+    MonthUp		int64
+    MonthDown	int64
+}
+
+// The accounting of one session, given back with Close. A session of no
+// user counts nothing. up and down are the bytes not folded into the
+// account yet.
+type Session struct {
+    user			string
+    conf			*config.QuotaConf
+    conn			net.Conn
+    usage		*usage
+    up			int64
+    down			int64
+    cut			int32
+    Upload		Counter
+    Download		Counter
+}
+
+// The bytes of a user over the current day and month, the ones folded
+// into the account and the ones its sessions hold yet. The sessions add
+// to it and check it without the store's lock.
+type usage struct {
+    day			int64
+    month		int64
+}
+
+// Counts one direction of a session
+type Counter struct {
+    session		*Session
+    upload		bool
+}
+
+// The accounts of the process, they outlive config reloads
+type store struct {
+    mutex		sync.Mutex
+    path			string
+    accounts		map[string]*Account
+    sessions		map[string]map[*Session]bool
+    usages		map[string]*usage
+    dirty		bool
+    done			chan bool
+    waiter		sync.WaitGroup
+}
+
+var state *store = &store{ accounts : make(map[string]*Account), sessions : make(map[string]map[*Session]bool), usages : make(map[string]*usage) }
+
+/*----------------------------------------------------------
+    The accounts file
+-----------------------------------------------------------*/
+
+// Start loads the counters saved at conf.Path, and saves them from then
+// on. A missing file starts the accounts afresh, an unreadable one is an
+// error so that the counters are not overwritten. Without a path the
+// sessions' bytes are still folded into the accounts every interval.
+func Start(conf *config.QuotaConf) (error) {
+
+    var accounts map[string]*Account = make(map[string]*Account)
+
+    if (len(conf.Path) != 0) {
+        bytes, err := ioutil.ReadFile(conf.Path)
+        if (err == nil) {
+            if err = json.Unmarshal(bytes, &accounts); err != nil {
+                return errors.New("Unmarshal quota file: " + err.Error())
+            }
+        } else if (!os.IsNotExist(err)) {
+            return errors.New("Reading quota file: " + err.Error())
+        }
+    }
+
+    var interval time.Duration = QUOTA_SAVE_INTERVAL
+    if (conf.Interval > 0) {
+        interval = time.Duration(conf.Interval) * time.Second
+    }
+
+    var done chan bool = make(chan bool)
+
+    state.mutex.Lock()
+    state.path = conf.Path
+    state.accounts = accounts
+    state.dirty = false
+    state.done = done
+    state.mutex.Unlock()
+
+    state.waiter.Add(1)
+    go state.saver(interval, done)
+
+    return nil
+}
+
+// Stop saves the counters a last time
+func Stop() {
+
+    state.mutex.Lock()
+    var done chan bool = state.done
+    state.done = nil
+    state.mutex.Unlock()
+
+    if (done == nil) {
+        return
+    }
+
+    close(done)
+    state.waiter.Wait()
+
+    state.mutex.Lock()
+    state.foldAll()
+    state.mutex.Unlock()
+
+    if err := state.save(); err != nil {
+        log.Errorf("Saving the quota file failed: %s\n", err.Error())
+    }
+}
+
+/*----------------------------------------------------------
+    Quotas
+-----------------------------------------------------------*/
+
+// Check refuses a request of a user over quota
+func Check(conf *config.QuotaConf, user string) (error) {
+
+    if ((len(user) == 0) || !accounting(conf)) {
+        return nil
+    }
+
+    state.mutex.Lock()
+    defer state.mutex.Unlock()
+
+    var account *Account = state.account(user)
+    var day int64 = account.DayUp + account.DayDown
+    var month int64 = account.MonthUp + account.MonthDown
+
+    // With sessions running, the bytes they hold count too
+    if usage := state.usages[user]; usage != nil {
+        day, month = atomic.LoadInt64(&usage.day), atomic.LoadInt64(&usage.month)
+    }
+
+    if period := over(conf, user, day, month); len(period) != 0 {
+        return &QuotaError{ User : user, Period : period }
+    }
+
+    return nil
+}
+
+// Open starts counting the traffic of a session
+func Open(contxt *context.Context) (*Session) {
+
+    var session *Session = &Session{ user : contxt.Username(), conf : &contxt.Config().Quota, conn : *contxt.Connection() }
+
+    session.Upload = Counter{ session : session, upload : true }
+    session.Download = Counter{ session : session }
+
+    if ((len(session.user) == 0) || !accounting(session.conf)) {
+        session.user = ""
+        return session
+    }
+
+    state.mutex.Lock()
+    defer state.mutex.Unlock()
+
+    // The first session of the user starts from the account
+    if (state.usages[session.user] == nil) {
+        account := state.account(session.user)
+        state.usages[session.user] = &usage{ day : account.DayUp + account.DayDown, month : account.MonthUp + account.MonthDown }
+        state.sessions[session.user] = make(map[*Session]bool)
+    }
+
+    session.usage = state.usages[session.user]
+    state.sessions[session.user][session] = true
+
+    return session
+}
+
+/*----------------------------------------------------------
+    Session Implementation
+-----------------------------------------------------------*/
+
+// Close folds the bytes of the session into the account
+func (session *Session) Close() {
+
+    if (len(session.user) == 0) {
+        return
+    }
+
+    state.mutex.Lock()
+    defer state.mutex.Unlock()
+
+    state.fold(session)
+
+    delete(state.sessions[session.user], session)
+    if (len(state.sessions[session.user]) == 0) {
+        delete(state.sessions, session.user)
+        delete(state.usages, session.user)
+    }
+}
+
+/*----------------------------------------------------------
+    Counter Implementation
+-----------------------------------------------------------*/
+
+// Add counts bytes of the direction. The session holds them until they
+// are folded into the account, the store's lock is only taken to cut
+// the sessions of a user going over quota when the config says so.
+func (counter Counter) Add(count int) {
+
+    var session *Session = counter.session
+
+    if ((session == nil) || (len(session.user) == 0) || (count <= 0)) {
+        return
+    }
+
+    if (counter.upload) {
+        atomic.AddInt64(&session.up, int64(count))
+    } else {
+        atomic.AddInt64(&session.down, int64(count))
+    }
+
+    var day int64 = atomic.AddInt64(&session.usage.day, int64(count))
+    var month int64 = atomic.AddInt64(&session.usage.month, int64(count))
+
+    if ((!session.conf.Cut) || (atomic.LoadInt32(&session.cut) != 0)) {
+        return
+    }
+
+    period := over(session.conf, session.user, day, month)
+    if (len(period) == 0) {
+        return
+    }
+
+    state.mutex.Lock()
+    defer state.mutex.Unlock()
+
+    for live := range state.sessions[session.user] {
+        if (atomic.CompareAndSwapInt32(&live.cut, 0, 1)) {
+            live.conn.Close()
+            log.Warnf("User '%s' is over the %s quota, session %s cut\n", session.user, period, live.conn.RemoteAddr().String())
+        }
+    }
+}
+
+// Reader returns src counting what is read into the direction, src
+// itself when nothing is counted so that the copy can still be done by
+// the kernel
+func (counter Counter) Reader(src io.Reader) (io.Reader) {
+
+    if ((counter.session == nil) || (len(counter.session.user) == 0)) {
+        return src
+    }
+
+    return &reader{ src : src, counter : counter }
+}
+
+type reader struct {
+    src			io.Reader
+    counter		Counter
+}
+
+func (reader *reader) Read(data []byte) (int, error) {
+
+    count, err := reader.src.Read(data)
+    reader.counter.Add(count)
+
+    return count, err
+}
+
+/*----------------------------------------------------------
+    QuotaError Implementation
+-----------------------------------------------------------*/
+func (err *QuotaError) Error() (string) {
+    return "User '" + err.User + "' is over the " + err.Period + " quota"
+}
+
+func (err *QuotaError) ReplyCode() (byte) {
+    return socks.SOCKS_V5_STATUS_NOT_ALLOWED
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+
+// Traffic is counted when it is saved or capped
+func accounting(conf *config.QuotaConf) (bool) {
+    return (len(conf.Path) != 0) || (conf.Daily != 0) || (conf.Monthly != 0) || (len(conf.Users) != 0)
+}
+
+// The period user is over quota for with day and month bytes, empty when
+// it isn't
+func over(conf *config.QuotaConf, user string, day int64, month int64) (string) {
+
+    var limit config.QuotaLimit = config.QuotaLimit{ Daily : conf.Daily, Monthly : conf.Monthly }
+    if custom, found := conf.Users[user]; found {
+        limit = custom
+    }
+
+    if ((limit.Daily > 0) && (day >= limit.Daily)) {
+        return PERIOD_DAILY
+    }
+
+    if ((limit.Monthly > 0) && (month >= limit.Monthly)) {
+        return PERIOD_MONTHLY
+    }
+
+    return ""
+}
+
+// The account of user, its day and month counters start over with a new
+// period, and so does the usage of its sessions. The store's lock is
+// held.
+func (store *store) account(user string) (*Account) {
+
+    account := store.accounts[user]
+    if (account == nil) {
+        account = &Account{}
+        store.accounts[user] = account
+    }
+
+    var now time.Time = time.Now()
+    var usage *usage = store.usages[user]
+
+    if day := now.Format("2006-01-02"); account.Day != day {
+        if (usage != nil) {
+            atomic.AddInt64(&usage.day, -(account.DayUp + account.DayDown))
+        }
+        account.Day, account.DayUp, account.DayDown = day, 0, 0
+        store.dirty = true
+    }
+
+    if month := now.Format("2006-01"); account.Month != month {
+        if (usage != nil) {
+            atomic.AddInt64(&usage.month, -(account.MonthUp + account.MonthDown))
+        }
+        account.Month, account.MonthUp, account.MonthDown = month, 0, 0
+        store.dirty = true
+    }
+
+    return account
+}
+
+// Move the bytes session holds into the account of its user. The
+// store's lock is held.
+func (store *store) fold(session *Session) {
+
+    var up int64 = atomic.SwapInt64(&session.up, 0)
+    var down int64 = atomic.SwapInt64(&session.down, 0)
+
+    // The new period starts before the bytes are added
+    account := store.account(session.user)
+
+    if ((up == 0) && (down == 0)) {
+        return
+    }
+
+    account.Up += up
+    account.DayUp += up
+    account.MonthUp += up
+    account.Down += down
+    account.DayDown += down
+    account.MonthDown += down
+
+    store.dirty = true
+}
+
+// Fold the bytes of every session. The store's lock is held.
+func (store *store) foldAll() {
+
+    for _, sessions := range store.sessions {
+        for session := range sessions {
+            store.fold(session)
+        }
+    }
+}
+
+// Fold and save every interval until done is closed
+func (store *store) saver(interval time.Duration, done chan bool) {
+
+    defer store.waiter.Done()
+
+    var ticker *time.Ticker = time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        select {
+            case <-done:
+                return
+            case <-ticker.C:
+                store.mutex.Lock()
+                store.foldAll()
+                store.mutex.Unlock()
+                if err := store.save(); err != nil {
+                    log.Errorf("Saving the quota file failed: %s\n", err.Error())
+                }
+                break
+        }
+    }
+}
+
+// Write the counters when they changed. The file is replaced at once so
+// that a crash leaves the previous one.
+func (store *store) save() (error) {
+
+    store.mutex.Lock()
+    if ((!store.dirty) || (len(store.path) == 0)) {
+        store.mutex.Unlock()
+        return nil
+    }
+    bytes, err := json.MarshalIndent(store.accounts, "", "\t")
+    var path string = store.path
+    store.dirty = false
+    store.mutex.Unlock()
+
+    if (err != nil) {
+        return err
+    }
+
+    var temporary string = path + ".tmp"
+
+    err = ioutil.WriteFile(temporary, bytes, 0600)
+    if (err == nil) {
+        err = os.Rename(temporary, path)
+    }
+
+    // Try again next time
+    if (err != nil) {
+        store.mutex.Lock()
+        store.dirty = true
+        store.mutex.Unlock()
+    }
+
+    return err
+}
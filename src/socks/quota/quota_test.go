@@ -0,0 +1,253 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package quota
+
+import (
+        "encoding/json"
+        "io/ioutil"
+        "net"
+        "os"
+        "path/filepath"
+        "testing"
+        "time"
+        "socks"
+        "socks/config"
+        "socks/context"
+)
+
+// The counters survive a stop and a start from the same file
+func TestSaveReload(t *testing.T) {
+
+    var conf *config.QuotaConf = &config.QuotaConf{ Path : filepath.Join(t.TempDir(), "quota.json") }
+
+    startQuota(t, conf)
+    session, _ := openSession(t, conf, "alice")
+    session.Upload.Add(100)
+    session.Download.Add(50)
+    session.Close()
+    Stop()
+
+    var account *Account = savedAccount(t, conf.Path, "alice")
+    if ((account.Up != 100) || (account.Down != 50) || (account.DayUp != 100) || (account.MonthDown != 50)) {
+        t.Fatalf("saved account: %+v", account)
+    }
+
+    // Loaded again, the new bytes add to the saved ones
+    startQuota(t, conf)
+    session, _ = openSession(t, conf, "alice")
+    session.Upload.Add(10)
+    session.Close()
+    Stop()
+
+    account = savedAccount(t, conf.Path, "alice")
+    if ((account.Up != 110) || (account.Down != 50) || (account.DayUp != 110)) {
+        t.Fatalf("account after reload: %+v", account)
+    }
+}
+
+// Stop counts the bytes of the sessions still open
+func TestStopFoldsOpenSessions(t *testing.T) {
+
+    var conf *config.QuotaConf = &config.QuotaConf{ Path : filepath.Join(t.TempDir(), "quota.json") }
+
+    startQuota(t, conf)
+    session, _ := openSession(t, conf, "bob")
+    session.Download.Add(70)
+    Stop()
+    session.Close()
+
+    if account := savedAccount(t, conf.Path, "bob"); account.Down != 70 {
+        t.Fatalf("saved account: %+v", account)
+    }
+}
+
+// The account of a past day and month starts over
+func TestNewPeriod(t *testing.T) {
+
+    var path string = filepath.Join(t.TempDir(), "quota.json")
+    var saved map[string]*Account = map[string]*Account{
+        "carol" : { Up : 1000, Down : 1000, Day : "2001-01-01", DayUp : 500, DayDown : 500, Month : "2001-01", MonthUp : 900, MonthDown : 900 },
+    }
+    bytes, _ := json.Marshal(saved)
+    ioutil.WriteFile(path, bytes, 0600)
+
+    var conf *config.QuotaConf = &config.QuotaConf{ Path : path, Daily : 100 }
+
+    startQuota(t, conf)
+    defer Stop()
+
+    if err := Check(conf, "carol"); err != nil {
+        t.Fatalf("over quota from a past day: %v", err)
+    }
+}
+
+func TestCheck(t *testing.T) {
+
+    var conf *config.QuotaConf = &config.QuotaConf{ Daily : 1000, Monthly : 5000, Users : map[string]config.QuotaLimit{
+        "heavy" : { Daily : 0, Monthly : 0 },
+        "light" : { Daily : 10 },
+    } }
+
+    var cases = []struct {
+        user			string
+        bytes		int
+        period		string
+    }{
+        { "", 1000000, "" },
+        { "under", 999, "" },
+        { "daily", 1000, PERIOD_DAILY },
+        { "heavy", 1000000, "" },
+        { "light", 10, PERIOD_DAILY },
+    }
+
+    startQuota(t, conf)
+    defer Stop()
+
+    for _, test := range cases {
+
+        session, _ := openSession(t, conf, test.user)
+        session.Upload.Add(test.bytes)
+
+        // Checked with the session open, and once its bytes are folded
+        for _, open := range []bool{ true, false } {
+            if (!open) {
+                session.Close()
+            }
+            err := Check(conf, test.user)
+            if ((len(test.period) == 0) != (err == nil)) {
+                t.Fatalf("%s: %v, want over %q", test.user, err, test.period)
+            }
+            if quotaErr, ok := err.(*QuotaError); ok && ((quotaErr.Period != test.period) || (quotaErr.ReplyCode() != socks.SOCKS_V5_STATUS_NOT_ALLOWED)) {
+                t.Fatalf("%s: %v", test.user, err)
+            }
+        }
+    }
+
+    // The monthly quota, over several days' worth
+    var monthly *config.QuotaConf = &config.QuotaConf{ Daily : 0, Monthly : 5000 }
+    session, _ := openSession(t, monthly, "monthly")
+    session.Download.Add(5000)
+    session.Close()
+    if err, ok := Check(monthly, "monthly").(*QuotaError); !ok || (err.Period != PERIOD_MONTHLY) {
+        t.Fatalf("monthly: %v", err)
+    }
+}
+
+// With Cut, going over quota closes every session of the user
+func TestCut(t *testing.T) {
+
+    var conf *config.QuotaConf = &config.QuotaConf{ Daily : 100, Cut : true }
+
+    startQuota(t, conf)
+    defer Stop()
+
+    first, firstClient := openSession(t, conf, "dave")
+    second, secondClient := openSession(t, conf, "dave")
+    other, otherClient := openSession(t, conf, "erin")
+    defer first.Close()
+    defer second.Close()
+    defer other.Close()
+
+    first.Upload.Add(60)
+    if (closed(firstClient) || closed(secondClient)) {
+        t.Fatalf("cut under quota")
+    }
+
+    second.Download.Add(40)
+    if (!closed(firstClient) || !closed(secondClient)) {
+        t.Fatalf("sessions not cut over quota")
+    }
+    if (closed(otherClient)) {
+        t.Fatalf("another user's session cut")
+    }
+}
+
+func TestStartErrors(t *testing.T) {
+
+    var directory string = t.TempDir()
+
+    var malformed string = filepath.Join(directory, "malformed.json")
+    ioutil.WriteFile(malformed, []byte("{"), 0600)
+
+    for _, path := range []string{ malformed, directory } {
+        if err := Start(&config.QuotaConf{ Path : path }); err == nil {
+            Stop()
+            t.Fatalf("started from %s", path)
+        }
+    }
+
+    // A missing file starts afresh
+    var missing string = filepath.Join(directory, "missing.json")
+    startQuota(t, &config.QuotaConf{ Path : missing })
+    Stop()
+
+    if _, err := os.Stat(missing); !os.IsNotExist(err) {
+        t.Fatalf("nothing counted, yet saved: %v", err)
+    }
+}
+
+/*----------------------------------------------------------
+    Helpers
+-----------------------------------------------------------*/
+
+func startQuota(t *testing.T, conf *config.QuotaConf) {
+
+    if err := Start(conf); err != nil {
+        t.Fatalf("start: %v", err)
+    }
+}
+
+// A session of user over a pipe, the client end is returned
+func openSession(t *testing.T, conf *config.QuotaConf, user string) (*Session, net.Conn) {
+
+    client, server := net.Pipe()
+    t.Cleanup(func() { client.Close(); server.Close() })
+
+    go client.Write([]byte{ socks.SOCKS_VERSION_V5 })
+
+    contxt, err := context.New(server, &config.Config{ Quota : *conf }, &config.ListenerConf{})
+    if (err != nil) {
+        t.Fatalf("context: %v", err)
+    }
+    contxt.SetUsername(user)
+
+    return Open(contxt), client
+}
+
+func savedAccount(t *testing.T, path string, user string) (*Account) {
+
+    bytes, err := ioutil.ReadFile(path)
+    if (err != nil) {
+        t.Fatalf("quota file: %v", err)
+    }
+
+    var accounts map[string]*Account
+    if err := json.Unmarshal(bytes, &accounts); err != nil {
+        t.Fatalf("quota file: %v", err)
+    }
+
+    if (accounts[user] == nil) {
+        t.Fatalf("no account of %s in %s", user, bytes)
+    }
+
+    return accounts[user]
+}
+
+// Whether the server end of client was closed
+func closed(client net.Conn) (bool) {
+
+    client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+    _, err := client.Read(make([]byte, 1))
+    client.SetReadDeadline(time.Time{})
+
+    if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+        return false
+    }
+
+    return true
+}
@@ -9,6 +9,7 @@ package request
 
 import (
         "errors"
+        "io"
         "net"
         "socks"
         "socks/address"
@@ -17,8 +18,10 @@ import (
 )
 
 type Request interface {
-        Start	() (bool, error)
-        Command	() (*command.Command)
+        Start		() (bool, error)
+        Command		() (*command.Command)
+        CommandIndex	() (byte)
+        Address		() (address.Address)
 }
 
 type RequestV4 struct {
@@ -26,6 +29,7 @@ type RequestV4 struct {
         commandIndex		byte
         reserved			byte
         atyp				byte
+        userid			string
         address			address.Address
         command			command.Command
         context			*context.Context
@@ -207,6 +211,14 @@ func (request *RequestV5) Command() (*command.Command) {
     return &request.command
 }
 
+func (request *RequestV5) CommandIndex() (byte) {
+    return request.commandIndex
+}
+
+func (request *RequestV5) Address() (address.Address) {
+    return request.address
+}
+
 func newRequestV5(context *context.Context) (*RequestV5) {
     return &RequestV5 { context : context}
 }
@@ -214,15 +226,93 @@ func newRequestV5(context *context.Context) (*RequestV5) {
 /*----------------------------------------------------------
     Handle Socks V4 requests
 -----------------------------------------------------------*/
+/* SOCKS 4
+   The client connects to the SOCKS server and sends a CONNECT (or BIND)
+   request when it wants to establish a connection to an application
+   server. The client includes in the request packet the IP address and
+   the port number of the destination host, and userid, in the following
+   format.
+
+                +----+----+----+----+----+----+----+----+----+----+....+----+
+                | VN | CD | DSTPORT |      DSTIP        | USERID       |NULL|
+                +----+----+----+----+----+----+----+----+----+----+....+----+
+   # of bytes:     1    1      2              4           variable       1
+
+   VN is the SOCKS protocol version number and should be 4. CD is the
+   SOCKS command code and should be 1 for CONNECT request, 2 for BIND
+   request. NULL is a byte of all zero bits.
+
+   SOCKS 4A
+   For version 4A, if the client cannot resolve the destination host's
+   domain name to find its IP address, it should set the first three bytes
+   of DSTIP to NULL and the last byte to a non-zero value. (This
+   corresponds to IP address 0.0.0.x, with x nonzero.) Following the NULL
+   byte terminating USERID, the client must send the destination domain
+   name and terminate it with another NULL byte.
+*/
 func (request *RequestV4) Start () (bool, error) {
     
-    return true, nil
+    var err error
+    
+    // Read VN, CD, DSTPORT and DSTIP
+    var header []byte = make([]byte, 8)
+    _, err = io.ReadFull(request.context.Reader(), header)
+    if (err != nil) {
+        return false, err
+    }
+    
+    request.version		= header[0]
+    request.commandIndex	= header[1]
+    
+    var port int = (int(header[2]) << 8) | int(header[3])
+    var ipbytes []byte = header[4:8]
+    
+    // Read USERID
+    request.userid, err = readString(request.context)
+    if (err != nil) {
+        return false, err
+    }
+    
+    var ipaddress string
+    
+    // Socks V4a, DSTIP is 0.0.0.x and the domain name follows USERID
+    if ((ipbytes[0] == 0) && (ipbytes[1] == 0) && (ipbytes[2] == 0) && (ipbytes[3] != 0)) {
+        request.atyp = socks.SOCKS_V5_ATYP_FQDN
+        ipaddress, err = readString(request.context)
+        if (err != nil) {
+            return false, err
+        }
+        if (len(ipaddress) == 0) {
+            return false, errors.New("Empty domain name")
+        }
+    } else {
+        request.atyp = socks.SOCKS_V5_ATYP_IP4
+        ipaddress = net.IP(ipbytes).String()
+    }
+    
+    request.address = address.New(request.atyp, ipaddress, port)
+    
+    _, err = request.getCommand()
+    
+    return err == nil, err
 }
 
 func (request *RequestV4) Command() (*command.Command) {
     return &request.command
 }
 
+func (request *RequestV4) CommandIndex() (byte) {
+    return request.commandIndex
+}
+
+func (request *RequestV4) Address() (address.Address) {
+    return request.address
+}
+
+func (request *RequestV4) UserId() (string) {
+    return request.userid
+}
+
 func newRequestV4(context *context.Context) (*RequestV4) {
     return &RequestV4 { context : context}
 }
@@ -283,7 +373,7 @@ func (request *RequestV5) getAddress() (address.Address, error) {
             
             break
         default :
-            err = errors.New("No supported address")
+            err = socks.ERR_ADDRESS_UNSUPPORTED
             break
     }
     
@@ -291,45 +381,9 @@ func (request *RequestV5) getAddress() (address.Address, error) {
         return nil, err
     }
   
-    if (request.atyp != socks.SOCKS_V5_ATYP_FQDN) {
-    
-        // The atyp in reply has to be SOCKS_V5_ATYP_FQDN, otherwise the certificate returned by 
-        // target server will not be able to be verified, and thus cause https handshake failure.
-        var hosts, err = net.LookupAddr(ipaddress)
-        
-        // any error? If there is any error, don't convert
-        if (err == nil) {
-                 
-            // Check if the returned hosts is empty
-            // if it is empty don't convert to FQDN
-            if (len(hosts) != 0) {
-                
-                var bfound bool = false
-                //it is not empty, convert the atyp to SOCKS_V5_ATYP_FQDN in reply
-                for _, v := range hosts {
-                    // Do the reverse dns query of this host
-                    ips, err := net.LookupIP(v)
-                    if (err != nil) {
-                        continue
-                    }
-                    for _, u := range ips {
-                        if (ipaddress == u.String()) {
-                            // found it.
-                           bfound = true
-                           break
-                        }
-                    }
-                    if (bfound == true) {
-                        ipaddress = v
-                        request.atyp	= socks.SOCKS_V5_ATYP_FQDN
-                        break
-                    }
-                }
-            }
-        }
-    }
-    
-    // create the destination address object
+    // create the destination address object, an IP destination is
+    // dialed exactly as given
+
     request.address = address.New(request.atyp, ipaddress, int(port))
     
     return request.address, nil
@@ -350,8 +404,38 @@ func (request *RequestV5) getCommand() (*command.Command, error) {
             request.command = command.NewCommandUDPAssociation(&request.address, request.context)
             break
         default:
-            err = errors.New("Not supported command")
+            err = socks.ERR_COMMAND_UNSUPPORTED
     }
     
     return &request.command, err
 }
+
+func (request *RequestV4) getCommand() (*command.Command, error) {
+    
+    var err error
+    
+    // Socks V4 supports CONNECT and BIND only
+    switch (request.commandIndex) {
+        case socks.SOCKS_COMMAND_CONNECT:
+            request.command = command.NewCommandConnect(&request.address, request.context)
+            break
+        case socks.SOCKS_COMMAND_BIND:
+            request.command = command.NewCommandBind(&request.address, request.context)
+            break
+        default:
+            err = socks.ERR_COMMAND_UNSUPPORTED
+    }
+    
+    return &request.command, err
+}
+
+// Read a NULL terminated string
+func readString(context *context.Context) (string, error) {
+    
+    bytes, err := context.Reader().ReadSlice(0x00)
+    if (err != nil) {
+        return "", err
+    }
+    
+    return string(bytes[:len(bytes) - 1]), nil
+}
@@ -0,0 +1,132 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package request
+
+import (
+        "errors"
+        "net"
+        "testing"
+        "socks"
+        "socks/config"
+        "socks/context"
+)
+
+func TestRequestV4(t *testing.T) {
+
+    var cases = []struct {
+        name			string
+        data			[]byte
+        command		byte
+        atyp			byte
+        host			string
+        port			int
+        userid		string
+        err			error
+    }{
+        { name : "connect",
+          data : testRequestV4(socks.SOCKS_COMMAND_CONNECT, 80, []byte{ 192, 0, 2, 1 }, "alice", ""),
+          command : socks.SOCKS_COMMAND_CONNECT, atyp : socks.SOCKS_V5_ATYP_IP4, host : "192.0.2.1", port : 80, userid : "alice" },
+        { name : "bind",
+          data : testRequestV4(socks.SOCKS_COMMAND_BIND, 6000, []byte{ 192, 0, 2, 1 }, "", ""),
+          command : socks.SOCKS_COMMAND_BIND, atyp : socks.SOCKS_V5_ATYP_IP4, host : "192.0.2.1", port : 6000 },
+        { name : "4a domain name",
+          data : testRequestV4(socks.SOCKS_COMMAND_CONNECT, 443, []byte{ 0, 0, 0, 1 }, "bob", "example.com"),
+          command : socks.SOCKS_COMMAND_CONNECT, atyp : socks.SOCKS_V5_ATYP_FQDN, host : "example.com", port : 443, userid : "bob" },
+        { name : "0.0.0.0 is not 4a",
+          data : testRequestV4(socks.SOCKS_COMMAND_BIND, 0, []byte{ 0, 0, 0, 0 }, "", ""),
+          command : socks.SOCKS_COMMAND_BIND, atyp : socks.SOCKS_V5_ATYP_IP4, host : "0.0.0.0", port : 0 },
+        { name : "4a empty domain name",
+          data : testRequestV4(socks.SOCKS_COMMAND_CONNECT, 443, []byte{ 0, 0, 0, 1 }, "", ""),
+          err : errors.New("Empty domain name") },
+        { name : "udp associate",
+          data : testRequestV4(socks.SOCKS_COMMAND_UDP_ASSOCIATE, 53, []byte{ 192, 0, 2, 1 }, "", ""),
+          err : socks.ERR_COMMAND_UNSUPPORTED },
+        { name : "short header",
+          data : []byte{ socks.SOCKS_VERSION_V4, socks.SOCKS_COMMAND_CONNECT, 0, 80 } },
+        { name : "unterminated userid",
+          data : []byte{ socks.SOCKS_VERSION_V4, socks.SOCKS_COMMAND_CONNECT, 0, 80, 192, 0, 2, 1, 'a', 'l' } },
+        { name : "4a unterminated domain name",
+          data : []byte{ socks.SOCKS_VERSION_V4, socks.SOCKS_COMMAND_CONNECT, 0, 80, 0, 0, 0, 1, 0, 'e', 'x' } },
+    }
+
+    for _, test := range cases {
+
+        var request *RequestV4 = startRequest(t, test.data)
+        status, err := request.Start()
+
+        // The malformed requests fail on the read
+        if ((test.command == 0) && (test.err == nil)) {
+            if (status || (err == nil)) {
+                t.Errorf("%s: parsed", test.name)
+            }
+            continue
+        }
+
+        if (test.err != nil) {
+            if (status || (err == nil) || (err.Error() != test.err.Error())) {
+                t.Errorf("%s: %v, want %v", test.name, err, test.err)
+            }
+            continue
+        }
+
+        if (!status || (err != nil)) {
+            t.Errorf("%s: %v", test.name, err)
+            continue
+        }
+
+        var address = request.Address()
+        if ((request.CommandIndex() != test.command) || (address.Atyp() != test.atyp) || (address.DstAddr() != test.host) || (address.DstPort() != test.port) || (request.UserId() != test.userid)) {
+            t.Errorf("%s: command %d, atyp %d, %s:%d, userid '%s'", test.name, request.CommandIndex(), address.Atyp(), address.DstAddr(), address.DstPort(), request.UserId())
+        }
+        if (*request.Command() == nil) {
+            t.Errorf("%s: no command", test.name)
+        }
+    }
+}
+
+/*----------------------------------------------------------
+    Helpers
+-----------------------------------------------------------*/
+
+// A Socks V4 request, a Socks V4a one when host is set
+func testRequestV4(command byte, port int, ip []byte, userid string, host string) ([]byte) {
+
+    var data []byte = []byte{ socks.SOCKS_VERSION_V4, command, byte(port >> 8), byte(port & 0xFF) }
+    data = append(data, ip...)
+    data = append(append(data, userid...), 0x00)
+
+    if ((ip[0] == 0) && (ip[1] == 0) && (ip[2] == 0) && (ip[3] != 0)) {
+        data = append(append(data, host...), 0x00)
+    }
+
+    return data
+}
+
+// The request of a client that sent data, then closed
+func startRequest(t *testing.T, data []byte) (*RequestV4) {
+
+    client, server := net.Pipe()
+    t.Cleanup(func() { server.Close() })
+
+    go func() {
+        client.Write(data)
+        client.Close()
+    }()
+
+    contxt, err := context.New(server, &config.Config{}, &config.ListenerConf{})
+    if (err != nil) {
+        t.Fatalf("context: %v", err)
+    }
+
+    request, ok := New(contxt).(*RequestV4)
+    if (!ok) {
+        t.Fatalf("not a Socks V4 request")
+    }
+
+    return request
+}
@@ -0,0 +1,320 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package resolver
+
+import (
+        "crypto/rand"
+        "errors"
+        "net"
+        "strings"
+)
+
+/* RFC 1035
+4.1.1. Header section format
+
+                                    1  1  1  1  1  1
+      0  1  2  3  4  5  6  7  8  9  0  1  2  3  4  5
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |                      ID                       |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |QR|   Opcode  |AA|TC|RD|RA|   Z    |   RCODE   |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |                    QDCOUNT                    |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |                    ANCOUNT                    |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |                    NSCOUNT                    |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+    |                    ARCOUNT                    |
+    +--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+--+
+*/
+const (
+        DNS_HEADER_SIZE		= 12
+        DNS_FLAG_RESPONSE	= 0x8000
+        DNS_FLAG_TRUNCATED	= 0x0200
+        DNS_FLAG_RECURSION	= 0x0100
+        DNS_RCODE_MASK		= 0x000F
+)
+
+const (
+        DNS_RCODE_SUCCESS	= 0
+        DNS_RCODE_SERVFAIL	= 2
+        DNS_RCODE_NXDOMAIN	= 3
+)
+
+const (
+        DNS_TYPE_A		= uint16(1)
+        DNS_TYPE_CNAME	= uint16(5)
+        DNS_TYPE_SOA		= uint16(6)
+        DNS_TYPE_AAAA	= uint16(28)
+        DNS_CLASS_IN		= uint16(1)
+)
+
+// What a response tells about the question
+type answer struct {
+        rcode		int
+        ips			[]net.IP
+        ttl			uint32
+        // SOA based TTL of a negative answer, 0 when there is no SOA
+        negativeTtl	uint32
+}
+
+// Longest CNAME chain followed from the queried name
+const DNS_MAX_CHAIN = 8
+
+// A resource record of the answer section
+type record struct {
+        name		string
+        rtype		uint16
+        ttl			uint32
+        // The address of A/AAAA, the canonical name of CNAME
+        ip			net.IP
+        target		string
+}
+
+var errMalformed = errors.New("Malformed DNS message")
+
+/*----------------------------------------------------------
+    Query
+-----------------------------------------------------------*/
+
+// Build a recursive query for name. The ID is random, DNS over HTTPS
+// clears it afterwards to keep the request cacheable.
+func newQuery(name string, qtype uint16) ([]byte, error) {
+
+    var query []byte = make([]byte, DNS_HEADER_SIZE, DNS_HEADER_SIZE + len(name) + 6)
+
+    if _, err := rand.Read(query[0:2]); err != nil {
+        return nil, err
+    }
+
+    query[2] = byte(DNS_FLAG_RECURSION >> 8)
+    query[5] = 1
+
+    // QNAME is a sequence of labels ending with the root
+    for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+        if ((len(label) == 0) || (len(label) > 63)) {
+            return nil, errors.New("Malformed domain name: " + name)
+        }
+        query = append(query, byte(len(label)))
+        query = append(query, label...)
+    }
+
+    query = append(query, 0x00)
+    query = append(query, byte(qtype >> 8), byte(qtype & 0xFF))
+    query = append(query, byte(DNS_CLASS_IN >> 8), byte(DNS_CLASS_IN & 0xFF))
+
+    if (len(query) > DNS_HEADER_SIZE + 255 + 4) {
+        return nil, errors.New("Domain name is too long: " + name)
+    }
+
+    return query, nil
+}
+
+/*----------------------------------------------------------
+    Response
+-----------------------------------------------------------*/
+
+// Parse the response to query. The question has to be the one asked,
+// only the addresses of the question type owned by the queried name, or
+// by the names its CNAME chain leads to, are kept.
+func parseResponse(query []byte, response []byte) (*answer, error) {
+
+    if (len(response) < DNS_HEADER_SIZE) {
+        return nil, errMalformed
+    }
+
+    if ((response[0] != query[0]) || (response[1] != query[1])) {
+        return nil, errors.New("DNS response ID mismatch")
+    }
+
+    var flags int = int(uint16At(response, 2))
+    if ((flags & DNS_FLAG_RESPONSE) == 0) {
+        return nil, errMalformed
+    }
+
+    var qtype uint16 = uint16At(query, len(query) - 4)
+    var result *answer = &answer{ rcode : flags & DNS_RCODE_MASK }
+
+    var questions int = int(uint16At(response, 4))
+    var answers int = int(uint16At(response, 6))
+    var authorities int = int(uint16At(response, 8))
+
+    qname, _, err := readName(query, DNS_HEADER_SIZE)
+    if (err != nil) {
+        return nil, err
+    }
+
+    // Some servers leave the question out of an error
+    if ((questions == 0) && (result.rcode != DNS_RCODE_SUCCESS)) {
+        return result, nil
+    }
+
+    // The question echoed back
+    if (questions != 1) {
+        return nil, errors.New("DNS response doesn't answer the question")
+    }
+
+    name, offset, err := readName(response, DNS_HEADER_SIZE)
+    if ((err != nil) || (offset + 4 > len(response))) {
+        return nil, errMalformed
+    }
+
+    if ((name != qname) || (uint16At(response, offset) != qtype) || (uint16At(response, offset + 2) != DNS_CLASS_IN)) {
+        return nil, errors.New("DNS response doesn't answer the question")
+    }
+    offset += 4
+
+    var records []record
+
+    for index := 0; index < answers + authorities; index++ {
+
+        owner, next, err := readName(response, offset)
+        if ((err != nil) || (next + 10 > len(response))) {
+            return nil, errMalformed
+        }
+        offset = next
+
+        var rtype uint16 = uint16At(response, offset)
+        var class uint16 = uint16At(response, offset + 2)
+        var ttl uint32 = uint32(uint16At(response, offset + 4)) << 16 | uint32(uint16At(response, offset + 6))
+        var length int = int(uint16At(response, offset + 8))
+
+        offset += 10
+        if (offset + length > len(response)) {
+            return nil, errMalformed
+        }
+
+        var rdata []byte = response[offset:offset + length]
+        var start int = offset
+        offset += length
+
+        if (class != DNS_CLASS_IN) {
+            continue
+        }
+
+        // Answer section
+        if (index < answers) {
+            switch {
+                case (rtype == DNS_TYPE_A) && (length == 4), (rtype == DNS_TYPE_AAAA) && (length == 16):
+                    records = append(records, record{ name : owner, rtype : rtype, ttl : ttl, ip : net.IP(append([]byte{}, rdata...)) })
+                    break
+                case rtype == DNS_TYPE_CNAME:
+                    target, _, err := readName(response, start)
+                    if (err != nil) {
+                        return nil, errMalformed
+                    }
+                    records = append(records, record{ name : owner, rtype : rtype, ttl : ttl, target : target })
+                    break
+            }
+            continue
+        }
+
+        /* RFC 2308
+           The TTL of this record is set from the minimum of the MINIMUM
+           field of the SOA record and the TTL of the SOA itself.
+        */
+        if ((rtype == DNS_TYPE_SOA) && (length >= 20)) {
+            var minimum uint32 = uint32(uint16At(rdata, length - 4)) << 16 | uint32(uint16At(rdata, length - 2))
+            if (minimum < ttl) {
+                ttl = minimum
+            }
+            result.negativeTtl = ttl
+        }
+    }
+
+    // Follow the chain from the queried name, the answer lasts as long
+    // as its shortest lived record
+    var first bool = true
+    var keep = func(ttl uint32) {
+        if (first || (ttl < result.ttl)) {
+            result.ttl = ttl
+            first = false
+        }
+    }
+
+    for hops := 0; (hops < DNS_MAX_CHAIN) && (len(qname) != 0); hops++ {
+
+        var next string
+
+        for _, record := range records {
+            if (record.name != qname) {
+                continue
+            }
+            if (record.rtype == qtype) {
+                result.ips = append(result.ips, record.ip)
+                keep(record.ttl)
+            } else if ((record.rtype == DNS_TYPE_CNAME) && (len(next) == 0)) {
+                next = record.target
+                keep(record.ttl)
+            }
+        }
+
+        qname = next
+    }
+
+    // A chain leading nowhere gives no TTL
+    if (len(result.ips) == 0) {
+        result.ttl = 0
+    }
+
+    return result, nil
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+func uint16At(data []byte, offset int) (uint16) {
+    return uint16(data[offset]) << 8 | uint16(data[offset + 1])
+}
+
+// The lower case name at offset and the offset right after it,
+// following compression pointers
+func readName(message []byte, offset int) (string, int, error) {
+
+    var labels []string
+    var end int = -1
+
+    // Every pointer has to go back, which bounds the loop
+    for limit := offset; ; {
+        if (offset >= len(message)) {
+            return "", 0, errMalformed
+        }
+
+        var length int = int(message[offset])
+
+        switch {
+            case length == 0:
+                if (end < 0) {
+                    end = offset + 1
+                }
+                return strings.ToLower(strings.Join(labels, ".")), end, nil
+            case (length & 0xC0) == 0xC0:
+                if (offset + 1 >= len(message)) {
+                    return "", 0, errMalformed
+                }
+                if (end < 0) {
+                    end = offset + 2
+                }
+                var pointer int = int(uint16At(message, offset) & 0x3FFF)
+                if (pointer >= limit) {
+                    return "", 0, errMalformed
+                }
+                offset, limit = pointer, pointer
+                continue
+            case (length & 0xC0) != 0:
+                return "", 0, errMalformed
+        }
+
+        if (offset + 1 + length > len(message)) {
+            return "", 0, errMalformed
+        }
+        labels = append(labels, string(message[offset + 1:offset + 1 + length]))
+        offset += length + 1
+    }
+}
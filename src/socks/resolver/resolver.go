@@ -0,0 +1,474 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package resolver
+
+import (
+        gocontext "context"
+        "crypto/tls"
+        "errors"
+        "net"
+        "net/http"
+        "net/url"
+        "strconv"
+        "strings"
+        "sync"
+        "time"
+        "socks/log"
+        "socks/config"
+)
+
+// Defaults of the zero config values
+const (
+        RESOLVER_TIMEOUT			= 5 * time.Second
+        RESOLVER_CACHE_SIZE		= 4096
+        RESOLVER_TTL				= 60 * time.Second
+        RESOLVER_NEGATIVE_TTL	= 30 * time.Second
+)
+
+type Resolver struct {
+        hosts		map[string][]net.IP
+        upstream		string
+        transport	transport
+        timeout		time.Duration
+        ttl			time.Duration
+        negativeTtl	time.Duration
+        size			int
+        cache		map[string]*entry
+        mutex		sync.Mutex
+}
+
+// A cached answer, err is set for a negative one
+type entry struct {
+        ips			[]net.IP
+        err			error
+        expires		time.Time
+}
+
+// Compiled resolvers, keyed by their config
+var resolvers		map[*config.ResolverConf]*Resolver = make(map[*config.ResolverConf]*Resolver)
+var resolversLock	sync.Mutex
+
+// The config of the current resolver, the next one starts with its cache
+var current		*config.ResolverConf
+
+/*----------------------------------------------------------
+    Create a Resolver
+-----------------------------------------------------------*/
+
+// Returns the compiled Resolver of the config. A config that doesn't
+// compile falls back to the system resolver.
+func Get(conf *config.ResolverConf) (*Resolver) {
+
+    resolversLock.Lock()
+    defer resolversLock.Unlock()
+
+    resolver := resolvers[conf]
+    if (resolver != nil) {
+        return resolver
+    }
+
+    resolver = compile(conf)
+    resolvers[conf] = resolver
+
+    // The first config is the current one until a reload
+    if (current == nil) {
+        current = conf
+    }
+
+    return resolver
+}
+
+// Swap is called when a reload makes conf the current config. Its
+// resolver starts with the answers cached by the previous one when both
+// ask the same server.
+func Swap(conf *config.ResolverConf) {
+
+    resolversLock.Lock()
+    defer resolversLock.Unlock()
+
+    var previous *Resolver = resolvers[current]
+
+    current = conf
+
+    if ((resolvers[conf] == nil) && (previous != nil)) {
+        resolver := compile(conf)
+        resolver.inherit(previous)
+        resolvers[conf] = resolver
+    }
+}
+
+// Drop forgets the compiled resolver of conf, it is called once the last
+// session of a config replaced by a reload is over
+func Drop(conf *config.ResolverConf) {
+
+    resolversLock.Lock()
+    defer resolversLock.Unlock()
+
+    delete(resolvers, conf)
+}
+
+func New(conf *config.ResolverConf) (*Resolver, error) {
+
+    if ((conf.Timeout < 0) || (conf.Ttl < 0) || (conf.NegativeTtl < 0)) {
+        return nil, errors.New("Timeout, ttl and negativeTtl must not be negative")
+    }
+
+    var resolver *Resolver = &Resolver{ hosts		: make(map[string][]net.IP),
+                                        timeout		: orDefault(conf.Timeout, RESOLVER_TIMEOUT),
+                                        ttl			: orDefault(conf.Ttl, RESOLVER_TTL),
+                                        negativeTtl	: orDefault(conf.NegativeTtl, RESOLVER_NEGATIVE_TTL),
+                                        size			: conf.Cache,
+                                        upstream		: conf.Upstream,
+                                        cache		: make(map[string]*entry) }
+
+    if (resolver.size == 0) {
+        resolver.size = RESOLVER_CACHE_SIZE
+    }
+
+    for name, addresses := range conf.Hosts {
+        for _, address := range addresses {
+            ip := net.ParseIP(address)
+            if (ip == nil) {
+                return nil, errors.New("Malformed address for '" + name + "': '" + address + "'")
+            }
+            key := canonical(name)
+            resolver.hosts[key] = append(resolver.hosts[key], ip)
+        }
+    }
+
+    var err error
+    resolver.transport, err = newTransport(conf, resolver.timeout)
+    if (err != nil) {
+        return nil, err
+    }
+
+    return resolver, nil
+}
+
+/*----------------------------------------------------------
+    Resolver Implementation
+-----------------------------------------------------------*/
+
+// LookupIP returns the addresses of host, network is "ip", "ip4" or
+// "ip6". IPv4 addresses come first for "ip". A missing name fails with
+// a *net.DNSError.
+func (resolver *Resolver) LookupIP(network string, host string) ([]net.IP, error) {
+
+    if ip := net.ParseIP(host); ip != nil {
+        return []net.IP{ ip }, nil
+    }
+
+    var name string = canonical(host)
+
+    // Static overrides
+    if ips, found := resolver.hosts[name]; found {
+        ips = filter(network, ips)
+        if (len(ips) == 0) {
+            return nil, &net.DNSError{ Err : "no such host", Name : host, IsNotFound : true }
+        }
+        return ips, nil
+    }
+
+    var qtypes []uint16
+    switch (network) {
+        case "ip4":
+            qtypes = []uint16{ DNS_TYPE_A }
+            break
+        case "ip6":
+            qtypes = []uint16{ DNS_TYPE_AAAA }
+            break
+        default:
+            qtypes = []uint16{ DNS_TYPE_A, DNS_TYPE_AAAA }
+            break
+    }
+
+    // Both families are asked at once
+    var results []*entry = make([]*entry, len(qtypes))
+    var waiter sync.WaitGroup
+
+    for index, qtype := range qtypes {
+        waiter.Add(1)
+        go func(index int, qtype uint16) {
+            defer waiter.Done()
+            results[index] = resolver.lookup(name, qtype)
+        }(index, qtype)
+    }
+
+    waiter.Wait()
+
+    var ips []net.IP
+    var err error
+
+    for _, result := range results {
+        ips = append(ips, result.ips...)
+        if ((err == nil) && (result.err != nil)) {
+            err = result.err
+        }
+    }
+
+    if (len(ips) != 0) {
+        return ips, nil
+    }
+
+    if (err == nil) {
+        err = &net.DNSError{ Err : "no such host", Name : host, IsNotFound : true }
+    }
+
+    return nil, err
+}
+
+// One question, from the cache when possible
+func (resolver *Resolver) lookup(name string, qtype uint16) (*entry) {
+
+    var key string = name + "/" + strconv.Itoa(int(qtype))
+
+    if cached := resolver.cached(key); cached != nil {
+        return cached
+    }
+
+    var result *entry
+    if (resolver.transport == nil) {
+        result = resolver.system(name, qtype)
+    } else {
+        result = resolver.query(name, qtype)
+    }
+
+    resolver.store(key, result)
+
+    return result
+}
+
+// Ask the system resolver, it doesn't tell the TTL
+func (resolver *Resolver) system(name string, qtype uint16) (*entry) {
+
+    var network string = "ip4"
+    if (qtype == DNS_TYPE_AAAA) {
+        network = "ip6"
+    }
+
+    ctx, cancel := gocontext.WithTimeout(gocontext.Background(), resolver.timeout)
+    defer cancel()
+
+    ips, err := net.DefaultResolver.LookupIP(ctx, network, name)
+    if (err != nil) {
+        var dnsError *net.DNSError
+        if (errors.As(err, &dnsError) && dnsError.IsNotFound) {
+            return &entry{ err : err, expires : time.Now().Add(resolver.negativeTtl) }
+        }
+        // Not cached
+        return &entry{ err : err }
+    }
+
+    return &entry{ ips : ips, expires : time.Now().Add(resolver.ttl) }
+}
+
+// Ask the configured upstream server
+func (resolver *Resolver) query(name string, qtype uint16) (*entry) {
+
+    var server string = resolver.transport.Address()
+
+    request, err := newQuery(name, qtype)
+    if (err != nil) {
+        return &entry{ err : &net.DNSError{ Err : err.Error(), Name : name, IsNotFound : true } }
+    }
+
+    response, err := resolver.transport.Exchange(request)
+    if (err != nil) {
+        var timeout bool
+        if netError, ok := err.(net.Error); ok {
+            timeout = netError.Timeout()
+        }
+        return &entry{ err : &net.DNSError{ Err : err.Error(), Name : name, Server : server, IsTimeout : timeout } }
+    }
+
+    answer, err := parseResponse(request, response)
+    if (err != nil) {
+        return &entry{ err : &net.DNSError{ Err : err.Error(), Name : name, Server : server } }
+    }
+
+    switch (answer.rcode) {
+        case DNS_RCODE_SUCCESS, DNS_RCODE_NXDOMAIN:
+            break
+        default:
+            // SERVFAIL, REFUSED... are not cached
+            return &entry{ err : &net.DNSError{ Err : "server failure, rcode " + strconv.Itoa(answer.rcode), Name : name, Server : server, IsTemporary : true } }
+    }
+
+    // NXDOMAIN, or the name has no record of this type
+    if (len(answer.ips) == 0) {
+        var ttl time.Duration = resolver.negativeTtl
+        if ((answer.negativeTtl != 0) && (time.Duration(answer.negativeTtl) * time.Second < ttl)) {
+            ttl = time.Duration(answer.negativeTtl) * time.Second
+        }
+        var notFound error
+        if (answer.rcode == DNS_RCODE_NXDOMAIN) {
+            notFound = &net.DNSError{ Err : "no such host", Name : name, Server : server, IsNotFound : true }
+        }
+        return &entry{ err : notFound, expires : time.Now().Add(ttl) }
+    }
+
+    return &entry{ ips : answer.ips, expires : time.Now().Add(time.Duration(answer.ttl) * time.Second) }
+}
+
+func (resolver *Resolver) cached(key string) (*entry) {
+
+    resolver.mutex.Lock()
+    defer resolver.mutex.Unlock()
+
+    cached := resolver.cache[key]
+    if (cached == nil) {
+        return nil
+    }
+
+    if (time.Now().After(cached.expires)) {
+        delete(resolver.cache, key)
+        return nil
+    }
+
+    return cached
+}
+
+// Keep the answer until it expires. When the cache is full the expired
+// answers are dropped first, then any.
+func (resolver *Resolver) store(key string, result *entry) {
+
+    if ((resolver.size < 0) || !time.Now().Before(result.expires)) {
+        return
+    }
+
+    resolver.mutex.Lock()
+    defer resolver.mutex.Unlock()
+
+    if (len(resolver.cache) >= resolver.size) {
+        var now time.Time = time.Now()
+        for cachedKey, cached := range resolver.cache {
+            if (now.After(cached.expires)) {
+                delete(resolver.cache, cachedKey)
+            }
+        }
+        for cachedKey := range resolver.cache {
+            if (len(resolver.cache) < resolver.size) {
+                break
+            }
+            delete(resolver.cache, cachedKey)
+        }
+    }
+
+    resolver.cache[key] = result
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+
+// The resolver of conf, or the system one when it doesn't compile. The
+// resolvers' lock is held.
+func compile(conf *config.ResolverConf) (*Resolver) {
+
+    resolver, err := New(conf)
+    if (err != nil) {
+        log.Errorf("Invalid resolver config, using the system resolver: %s\n", err.Error())
+        resolver, _ = New(&config.ResolverConf{})
+    }
+
+    return resolver
+}
+
+// Take over the answers previous cached, as many as the cache holds.
+// The answers of another server are not.
+func (resolver *Resolver) inherit(previous *Resolver) {
+
+    if ((resolver.upstream != previous.upstream) || (resolver.size < 0)) {
+        return
+    }
+
+    previous.mutex.Lock()
+    defer previous.mutex.Unlock()
+
+    var now time.Time = time.Now()
+
+    for key, cached := range previous.cache {
+        if (len(resolver.cache) >= resolver.size) {
+            break
+        }
+        if (now.Before(cached.expires)) {
+            resolver.cache[key] = cached
+        }
+    }
+}
+
+func newTransport(conf *config.ResolverConf, timeout time.Duration) (transport, error) {
+
+    if (len(conf.Upstream) == 0) {
+        return nil, nil
+    }
+
+    upstream, err := url.Parse(conf.Upstream)
+    if ((err != nil) || (len(upstream.Host) == 0)) {
+        return nil, errors.New("Malformed upstream: '" + conf.Upstream + "'")
+    }
+
+    switch (upstream.Scheme) {
+        case "udp":
+            return &udpTransport{ address : withPort(upstream.Host, "53"), timeout : timeout }, nil
+        case "tcp":
+            return &streamTransport{ address : withPort(upstream.Host, "53"), timeout : timeout }, nil
+        case "tls":
+            var serverName string = conf.Servername
+            if (len(serverName) == 0) {
+                serverName = upstream.Hostname()
+            }
+            return &streamTransport{ address : withPort(upstream.Host, "853"), timeout : timeout, tls : &tls.Config{ ServerName : serverName } }, nil
+        case "https":
+            var client *http.Client = &http.Client{ Timeout : timeout }
+            if (len(conf.Servername) != 0) {
+                client.Transport = &http.Transport{ TLSClientConfig : &tls.Config{ ServerName : conf.Servername } }
+            }
+            return &httpsTransport{ url : upstream.String(), client : client }, nil
+    }
+
+    return nil, errors.New("Unknown upstream scheme: '" + upstream.Scheme + "'")
+}
+
+func withPort(host string, port string) (string) {
+
+    if _, _, err := net.SplitHostPort(host); err == nil {
+        return host
+    }
+
+    return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+func canonical(name string) (string) {
+    return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func orDefault(seconds int, fallback time.Duration) (time.Duration) {
+
+    if (seconds == 0) {
+        return fallback
+    }
+
+    return time.Duration(seconds) * time.Second
+}
+
+// Keep the addresses of the network's family
+func filter(network string, ips []net.IP) ([]net.IP) {
+
+    var result []net.IP
+
+    for _, ip := range ips {
+        var v4 bool = ip.To4() != nil
+        if (((network == "ip4") && !v4) || ((network == "ip6") && v4)) {
+            continue
+        }
+        result = append(result, ip)
+    }
+
+    return result
+}
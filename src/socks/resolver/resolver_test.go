@@ -0,0 +1,712 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package resolver
+
+import (
+        "errors"
+        "io"
+        "net"
+        "strconv"
+        "strings"
+        "sync"
+        "testing"
+        "time"
+        "socks/config"
+)
+
+/* The upstream server is played by the test, over UDP and TCP on the
+   same port. It answers with what the test tells it and counts the
+   questions it was asked.
+*/
+
+// What the fake server answers to a question
+type reply struct {
+        rcode		int
+        ips			[]net.IP
+        ttl			uint32
+        // TTL and MINIMUM of an SOA in the authority section, none when 0
+        soa			uint32
+        // Over UDP, an empty answer with the TC bit set
+        truncate		bool
+}
+
+type fakeServer struct {
+        udp			net.PacketConn
+        tcp			net.Listener
+        answer		func(name string, qtype uint16) (reply)
+        mutex		sync.Mutex
+        asked		map[string]int
+}
+
+// Starts a fake server answering with answer
+func newFakeServer(t *testing.T, answer func(name string, qtype uint16) (reply)) (*fakeServer) {
+
+    var server *fakeServer = &fakeServer{ answer : answer, asked : make(map[string]int) }
+    var err error
+
+    // The TCP port has to be the UDP one, try a few
+    for attempt := 0; attempt < 10; attempt++ {
+        server.udp, err = net.ListenPacket("udp", "127.0.0.1:0")
+        if (err != nil) {
+            t.Fatalf("listen: %v", err)
+        }
+        server.tcp, err = net.Listen("tcp", server.udp.LocalAddr().String())
+        if (err == nil) {
+            break
+        }
+        server.udp.Close()
+    }
+    if (err != nil) {
+        t.Fatalf("listen: %v", err)
+    }
+
+    t.Cleanup(func() { server.udp.Close(); server.tcp.Close() })
+
+    go server.serveUdp()
+    go server.serveTcp()
+
+    return server
+}
+
+func (server *fakeServer) address() (string) {
+    return server.udp.LocalAddr().String()
+}
+
+// How many times the question was asked, over transport "udp" or "tcp"
+func (server *fakeServer) count(transport string, name string, qtype uint16) (int) {
+
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+
+    return server.asked[key(transport, name, qtype)]
+}
+
+func (server *fakeServer) serveUdp() {
+
+    var buffer []byte = make([]byte, DNS_MAX_UDP_MESSAGE)
+
+    for {
+        count, addr, err := server.udp.ReadFrom(buffer)
+        if (err != nil) {
+            return
+        }
+        if response := server.respond("udp", buffer[:count]); response != nil {
+            server.udp.WriteTo(response, addr)
+        }
+    }
+}
+
+func (server *fakeServer) serveTcp() {
+
+    for {
+        conn, err := server.tcp.Accept()
+        if (err != nil) {
+            return
+        }
+        go func() {
+            defer conn.Close()
+            var length []byte = make([]byte, 2)
+            if _, err := io.ReadFull(conn, length); err != nil {
+                return
+            }
+            var query []byte = make([]byte, int(uint16At(length, 0)))
+            if _, err := io.ReadFull(conn, query); err != nil {
+                return
+            }
+            if response := server.respond("tcp", query); response != nil {
+                conn.Write(append([]byte{ byte(len(response) >> 8), byte(len(response) & 0xFF) }, response...))
+            }
+        }()
+    }
+}
+
+func (server *fakeServer) respond(transport string, query []byte) ([]byte) {
+
+    name, qtype, err := question(query)
+    if (err != nil) {
+        return nil
+    }
+
+    server.mutex.Lock()
+    server.asked[key(transport, name, qtype)]++
+    server.mutex.Unlock()
+
+    var answer reply = server.answer(name, qtype)
+    if (answer.truncate && (transport == "udp")) {
+        return buildResponse(query, reply{ }, DNS_FLAG_TRUNCATED)
+    }
+
+    return buildResponse(query, answer, 0)
+}
+
+/*----------------------------------------------------------
+    Cache
+-----------------------------------------------------------*/
+
+func TestCacheTtl(t *testing.T) {
+
+    server := newFakeServer(t, func(name string, qtype uint16) (reply) {
+        return reply{ ips : []net.IP{ net.ParseIP("192.0.2.10").To4() }, ttl : 1 }
+    })
+
+    resolver := testResolver(t, &config.ResolverConf{ Upstream : "udp://" + server.address() })
+
+    for round := 0; round < 3; round++ {
+        ips, err := resolver.LookupIP("ip4", "cached.example")
+        if ((err != nil) || (len(ips) != 1) || !ips[0].Equal(net.ParseIP("192.0.2.10"))) {
+            t.Fatalf("lookup: %v %v", ips, err)
+        }
+    }
+
+    if count := server.count("udp", "cached.example", DNS_TYPE_A); count != 1 {
+        t.Fatalf("asked %d times within the TTL, want 1", count)
+    }
+
+    // The record's TTL, not the default one, tells when it expires
+    time.Sleep(1100 * time.Millisecond)
+
+    if _, err := resolver.LookupIP("ip4", "cached.example"); err != nil {
+        t.Fatalf("lookup: %v", err)
+    }
+
+    if count := server.count("udp", "cached.example", DNS_TYPE_A); count != 2 {
+        t.Fatalf("asked %d times after the TTL, want 2", count)
+    }
+}
+
+func TestNegativeCache(t *testing.T) {
+
+    server := newFakeServer(t, func(name string, qtype uint16) (reply) {
+        switch (name) {
+            case "missing.example":
+                return reply{ rcode : DNS_RCODE_NXDOMAIN, soa : 1 }
+            case "failing.example":
+                return reply{ rcode : DNS_RCODE_SERVFAIL }
+        }
+        return reply{ }
+    })
+
+    resolver := testResolver(t, &config.ResolverConf{ Upstream : "udp://" + server.address() })
+
+    for round := 0; round < 3; round++ {
+        _, err := resolver.LookupIP("ip4", "missing.example")
+        var dnsError *net.DNSError
+        if (!errors.As(err, &dnsError) || !dnsError.IsNotFound) {
+            t.Fatalf("lookup of a missing name: %v", err)
+        }
+    }
+
+    if count := server.count("udp", "missing.example", DNS_TYPE_A); count != 1 {
+        t.Fatalf("NXDOMAIN asked %d times, want 1", count)
+    }
+
+    // The SOA tells the negative TTL, shorter than the default one
+    time.Sleep(1100 * time.Millisecond)
+
+    resolver.LookupIP("ip4", "missing.example")
+    if count := server.count("udp", "missing.example", DNS_TYPE_A); count != 2 {
+        t.Fatalf("NXDOMAIN asked %d times after the SOA TTL, want 2", count)
+    }
+
+    // A server failure is asked again
+    for round := 0; round < 2; round++ {
+        _, err := resolver.LookupIP("ip4", "failing.example")
+        var dnsError *net.DNSError
+        if (!errors.As(err, &dnsError) || !dnsError.IsTemporary) {
+            t.Fatalf("lookup with a server failure: %v", err)
+        }
+    }
+
+    if count := server.count("udp", "failing.example", DNS_TYPE_A); count != 2 {
+        t.Fatalf("SERVFAIL asked %d times, want 2", count)
+    }
+}
+
+// A reload keeps the answers when the server is the same
+func TestSwapCarriesCache(t *testing.T) {
+
+    server := newFakeServer(t, func(name string, qtype uint16) (reply) {
+        return reply{ ips : []net.IP{ net.ParseIP("192.0.2.20").To4() }, ttl : 60 }
+    })
+
+    var before *config.ResolverConf = &config.ResolverConf{ Upstream : "udp://" + server.address() }
+    var after *config.ResolverConf = &config.ResolverConf{ Upstream : "udp://" + server.address() }
+    var other *config.ResolverConf = &config.ResolverConf{ Upstream : "tcp://" + server.address() }
+
+    Swap(before)
+    if _, err := Get(before).LookupIP("ip4", "kept.example"); err != nil {
+        t.Fatalf("lookup: %v", err)
+    }
+
+    Swap(after)
+    if _, err := Get(after).LookupIP("ip4", "kept.example"); err != nil {
+        t.Fatalf("lookup: %v", err)
+    }
+
+    if count := server.count("udp", "kept.example", DNS_TYPE_A); count != 1 {
+        t.Fatalf("asked %d times across a reload, want 1", count)
+    }
+
+    Swap(other)
+    if _, err := Get(other).LookupIP("ip4", "kept.example"); err != nil {
+        t.Fatalf("lookup: %v", err)
+    }
+
+    if count := server.count("tcp", "kept.example", DNS_TYPE_A); count != 1 {
+        t.Fatalf("asked %d times after the server changed, want 1", count)
+    }
+}
+
+// The resolver of an old config is kept for its sessions until dropped
+func TestDrop(t *testing.T) {
+
+    var old *config.ResolverConf = &config.ResolverConf{}
+    var current *config.ResolverConf = &config.ResolverConf{}
+
+    var resolver *Resolver = Get(old)
+    Swap(current)
+
+    if (Get(old) != resolver) {
+        t.Fatalf("resolver of the old config compiled again")
+    }
+
+    Drop(old)
+
+    resolversLock.Lock()
+    defer resolversLock.Unlock()
+
+    if ((resolvers[old] != nil) || (resolvers[current] == nil)) {
+        t.Fatalf("old config kept: %v, current config kept: %v", resolvers[old] != nil, resolvers[current] != nil)
+    }
+}
+
+/*----------------------------------------------------------
+    Transport
+-----------------------------------------------------------*/
+
+func TestTruncatedRetry(t *testing.T) {
+
+    server := newFakeServer(t, func(name string, qtype uint16) (reply) {
+        return reply{ ips : []net.IP{ net.ParseIP("2001:db8::30") }, ttl : 60, truncate : true }
+    })
+
+    resolver := testResolver(t, &config.ResolverConf{ Upstream : "udp://" + server.address() })
+
+    ips, err := resolver.LookupIP("ip6", "large.example")
+    if ((err != nil) || (len(ips) != 1) || !ips[0].Equal(net.ParseIP("2001:db8::30"))) {
+        t.Fatalf("lookup: %v %v", ips, err)
+    }
+
+    if ((server.count("udp", "large.example", DNS_TYPE_AAAA) != 1) || (server.count("tcp", "large.example", DNS_TYPE_AAAA) != 1)) {
+        t.Fatalf("want one question over UDP then one over TCP")
+    }
+}
+
+/*----------------------------------------------------------
+    Static hosts
+-----------------------------------------------------------*/
+
+func TestStaticHosts(t *testing.T) {
+
+    server := newFakeServer(t, func(name string, qtype uint16) (reply) {
+        return reply{ ips : []net.IP{ net.ParseIP("192.0.2.99").To4() }, ttl : 60 }
+    })
+
+    resolver := testResolver(t, &config.ResolverConf{ Upstream	: "udp://" + server.address(),
+                                                      Hosts		: map[string][]string{ "Static.Example" : { "192.0.2.40", "2001:db8::40" },
+                                                                                   "v6only.example" : { "2001:db8::41" } } })
+
+    var cases = []struct {
+        network		string
+        host			string
+        want			[]string
+    }{
+        { "ip", "static.example", []string{ "192.0.2.40", "2001:db8::40" } },
+        { "ip4", "STATIC.example.", []string{ "192.0.2.40" } },
+        { "ip6", "static.example", []string{ "2001:db8::40" } },
+        { "ip4", "v6only.example", nil },
+        { "ip", "192.0.2.50", []string{ "192.0.2.50" } },
+    }
+
+    for _, test := range cases {
+        ips, err := resolver.LookupIP(test.network, test.host)
+        if (test.want == nil) {
+            var dnsError *net.DNSError
+            if (!errors.As(err, &dnsError) || !dnsError.IsNotFound) {
+                t.Fatalf("%s %s: %v %v, want not found", test.network, test.host, ips, err)
+            }
+            continue
+        }
+        if ((err != nil) || (len(ips) != len(test.want))) {
+            t.Fatalf("%s %s: %v %v, want %v", test.network, test.host, ips, err, test.want)
+        }
+        for index, ip := range ips {
+            if (!ip.Equal(net.ParseIP(test.want[index]))) {
+                t.Fatalf("%s %s: %v, want %v", test.network, test.host, ips, test.want)
+            }
+        }
+    }
+
+    server.mutex.Lock()
+    defer server.mutex.Unlock()
+
+    if (len(server.asked) != 0) {
+        t.Fatalf("static names were asked upstream: %v", server.asked)
+    }
+}
+
+/*----------------------------------------------------------
+    Messages
+-----------------------------------------------------------*/
+
+func TestParseResponse(t *testing.T) {
+
+    query, err := newQuery("parsed.example", DNS_TYPE_A)
+    if (err != nil) {
+        t.Fatalf("query: %v", err)
+    }
+
+    response := buildResponse(query, reply{ ips : []net.IP{ net.ParseIP("192.0.2.60").To4(), net.ParseIP("192.0.2.61").To4() }, ttl : 300 }, 0)
+
+    result, err := parseResponse(query, response)
+    if ((err != nil) || (len(result.ips) != 2) || (result.ttl != 300) || (result.rcode != DNS_RCODE_SUCCESS)) {
+        t.Fatalf("parse: %+v %v", result, err)
+    }
+
+    negative := buildResponse(query, reply{ rcode : DNS_RCODE_NXDOMAIN, soa : 120 }, 0)
+
+    result, err = parseResponse(query, negative)
+    if ((err != nil) || (len(result.ips) != 0) || (result.negativeTtl != 120) || (result.rcode != DNS_RCODE_NXDOMAIN)) {
+        t.Fatalf("parse of NXDOMAIN: %+v %v", result, err)
+    }
+}
+
+func TestParseResponseMalformed(t *testing.T) {
+
+    query, err := newQuery("parsed.example", DNS_TYPE_A)
+    if (err != nil) {
+        t.Fatalf("query: %v", err)
+    }
+
+    valid := buildResponse(query, reply{ ips : []net.IP{ net.ParseIP("192.0.2.60").To4() }, ttl : 300 }, 0)
+    var question int = len(query)
+
+    // A copy of valid changed by change
+    mangle := func(change func(response []byte) ([]byte)) ([]byte) {
+        return change(append([]byte{}, valid...))
+    }
+
+    var cases = []struct {
+        name			string
+        response		[]byte
+    }{
+        { "empty", []byte{} },
+        { "short header", valid[:DNS_HEADER_SIZE - 1] },
+        { "ID mismatch", mangle(func(response []byte) ([]byte) { response[0] ^= 0xFF; return response }) },
+        { "not a response", mangle(func(response []byte) ([]byte) { response[2] &^= byte(DNS_FLAG_RESPONSE >> 8); return response }) },
+        { "question cut", valid[:question - 2] },
+        { "name cut", valid[:DNS_HEADER_SIZE + 3] },
+        { "bad label", mangle(func(response []byte) ([]byte) { response[DNS_HEADER_SIZE] = 0x80; return response }) },
+        { "pointer loop", mangle(func(response []byte) ([]byte) { response[DNS_HEADER_SIZE], response[DNS_HEADER_SIZE + 1] = 0xC0, DNS_HEADER_SIZE; return response }) },
+        { "pointer forward", mangle(func(response []byte) ([]byte) { response[question], response[question + 1] = 0xC0, byte(question + 2); return response }) },
+        { "record cut", valid[:len(valid) - 5] },
+        { "record header cut", valid[:question + 6] },
+        { "rdata past the end", mangle(func(response []byte) ([]byte) { response[question + 11] = 0xFF; return response }) },
+        { "more records than sent", mangle(func(response []byte) ([]byte) { response[7] = 2; return response }) },
+    }
+
+    for _, test := range cases {
+        if result, err := parseResponse(query, test.response); err == nil {
+            t.Fatalf("%s: parsed as %+v", test.name, result)
+        }
+    }
+}
+
+// A response only counts for the question that was asked
+func TestParseResponseQuestion(t *testing.T) {
+
+    query, err := newQuery("parsed.example", DNS_TYPE_A)
+    if (err != nil) {
+        t.Fatalf("query: %v", err)
+    }
+
+    other, _ := newQuery("other.example", DNS_TYPE_A)
+    aaaa, _ := newQuery("parsed.example", DNS_TYPE_AAAA)
+    upper, _ := newQuery("PARSED.Example", DNS_TYPE_A)
+
+    var ip net.IP = net.ParseIP("192.0.2.60").To4()
+
+    var cases = []struct {
+        name			string
+        response		[]byte
+        valid		bool
+    }{
+        { "same question", buildResponse(query, reply{ ips : []net.IP{ ip }, ttl : 300 }, 0), true },
+        { "name case", buildResponse(upper, reply{ ips : []net.IP{ ip }, ttl : 300 }, 0), true },
+        { "other name", buildResponse(other, reply{ ips : []net.IP{ ip }, ttl : 300 }, 0), false },
+        { "other type", buildResponse(aaaa, reply{ ips : []net.IP{ ip }, ttl : 300 }, 0), false },
+        { "two questions", append(buildResponse(query, reply{}, 0), query[DNS_HEADER_SIZE:]...), false },
+        { "no question", buildRecords(query, false), false },
+    }
+
+    // The ID of the query, the question of the case
+    for index := range cases {
+        cases[index].response[0], cases[index].response[1] = query[0], query[1]
+    }
+    cases[4].response[5] = 2
+
+    for _, test := range cases {
+        result, err := parseResponse(query, test.response)
+        if (test.valid && ((err != nil) || (len(result.ips) != 1))) {
+            t.Fatalf("%s: %+v %v", test.name, result, err)
+        }
+        if (!test.valid && (err == nil)) {
+            t.Fatalf("%s: parsed as %+v", test.name, result)
+        }
+    }
+
+    // An error without the question is still an error
+    failure := buildRecords(query, false)
+    failure[3] |= DNS_RCODE_SERVFAIL
+    if result, err := parseResponse(query, failure); err != nil || result.rcode != DNS_RCODE_SERVFAIL {
+        t.Fatalf("SERVFAIL without question: %+v %v", result, err)
+    }
+}
+
+// Only the addresses along the CNAME chain from the queried name count
+func TestParseResponseChain(t *testing.T) {
+
+    query, err := newQuery("www.example", DNS_TYPE_A)
+    if (err != nil) {
+        t.Fatalf("query: %v", err)
+    }
+
+    var cases = []struct {
+        name			string
+        records		[]testRecord
+        ips			[]string
+        ttl			uint32
+    }{
+        { "direct", []testRecord{
+            { "www.example", DNS_TYPE_A, 300, "192.0.2.1" },
+          }, []string{ "192.0.2.1" }, 300 },
+        { "chain", []testRecord{
+            { "www.example", DNS_TYPE_CNAME, 60, "edge.example" },
+            { "edge.example", DNS_TYPE_CNAME, 600, "host.cdn.example" },
+            { "host.cdn.example", DNS_TYPE_A, 300, "192.0.2.2" },
+          }, []string{ "192.0.2.2" }, 60 },
+        { "chain out of order", []testRecord{
+            { "host.cdn.example", DNS_TYPE_A, 300, "192.0.2.2" },
+            { "edge.example", DNS_TYPE_CNAME, 600, "host.cdn.example" },
+            { "www.example", DNS_TYPE_CNAME, 900, "edge.example" },
+          }, []string{ "192.0.2.2" }, 300 },
+        { "unrelated address", []testRecord{
+            { "www.example", DNS_TYPE_A, 300, "192.0.2.1" },
+            { "bank.example", DNS_TYPE_A, 300, "198.51.100.1" },
+          }, []string{ "192.0.2.1" }, 300 },
+        { "address off the chain", []testRecord{
+            { "www.example", DNS_TYPE_CNAME, 300, "edge.example" },
+            { "www.example", DNS_TYPE_A, 300, "198.51.100.1" },
+            { "edge.example", DNS_TYPE_A, 300, "192.0.2.3" },
+          }, []string{ "198.51.100.1", "192.0.2.3" }, 300 },
+        { "other type", []testRecord{
+            { "www.example", DNS_TYPE_AAAA, 300, "2001:db8::1" },
+          }, nil, 0 },
+        { "broken chain", []testRecord{
+            { "www.example", DNS_TYPE_CNAME, 300, "edge.example" },
+            { "elsewhere.example", DNS_TYPE_A, 300, "198.51.100.1" },
+          }, nil, 0 },
+        { "loop", []testRecord{
+            { "www.example", DNS_TYPE_CNAME, 300, "edge.example" },
+            { "edge.example", DNS_TYPE_CNAME, 300, "www.example" },
+          }, nil, 0 },
+        { "owner case", []testRecord{
+            { "WWW.Example", DNS_TYPE_A, 300, "192.0.2.1" },
+          }, []string{ "192.0.2.1" }, 300 },
+    }
+
+    for _, test := range cases {
+        result, err := parseResponse(query, buildRecords(query, true, test.records...))
+        if (err != nil) {
+            t.Fatalf("%s: %v", test.name, err)
+        }
+
+        var ips []string
+        for _, ip := range result.ips {
+            ips = append(ips, ip.String())
+        }
+        if ((strings.Join(ips, " ") != strings.Join(test.ips, " ")) || (result.ttl != test.ttl)) {
+            t.Fatalf("%s: addresses %v ttl %d, want %v ttl %d", test.name, ips, result.ttl, test.ips, test.ttl)
+        }
+    }
+}
+
+/*----------------------------------------------------------
+    Helpers
+-----------------------------------------------------------*/
+
+func testResolver(t *testing.T, conf *config.ResolverConf) (*Resolver) {
+
+    resolver, err := New(conf)
+    if (err != nil) {
+        t.Fatalf("resolver: %v", err)
+    }
+
+    return resolver
+}
+
+func key(transport string, name string, qtype uint16) (string) {
+    return transport + " " + name + " " + strconv.Itoa(int(qtype))
+}
+
+// The name and type of the question of query
+func question(query []byte) (string, uint16, error) {
+
+    if (len(query) < DNS_HEADER_SIZE + 5) {
+        return "", 0, errMalformed
+    }
+
+    var labels []string
+    var offset int = DNS_HEADER_SIZE
+
+    for (offset < len(query)) && (query[offset] != 0) {
+        var length int = int(query[offset])
+        if (offset + 1 + length > len(query)) {
+            return "", 0, errMalformed
+        }
+        labels = append(labels, string(query[offset + 1:offset + 1 + length]))
+        offset += 1 + length
+    }
+
+    if (offset + 5 > len(query)) {
+        return "", 0, errMalformed
+    }
+
+    return strings.Join(labels, "."), uint16At(query, offset + 1), nil
+}
+
+// The response to query: the question, one record per address pointing
+// back to the question's name, then the SOA
+func buildResponse(query []byte, answer reply, flags int) ([]byte) {
+
+    flags |= DNS_FLAG_RESPONSE | DNS_FLAG_RECURSION | 0x0080 | answer.rcode
+
+    var authorities int
+    if (answer.soa != 0) {
+        authorities = 1
+    }
+
+    var response []byte = []byte{ query[0], query[1], byte(flags >> 8), byte(flags & 0xFF),
+                                  0, 1,
+                                  byte(len(answer.ips) >> 8), byte(len(answer.ips) & 0xFF),
+                                  0, byte(authorities),
+                                  0, 0 }
+
+    response = append(response, query[DNS_HEADER_SIZE:]...)
+
+    for _, ip := range answer.ips {
+        var rtype uint16 = DNS_TYPE_A
+        if (len(ip) == net.IPv6len) {
+            rtype = DNS_TYPE_AAAA
+        }
+        response = append(response, 0xC0, DNS_HEADER_SIZE)
+        response = appendUint16(response, rtype, DNS_CLASS_IN)
+        response = appendUint32(response, answer.ttl)
+        response = appendUint16(response, uint16(len(ip)))
+        response = append(response, ip...)
+    }
+
+    if (answer.soa != 0) {
+        response = append(response, 0xC0, DNS_HEADER_SIZE)
+        response = appendUint16(response, DNS_TYPE_SOA, DNS_CLASS_IN)
+        response = appendUint32(response, answer.soa)
+        // MNAME and RNAME at the root, SERIAL REFRESH RETRY EXPIRE MINIMUM
+        response = appendUint16(response, 2 + 20)
+        response = append(response, 0, 0)
+        response = appendUint32(response, 1, 3600, 600, 86400, answer.soa)
+    }
+
+    return response
+}
+
+func appendUint16(data []byte, values ...uint16) ([]byte) {
+
+    for _, value := range values {
+        data = append(data, byte(value >> 8), byte(value & 0xFF))
+    }
+
+    return data
+}
+
+func appendUint32(data []byte, values ...uint32) ([]byte) {
+
+    for _, value := range values {
+        data = append(data, byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value))
+    }
+
+    return data
+}
+
+// A record of buildRecords, value is an address or a canonical name
+type testRecord struct {
+        name			string
+        rtype		uint16
+        ttl			uint32
+        value		string
+}
+
+// A response to query with records in the answer section, the question
+// echoed when withQuestion. Names are written out, not compressed,
+// apart from the canonical names pointing back to the question.
+func buildRecords(query []byte, withQuestion bool, records ...testRecord) ([]byte) {
+
+    var questions byte
+    if (withQuestion) {
+        questions = 1
+    }
+
+    var response []byte = []byte{ query[0], query[1], byte((DNS_FLAG_RESPONSE | DNS_FLAG_RECURSION | 0x0080) >> 8), 0x80,
+                                  0, questions,
+                                  0, byte(len(records)),
+                                  0, 0,
+                                  0, 0 }
+
+    if (withQuestion) {
+        response = append(response, query[DNS_HEADER_SIZE:]...)
+    }
+
+    for _, record := range records {
+        response = appendName(response, record.name)
+        response = appendUint16(response, record.rtype, DNS_CLASS_IN)
+        response = appendUint32(response, record.ttl)
+
+        var rdata []byte
+        if (record.rtype == DNS_TYPE_CNAME) {
+            rdata = appendName(nil, record.value)
+        } else if ip := net.ParseIP(record.value); ip.To4() != nil {
+            rdata = ip.To4()
+        } else {
+            rdata = ip.To16()
+        }
+
+        response = appendUint16(response, uint16(len(rdata)))
+        response = append(response, rdata...)
+    }
+
+    return response
+}
+
+func appendName(message []byte, name string) ([]byte) {
+
+    for _, label := range strings.Split(name, ".") {
+        message = append(message, byte(len(label)))
+        message = append(message, label...)
+    }
+
+    return append(message, 0)
+}
@@ -0,0 +1,196 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package resolver
+
+import (
+        "bytes"
+        "crypto/tls"
+        "errors"
+        "io"
+        "io/ioutil"
+        "net"
+        "net/http"
+        "time"
+)
+
+// Largest DNS message, over TCP
+const DNS_MAX_MESSAGE = 65535
+
+// Classic DNS over UDP has no EDNS0 here, answers are at most 512 bytes
+const DNS_MAX_UDP_MESSAGE = 512
+
+// A transport sends a query to the upstream server and returns the
+// raw response
+type transport interface {
+    Exchange (query []byte) ([]byte, error)
+    Address () (string)
+}
+
+// Plain DNS over UDP, a truncated answer is retried over TCP
+type udpTransport struct {
+        address		string
+        timeout		time.Duration
+}
+
+// Plain DNS over TCP, or DNS over TLS (RFC 7858) when tls is set
+type streamTransport struct {
+        address		string
+        timeout		time.Duration
+        tls			*tls.Config
+}
+
+// DNS over HTTPS (RFC 8484), POST with an application/dns-message body
+type httpsTransport struct {
+        url			string
+        client		*http.Client
+}
+
+/*----------------------------------------------------------
+    udpTransport Implementation
+-----------------------------------------------------------*/
+func (transport *udpTransport) Address() (string) {
+    return transport.address
+}
+
+func (transport *udpTransport) Exchange(query []byte) ([]byte, error) {
+
+    conn, err := net.DialTimeout("udp", transport.address, transport.timeout)
+    if (err != nil) {
+        return nil, err
+    }
+    defer conn.Close()
+
+    conn.SetDeadline(time.Now().Add(transport.timeout))
+
+    if _, err = conn.Write(query); err != nil {
+        return nil, err
+    }
+
+    var buffer []byte = make([]byte, DNS_MAX_UDP_MESSAGE)
+
+    // Skip anything not answering this query, it may be spoofed
+    for {
+        count, err := conn.Read(buffer)
+        if (err != nil) {
+            return nil, err
+        }
+
+        if ((count < DNS_HEADER_SIZE) || (buffer[0] != query[0]) || (buffer[1] != query[1])) {
+            continue
+        }
+
+        if ((int(uint16At(buffer, 2)) & DNS_FLAG_TRUNCATED) != 0) {
+            stream := &streamTransport{ address : transport.address, timeout : transport.timeout }
+            return stream.Exchange(query)
+        }
+
+        return buffer[:count], nil
+    }
+}
+
+/*----------------------------------------------------------
+    streamTransport Implementation
+-----------------------------------------------------------*/
+func (transport *streamTransport) Address() (string) {
+    return transport.address
+}
+
+/* RFC 1035
+4.2.2. TCP usage
+
+   The message is prefixed with a two byte length field which gives the
+   message length, excluding the two byte length field.
+*/
+func (transport *streamTransport) Exchange(query []byte) ([]byte, error) {
+
+    var dialer *net.Dialer = &net.Dialer{ Timeout : transport.timeout }
+    var conn net.Conn
+    var err error
+
+    if (transport.tls != nil) {
+        conn, err = tls.DialWithDialer(dialer, "tcp", transport.address, transport.tls)
+    } else {
+        conn, err = dialer.Dial("tcp", transport.address)
+    }
+
+    if (err != nil) {
+        return nil, err
+    }
+    defer conn.Close()
+
+    conn.SetDeadline(time.Now().Add(transport.timeout))
+
+    var request []byte = append([]byte{ byte(len(query) >> 8), byte(len(query) & 0xFF) }, query...)
+    if _, err = conn.Write(request); err != nil {
+        return nil, err
+    }
+
+    var length []byte = make([]byte, 2)
+    if _, err = io.ReadFull(conn, length); err != nil {
+        return nil, err
+    }
+
+    var response []byte = make([]byte, int(uint16At(length, 0)))
+    if _, err = io.ReadFull(conn, response); err != nil {
+        return nil, err
+    }
+
+    return response, nil
+}
+
+/*----------------------------------------------------------
+    httpsTransport Implementation
+-----------------------------------------------------------*/
+func (transport *httpsTransport) Address() (string) {
+    return transport.url
+}
+
+/* RFC 8484
+4.1.  The HTTP Request
+
+   In order to maximize HTTP cache friendliness, DoH clients using media
+   formats that include the ID field from the DNS message header, such
+   as "application/dns-message", SHOULD use a DNS ID of 0 in every DNS
+   request.
+*/
+func (transport *httpsTransport) Exchange(query []byte) ([]byte, error) {
+
+    var body []byte = append([]byte{ 0x00, 0x00 }, query[2:]...)
+
+    request, err := http.NewRequest(http.MethodPost, transport.url, bytes.NewReader(body))
+    if (err != nil) {
+        return nil, err
+    }
+
+    request.Header.Set("Content-Type", "application/dns-message")
+    request.Header.Set("Accept", "application/dns-message")
+
+    response, err := transport.client.Do(request)
+    if (err != nil) {
+        return nil, err
+    }
+    defer response.Body.Close()
+
+    if (response.StatusCode != http.StatusOK) {
+        return nil, errors.New("DNS over HTTPS failed: " + response.Status)
+    }
+
+    message, err := ioutil.ReadAll(io.LimitReader(response.Body, DNS_MAX_MESSAGE))
+    if (err != nil) {
+        return nil, err
+    }
+
+    if (len(message) < DNS_HEADER_SIZE) {
+        return nil, errMalformed
+    }
+
+    // Put the query ID back for the response check
+    message[0], message[1] = query[0], query[1]
+
+    return message, nil
+}
@@ -8,11 +8,19 @@
 package session
 
 import (
+        "net"
+        "strconv"
         "socks"
+        "socks/acl"
+        "socks/access"
+        "socks/command"
+        "socks/limit"
+        "socks/quota"
         "socks/log"
         "socks/context"
         "socks/handshake"
         "socks/request"
+        "socks/upstream"
 )
 
 type Session interface {
@@ -66,9 +74,89 @@ func createSessionV4(contxt *context.Context) (*SessionV4) {
 }
 
 func (session *SessionV4) Start() (error){
+    
+    // Socks V4 has no handshake, keep the same flow as V5 though
+    err := handshake.New(session.context).Handshake()
+    
+    // Is there any error?
+    if ( err != nil) {
+        session.reponse(socks.SOCKS_V4_STATUS_REJECTED)
+        session.context.Record().End(access.REASON_HANDSHAKE, err)
+        log.Errorf("Handshake failed, error: %s\n", err.Error())
+        return err
+    }
+    
+    // The request has its own time limit
+    session.context.SetTimeout(session.context.Config().Timeouts.RequestTimeout())
+
+    // Accept the requests
+    request := request.New(session.context)
+    status, err := request.Start()
+    if (status == false) {
+        
+        // A fresh time limit to send the reply
+        session.context.SetTimeout(session.context.Config().Timeouts.RequestTimeout())
+        
+        // Request rejected or failed
+        session.reponse(socks.SOCKS_V4_STATUS_REJECTED)
+        session.context.Record().End(access.REASON_REQUEST, err)
+        log.Errorf("Process Request failed, error: %s\n", err.Error())
+        return err 
+    }
+    
+    describe(session.context, request)
+    
+    // One more session of the user
+    err = limit.AdmitUser(&session.context.Config().Limits, session.context.Username())
+    if (err != nil) {
+        if (session.context.Config().Limits.Reply) {
+            session.reponse(socks.SOCKS_V4_STATUS_REJECTED)
+        }
+        session.context.Record().End(access.REASON_REFUSED, err)
+        log.Errorf("Request refused, error: %s\n", err.Error())
+        return err
+    }
+    defer limit.ReleaseUser(session.context.Username())
+    
+    // Users over quota are refused
+    err = quota.Check(&session.context.Config().Quota, session.context.Username())
+    if (err != nil) {
+        session.reponse(socks.SOCKS_V4_STATUS_REJECTED)
+        session.context.Record().End(access.REASON_QUOTA, err)
+        log.Errorf("Request refused, error: %s\n", err.Error())
+        return err
+    }
+    
+    // Check the request against the ACL
+    err = authorize(session.context, request)
+    if (err != nil) {
+        session.reponse(socks.SOCKS_V4_STATUS_REJECTED)
+        session.context.Record().End(denyReason(err), err)
+        log.Errorf("Request denied, error: %s\n", err.Error())
+        return err
+    }
+    
+    // The commands set their own time limits
+    session.context.SetTimeout(0)
+    
+    // Run the command
+    (*request.Command()).Execute()
+    
+    // Done
     return nil
 }
 
+func (session *SessionV4) reponse(statuscode byte) {
+    
+    session.context.Record().Reply = int(statuscode)
+    
+    // Send response back, DSTPORT and DSTIP are ignored.
+    session.context.Writer().WriteByte(socks.SOCKS_V4_REPLY_VERSION)
+    session.context.Writer().WriteByte(statuscode)
+    session.context.Writer().Write([]byte{0, 0, 0, 0, 0, 0})
+    session.context.Writer().Flush()
+}
+
 /*----------------------------------------------------------
     Socks Version 5
 -----------------------------------------------------------*/
@@ -85,23 +173,66 @@ func (session *SessionV5) Start() (error) {
     
     // Is there any error?
     if ( err != nil) {
+        session.context.Record().End(access.REASON_HANDSHAKE, err)
         log.Errorf("Handshake failed, error: %s\n", err.Error())
         return err
     }
         
+    // The request has its own time limit
+    session.context.SetTimeout(session.context.Config().Timeouts.RequestTimeout())
+
     // Accept the requests
     request := request.New(session.context)
     status, err := request.Start()
     if (status == false) {
         
+        // A fresh time limit to send the reply
+        session.context.SetTimeout(session.context.Config().Timeouts.RequestTimeout())
+        
         // send the error code back to client, really don't 
         // care of the rest of reply data since we are going
         // to close the connection any way.
-        session.reponse(socks.SOCKS_V5_STATUS_SERVER_FAILURE)
+        session.reponse(command.ReplyCode(err))
+        session.context.Record().End(access.REASON_REQUEST, err)
         log.Errorf("Process Request failed, error: %s\n", err.Error())
         return err 
     }
     
+    describe(session.context, request)
+    
+    // One more session of the user
+    err = limit.AdmitUser(&session.context.Config().Limits, session.context.Username())
+    if (err != nil) {
+        if (session.context.Config().Limits.Reply) {
+            session.reponse(command.ReplyCode(err))
+        }
+        session.context.Record().End(access.REASON_REFUSED, err)
+        log.Errorf("Request refused, error: %s\n", err.Error())
+        return err
+    }
+    defer limit.ReleaseUser(session.context.Username())
+    
+    // Users over quota are refused
+    err = quota.Check(&session.context.Config().Quota, session.context.Username())
+    if (err != nil) {
+        session.reponse(command.ReplyCode(err))
+        session.context.Record().End(access.REASON_QUOTA, err)
+        log.Errorf("Request refused, error: %s\n", err.Error())
+        return err
+    }
+    
+    // Check the request against the ACL
+    err = authorize(session.context, request)
+    if (err != nil) {
+        session.reponse(command.ReplyCode(err))
+        session.context.Record().End(denyReason(err), err)
+        log.Errorf("Request denied, error: %s\n", err.Error())
+        return err
+    }
+    
+    // The commands set their own time limits
+    session.context.SetTimeout(0)
+    
     // Run the command
     (*request.Command()).Execute()
     
@@ -111,8 +242,76 @@ func (session *SessionV5) Start() (error) {
 
 func (session *SessionV5) reponse(statuscode byte) {
     
-    // Send response back.
+    session.context.Record().Reply = int(statuscode)
+    
+    // Send response back, BND.ADDR and BND.PORT are all zeros.
     session.context.Writer().WriteByte(session.context.Version())
     session.context.Writer().WriteByte(statuscode)
+    session.context.Writer().WriteByte(0x00)
+    session.context.Writer().WriteByte(socks.SOCKS_V5_ATYP_IP4)
+    session.context.Writer().Write([]byte{0, 0, 0, 0, 0, 0})
     session.context.Writer().Flush()
-}
\ No newline at end of file
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+
+// Evaluate the request against the ACL, the matching rule is recorded
+// in the context. A domain name the ACL can't decide on its own is
+// resolved first, whether the server connects to it or a parent proxy
+// does.
+func authorize(contxt *context.Context, req request.Request) (error) {
+    
+    var rules *acl.Acl = acl.Get(contxt.Config().AclProfile(contxt.Listener().Acl))
+    var request *acl.Request = acl.NewRequest(contxt, req.CommandIndex(), req.Address())
+    
+    allowed, rule, decided := rules.Evaluate(request)
+    
+    if (!decided) {
+        ips, err := upstream.Resolve(contxt.Config(), request.Host)
+        if (err != nil) {
+            return err
+        }
+        allowed, rule = rules.EvaluateAddresses(request, ips)
+    }
+    
+    contxt.SetRule(rule)
+    
+    if (!allowed) {
+        var name string
+        if (rule != nil) {
+            name = rule.Name
+        }
+        return &acl.DeniedError{ Rule : name }
+    }
+    
+    return nil
+}
+
+// Why a request authorize refused ended
+func denyReason(err error) (string) {
+    
+    if _, ok := err.(*acl.DeniedError); ok {
+        return access.REASON_DENIED
+    }
+    
+    return access.REASON_FAILED
+}
+
+// Record the command and the requested destination for the access log
+func describe(contxt *context.Context, req request.Request) {
+    
+    for name, command := range acl.COMMAND_NAMES {
+        if (command == req.CommandIndex()) {
+            contxt.Record().Command = name
+        }
+    }
+    
+    contxt.Record().Destination = net.JoinHostPort(req.Address().DstAddr(), strconv.Itoa(req.Address().DstPort()))
+    
+    // Socks V4 only has the USERID the client claims
+    if v4, ok := req.(*request.RequestV4); ok && (len(contxt.Username()) == 0) {
+        contxt.Record().User = v4.UserId()
+    }
+}
@@ -0,0 +1,424 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package shaping
+
+import (
+        "errors"
+        "io"
+        "net"
+        "sort"
+        "sync"
+        "time"
+        "socks/log"
+        "socks/config"
+        "socks/context"
+)
+
+// Largest read charged at once, sessions sharing a bucket take turns
+// by chunks of at most that size
+const SHAPING_CHUNK = 16 * 1024
+
+// A token bucket of rate bytes per second, holding at most one second
+// of traffic. A take may run the bucket into debt, the taker then waits
+// until the debt is paid back. The takers are served in turn that way,
+// a later one waits behind the debt of the earlier ones.
+type Bucket struct {
+        rate			float64
+        tokens		float64
+        refilled		time.Time
+        mutex		sync.Mutex
+}
+
+// The buckets one direction of a session is held to, the slowest one
+// sets the pace
+type Limiter []*Bucket
+
+// An upload and a download bucket, shared by the sessions holding them
+type pair struct {
+        upload		*Bucket
+        download		*Bucket
+        sessions		int
+}
+
+// What a shared pair of buckets belongs to
+type key struct {
+        user			string
+        client		string
+        rule			*config.AclRule
+}
+
+type network struct {
+        cidr			*net.IPNet
+        rate			config.RateConf
+}
+
+type Shaper struct {
+        global		pair
+        users		map[string]config.RateConf
+        clients		[]*network
+        shared		map[key]*pair
+        carried		map[key]*pair
+        mutex		sync.Mutex
+}
+
+// The buckets of one session, given back with Close
+type Session struct {
+        shaper		*Shaper
+        keys			[]key
+        Upload		Limiter
+        Download		Limiter
+}
+
+// Compiled shapers, keyed by their config
+var shapers		map[*config.ShapingConf]*Shaper = make(map[*config.ShapingConf]*Shaper)
+var shapersLock	sync.Mutex
+
+// The config of the current shaper, the next one takes over its buckets
+var current		*config.ShapingConf
+
+/*----------------------------------------------------------
+    Create a Shaper
+-----------------------------------------------------------*/
+
+// Returns the compiled Shaper of the config. A config that doesn't
+// compile shapes nothing.
+func Get(conf *config.ShapingConf) (*Shaper) {
+
+    shapersLock.Lock()
+    defer shapersLock.Unlock()
+
+    shaper := shapers[conf]
+    if (shaper != nil) {
+        return shaper
+    }
+
+    shaper = compile(conf)
+    shapers[conf] = shaper
+
+    // The first config is the current one until a reload
+    if (current == nil) {
+        current = conf
+    }
+
+    return shaper
+}
+
+// Swap is called when a reload makes conf the current config. Its
+// shaper takes over the buckets of the previous one, at the new rates,
+// so that a reload doesn't hand out a fresh allowance.
+func Swap(conf *config.ShapingConf) {
+
+    shapersLock.Lock()
+    defer shapersLock.Unlock()
+
+    var previous *Shaper = shapers[current]
+
+    current = conf
+
+    if ((shapers[conf] == nil) && (previous != nil)) {
+        shaper := compile(conf)
+        shaper.inherit(previous)
+        shapers[conf] = shaper
+    }
+}
+
+// Drop forgets the compiled shaper of conf, it is called once the last
+// session of a config replaced by a reload is over
+func Drop(conf *config.ShapingConf) {
+
+    shapersLock.Lock()
+    defer shapersLock.Unlock()
+
+    delete(shapers, conf)
+}
+
+func New(conf *config.ShapingConf) (*Shaper, error) {
+
+    if err := check(conf.Global); err != nil {
+        return nil, errors.New("Global: " + err.Error())
+    }
+
+    var shaper *Shaper = &Shaper{ global		: pair{ upload : NewBucket(conf.Global.Upload), download : NewBucket(conf.Global.Download) },
+                                  users		: conf.Users,
+                                  shared		: make(map[key]*pair),
+                                  carried		: make(map[key]*pair) }
+
+    for user, rate := range conf.Users {
+        if err := check(rate); err != nil {
+            return nil, errors.New("User '" + user + "': " + err.Error())
+        }
+    }
+
+    for cidr, rate := range conf.Clients {
+        _, ipNet, err := net.ParseCIDR(cidr)
+        if (err != nil) {
+            return nil, errors.New("Malformed client CIDR: '" + cidr + "'")
+        }
+        if err = check(rate); err != nil {
+            return nil, errors.New("Client '" + cidr + "': " + err.Error())
+        }
+        shaper.clients = append(shaper.clients, &network{ cidr : ipNet, rate : rate })
+    }
+
+    // The most specific network first
+    sort.Slice(shaper.clients, func(i int, j int) (bool) {
+        iOnes, _ := shaper.clients[i].cidr.Mask.Size()
+        jOnes, _ := shaper.clients[j].cidr.Mask.Size()
+        return iOnes > jOnes
+    })
+
+    return shaper, nil
+}
+
+/*----------------------------------------------------------
+    Shaper Implementation
+-----------------------------------------------------------*/
+
+// Open takes the buckets of a session: the global ones, the user's, the
+// client address' and the ones of the ACL rule that allowed it
+func (shaper *Shaper) Open(contxt *context.Context) (*Session) {
+
+    var session *Session = &Session{ shaper : shaper }
+
+    session.add(&shaper.global)
+
+    shaper.mutex.Lock()
+    defer shaper.mutex.Unlock()
+
+    if user := contxt.Username(); len(user) != 0 {
+        if rate, found := shaper.users[user]; found {
+            session.share(key{ user : user }, rate)
+        }
+    }
+
+    if addr, ok := (*contxt.Connection()).RemoteAddr().(*net.TCPAddr); ok {
+        for _, network := range shaper.clients {
+            if (network.cidr.Contains(addr.IP)) {
+                session.share(key{ client : addr.IP.String() }, network.rate)
+                break
+            }
+        }
+    }
+
+    if rule := contxt.Rule(); (rule != nil) && ((rule.Upload != 0) || (rule.Download != 0)) {
+        session.share(key{ rule : rule }, config.RateConf{ Upload : rule.Upload, Download : rule.Download })
+    }
+
+    return session
+}
+
+// The shared pair of k, created with rate by its first session. The
+// shaper's lock is held.
+func (shaper *Shaper) take(k key, rate config.RateConf) (*pair) {
+
+    shared := shaper.shared[k]
+    if (shared == nil) {
+        shared = &pair{ upload : NewBucket(rate.Upload), download : NewBucket(rate.Download) }
+        if carried := shaper.carried[k]; carried != nil {
+            shared.upload, shared.download = carry(carried.upload, shared.upload), carry(carried.download, shared.download)
+            delete(shaper.carried, k)
+        }
+        shaper.shared[k] = shared
+    }
+
+    shared.sessions++
+
+    return shared
+}
+
+/*----------------------------------------------------------
+    Session Implementation
+-----------------------------------------------------------*/
+
+// Close gives the shared buckets back, the last session of a pair drops it
+func (session *Session) Close() {
+
+    session.shaper.mutex.Lock()
+    defer session.shaper.mutex.Unlock()
+
+    for _, k := range session.keys {
+        shared := session.shaper.shared[k]
+        if (shared == nil) {
+            continue
+        }
+        shared.sessions--
+        if (shared.sessions <= 0) {
+            delete(session.shaper.shared, k)
+        }
+    }
+
+    session.keys = nil
+}
+
+func (session *Session) add(shared *pair) {
+
+    if (shared.upload != nil) {
+        session.Upload = append(session.Upload, shared.upload)
+    }
+
+    if (shared.download != nil) {
+        session.Download = append(session.Download, shared.download)
+    }
+}
+
+// Add the shared pair of k, the shaper's lock is held
+func (session *Session) share(k key, rate config.RateConf) {
+
+    session.add(session.shaper.take(k, rate))
+    session.keys = append(session.keys, k)
+}
+
+/*----------------------------------------------------------
+    Bucket Implementation
+-----------------------------------------------------------*/
+
+// A bucket of rate bytes per second, nil when rate is 0 (no limit)
+func NewBucket(rate int64) (*Bucket) {
+
+    if (rate <= 0) {
+        return nil
+    }
+
+    return &Bucket{ rate : float64(rate), tokens : float64(rate), refilled : time.Now() }
+}
+
+// Take count bytes, returns how long to wait before sending them
+func (bucket *Bucket) Take(count int) (time.Duration) {
+
+    bucket.mutex.Lock()
+    defer bucket.mutex.Unlock()
+
+    var now time.Time = time.Now()
+
+    bucket.tokens += now.Sub(bucket.refilled).Seconds() * bucket.rate
+    if (bucket.tokens > bucket.rate) {
+        bucket.tokens = bucket.rate
+    }
+    bucket.refilled = now
+
+    bucket.tokens -= float64(count)
+    if (bucket.tokens >= 0) {
+        return 0
+    }
+
+    return time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+}
+
+/*----------------------------------------------------------
+    Limiter Implementation
+-----------------------------------------------------------*/
+
+// Wait charges count bytes to all the buckets, and waits for the slowest
+func (limiter Limiter) Wait(count int) {
+
+    var delay time.Duration
+
+    for _, bucket := range limiter {
+        if wait := bucket.Take(count); wait > delay {
+            delay = wait
+        }
+    }
+
+    if (delay > 0) {
+        time.Sleep(delay)
+    }
+}
+
+// Reader returns src held to the limiter, src itself when there is no
+// bucket so that the copy can still be done by the kernel
+func (limiter Limiter) Reader(src io.Reader) (io.Reader) {
+
+    if (len(limiter) == 0) {
+        return src
+    }
+
+    return &reader{ src : src, limiter : limiter }
+}
+
+type reader struct {
+        src			io.Reader
+        limiter		Limiter
+}
+
+// Reads at most a chunk, and returns once it may be sent on
+func (reader *reader) Read(data []byte) (int, error) {
+
+    if (len(data) > SHAPING_CHUNK) {
+        data = data[:SHAPING_CHUNK]
+    }
+
+    count, err := reader.src.Read(data)
+    if (count > 0) {
+        reader.limiter.Wait(count)
+    }
+
+    return count, err
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+
+// The shaper of conf, or one shaping nothing when it doesn't compile.
+// The shapers' lock is held.
+func compile(conf *config.ShapingConf) (*Shaper) {
+
+    shaper, err := New(conf)
+    if (err != nil) {
+        log.Errorf("Invalid shaping config, bandwidth is not limited: %s\n", err.Error())
+        shaper, _ = New(&config.ShapingConf{})
+    }
+
+    return shaper
+}
+
+// Take over the buckets of previous: the global ones, and those of the
+// users and client addresses with sessions running. The pairs of an ACL
+// rule are not, the rules of the new config are others.
+func (shaper *Shaper) inherit(previous *Shaper) {
+
+    shaper.global.upload = carry(previous.global.upload, shaper.global.upload)
+    shaper.global.download = carry(previous.global.download, shaper.global.download)
+
+    previous.mutex.Lock()
+    defer previous.mutex.Unlock()
+
+    for k, shared := range previous.shared {
+        if (k.rule == nil) {
+            shaper.carried[k] = &pair{ upload : shared.upload, download : shared.download }
+        }
+    }
+}
+
+// The bucket to go on with instead of fresh, the previous one at the new
+// rate so that its debt and the sessions holding it carry over. No bucket
+// when the new config doesn't limit.
+func carry(bucket *Bucket, fresh *Bucket) (*Bucket) {
+
+    if ((bucket == nil) || (fresh == nil)) {
+        return fresh
+    }
+
+    bucket.mutex.Lock()
+    bucket.rate = fresh.rate
+    if (bucket.tokens > bucket.rate) {
+        bucket.tokens = bucket.rate
+    }
+    bucket.mutex.Unlock()
+
+    return bucket
+}
+
+func check(rate config.RateConf) (error) {
+
+    if ((rate.Upload < 0) || (rate.Download < 0)) {
+        return errors.New("upload and download must not be negative")
+    }
+
+    return nil
+}
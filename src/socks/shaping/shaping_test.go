@@ -0,0 +1,256 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package shaping
+
+import (
+        "net"
+        "testing"
+        "time"
+        "socks"
+        "socks/config"
+        "socks/context"
+)
+
+// How far a wait may be off, the time the test itself takes
+const TEST_SLACK = 50 * time.Millisecond
+
+func TestBucketTake(t *testing.T) {
+
+    var cases = []struct {
+        name			string
+        rate			int64
+        takes		[]int
+        // The wait of the last take
+        wait			time.Duration
+    }{
+        { "within the rate", 1000, []int{ 400, 600 }, 0 },
+        { "one second of debt", 1000, []int{ 1000, 1000 }, time.Second },
+        { "debt adds up", 1000, []int{ 1000, 500, 500 }, time.Second },
+        { "large take", 1000, []int{ 3000 }, 2 * time.Second },
+        { "fast bucket", 1000000, []int{ 1000000, 250000 }, 250 * time.Millisecond },
+    }
+
+    for _, test := range cases {
+
+        var bucket *Bucket = NewBucket(test.rate)
+        var wait time.Duration
+
+        for _, count := range test.takes {
+            wait = bucket.Take(count)
+        }
+
+        if ((wait > test.wait) || (wait < test.wait - TEST_SLACK)) {
+            t.Errorf("%s: wait %v, want %v", test.name, wait, test.wait)
+        }
+    }
+
+    if (NewBucket(0) != nil) {
+        t.Errorf("bucket without a rate")
+    }
+}
+
+// An empty bucket fills up again at its rate, one second of it at most
+func TestBucketRefill(t *testing.T) {
+
+    var bucket *Bucket = NewBucket(10000)
+    bucket.Take(10000)
+
+    time.Sleep(100 * time.Millisecond)
+    if wait := bucket.Take(900); wait != 0 {
+        t.Fatalf("not refilled: wait %v", wait)
+    }
+
+    bucket = NewBucket(10000)
+    time.Sleep(100 * time.Millisecond)
+    if wait := bucket.Take(11000); wait < 100 * time.Millisecond - TEST_SLACK {
+        t.Fatalf("filled over the rate: wait %v", wait)
+    }
+}
+
+// A session holds the buckets of every rate that applies to it
+func TestOpen(t *testing.T) {
+
+    var rule *config.AclRule = &config.AclRule{ Name : "slow", Upload : 100 }
+    var conf *config.ShapingConf = &config.ShapingConf{
+        Global : config.RateConf{ Upload : 1000000, Download : 1000000 },
+        Users : map[string]config.RateConf{ "alice" : { Upload : 1000, Download : 2000 } },
+        Clients : map[string]config.RateConf{ "127.0.0.0/8" : { Download : 500 }, "127.0.0.1/32" : { Download : 50 } },
+    }
+
+    var cases = []struct {
+        name			string
+        user			string
+        rule			*config.AclRule
+        upload		[]float64
+        download		[]float64
+    }{
+        { "anonymous", "", nil, []float64{ 1000000 }, []float64{ 1000000, 50 } },
+        { "user", "alice", nil, []float64{ 1000000, 1000 }, []float64{ 1000000, 2000, 50 } },
+        { "other user", "bob", nil, []float64{ 1000000 }, []float64{ 1000000, 50 } },
+        { "rule", "", rule, []float64{ 1000000, 100 }, []float64{ 1000000, 50 } },
+    }
+
+    var shaper *Shaper = testShaper(t, conf)
+
+    for _, test := range cases {
+
+        var session *Session = shaper.Open(testContext(t, test.user, test.rule))
+
+        if (!sameRates(session.Upload, test.upload) || !sameRates(session.Download, test.download)) {
+            t.Errorf("%s: upload %v, download %v, want %v and %v", test.name, rates(session.Upload), rates(session.Download), test.upload, test.download)
+        }
+
+        session.Close()
+    }
+}
+
+// The sessions of a user share its buckets, the last one drops them
+func TestShare(t *testing.T) {
+
+    var conf *config.ShapingConf = &config.ShapingConf{ Users : map[string]config.RateConf{ "alice" : { Upload : 1000 } } }
+    var shaper *Shaper = testShaper(t, conf)
+
+    first := shaper.Open(testContext(t, "alice", nil))
+    second := shaper.Open(testContext(t, "alice", nil))
+
+    if ((len(first.Upload) != 1) || (first.Upload[0] != second.Upload[0])) {
+        t.Fatalf("buckets not shared")
+    }
+
+    first.Close()
+    if (len(shaper.shared) != 1) {
+        t.Fatalf("dropped while in use")
+    }
+
+    second.Close()
+    if (len(shaper.shared) != 0) {
+        t.Fatalf("kept after the last session")
+    }
+}
+
+// A reload carries the buckets over at the new rates, with their debt
+func TestSwap(t *testing.T) {
+
+    var before *config.ShapingConf = &config.ShapingConf{ Global : config.RateConf{ Upload : 1000 }, Users : map[string]config.RateConf{ "alice" : { Upload : 1000 } } }
+    var after *config.ShapingConf = &config.ShapingConf{ Global : config.RateConf{ Upload : 2000 }, Users : map[string]config.RateConf{ "alice" : { Upload : 2000 } } }
+    defer Drop(before)
+    defer Drop(after)
+
+    Swap(before)
+    session := Get(before).Open(testContext(t, "alice", nil))
+    defer session.Close()
+
+    // One second of debt at the old rate
+    for _, bucket := range session.Upload {
+        bucket.Take(2000)
+    }
+
+    Swap(after)
+    carried := Get(after).Open(testContext(t, "alice", nil))
+    defer carried.Close()
+
+    if (!sameRates(carried.Upload, []float64{ 2000, 2000 })) {
+        t.Fatalf("rates after the reload: %v", rates(carried.Upload))
+    }
+
+    // The debt is paid at the new rate
+    for index, bucket := range carried.Upload {
+        if wait := bucket.Take(0); (wait > 500 * time.Millisecond) || (wait < 500 * time.Millisecond - TEST_SLACK) {
+            t.Errorf("bucket %d: wait %v after the reload", index, wait)
+        }
+    }
+}
+
+func TestNewErrors(t *testing.T) {
+
+    var cases = []config.ShapingConf{
+        { Global : config.RateConf{ Upload : -1 } },
+        { Users : map[string]config.RateConf{ "alice" : { Download : -1 } } },
+        { Clients : map[string]config.RateConf{ "10.0.0.0/33" : { Download : 1 } } },
+        { Clients : map[string]config.RateConf{ "10.0.0.0/8" : { Upload : -1 } } },
+    }
+
+    for _, conf := range cases {
+        if _, err := New(&conf); err == nil {
+            t.Errorf("%+v compiled", conf)
+        }
+    }
+}
+
+/*----------------------------------------------------------
+    Helpers
+-----------------------------------------------------------*/
+
+func testShaper(t *testing.T, conf *config.ShapingConf) (*Shaper) {
+
+    shaper, err := New(conf)
+    if (err != nil) {
+        t.Fatalf("shaper: %v", err)
+    }
+
+    return shaper
+}
+
+// The context of a session from 127.0.0.1 by user, allowed by rule
+func testContext(t *testing.T, user string, rule *config.AclRule) (*context.Context) {
+
+    listener, err := net.Listen("tcp", "127.0.0.1:0")
+    if (err != nil) {
+        t.Fatalf("listen: %v", err)
+    }
+    defer listener.Close()
+
+    client, err := net.Dial("tcp", listener.Addr().String())
+    if (err != nil) {
+        t.Fatalf("dial: %v", err)
+    }
+    t.Cleanup(func() { client.Close() })
+
+    server, err := listener.Accept()
+    if (err != nil) {
+        t.Fatalf("accept: %v", err)
+    }
+    t.Cleanup(func() { server.Close() })
+
+    client.Write([]byte{ socks.SOCKS_VERSION_V5 })
+
+    contxt, err := context.New(server, &config.Config{}, &config.ListenerConf{})
+    if (err != nil) {
+        t.Fatalf("context: %v", err)
+    }
+    contxt.SetUsername(user)
+    contxt.SetRule(rule)
+
+    return contxt
+}
+
+func rates(limiter Limiter) ([]float64) {
+
+    var rates []float64
+    for _, bucket := range limiter {
+        rates = append(rates, bucket.rate)
+    }
+
+    return rates
+}
+
+func sameRates(limiter Limiter, expected []float64) (bool) {
+
+    var got []float64 = rates(limiter)
+    if (len(got) != len(expected)) {
+        return false
+    }
+
+    for index := range got {
+        if (got[index] != expected[index]) {
+            return false
+        }
+    }
+
+    return true
+}
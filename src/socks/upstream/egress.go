@@ -0,0 +1,248 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package upstream
+
+import (
+        gocontext "context"
+        "errors"
+        "net"
+        "sync"
+        "sync/atomic"
+        "syscall"
+        "socks/log"
+        "socks/config"
+        "socks/context"
+)
+
+// Where outbound connections leave from
+type Egress struct {
+    name			string
+    sources		[]net.IP
+    next			uint32
+    device		string
+    mark			int
+}
+
+type Outbound struct {
+    profiles		map[string]*Egress
+    users		map[string]string
+    fallback		string
+}
+
+// Compiled outbound profiles, keyed by their config
+var outbounds		map[*config.OutboundConf]*Outbound = make(map[*config.OutboundConf]*Outbound)
+var outboundsLock	sync.Mutex
+
+
+/*----------------------------------------------------------
+    Create an Outbound
+-----------------------------------------------------------*/
+
+// Returns the compiled Outbound of the config. A config that doesn't
+// compile has no profile, connections use the default source address.
+func GetOutbound(conf *config.OutboundConf) (*Outbound) {
+
+    outboundsLock.Lock()
+    defer outboundsLock.Unlock()
+
+    outbound := outbounds[conf]
+    if (outbound != nil) {
+        return outbound
+    }
+
+    outbound, err := NewOutbound(conf)
+    if (err != nil) {
+        log.Errorf("Invalid outbound config, egress profiles are ignored: %s\n", err.Error())
+        outbound = &Outbound{ profiles : make(map[string]*Egress) }
+    }
+
+    outbounds[conf] = outbound
+
+    return outbound
+}
+
+// DropOutbound forgets the compiled outbound of conf, like Drop does for
+// the upstreams
+func DropOutbound(conf *config.OutboundConf) {
+
+    outboundsLock.Lock()
+    defer outboundsLock.Unlock()
+
+    delete(outbounds, conf)
+}
+
+func NewOutbound(conf *config.OutboundConf) (*Outbound, error) {
+
+    var outbound *Outbound = &Outbound{ profiles : make(map[string]*Egress), users : conf.Users, fallback : conf.Egress }
+
+    for name, profile := range conf.Profiles {
+        egress, err := NewEgress(name, &profile)
+        if (err != nil) {
+            return nil, err
+        }
+        outbound.profiles[name] = egress
+    }
+
+    if err := outbound.Check(conf.Egress); err != nil {
+        return nil, err
+    }
+
+    for user, name := range conf.Users {
+        if err := outbound.Check(name); err != nil {
+            return nil, errors.New("User '" + user + "': " + err.Error())
+        }
+    }
+
+    return outbound, nil
+}
+
+// An empty name means no profile
+func (outbound *Outbound) Check(name string) (error) {
+
+    if ((len(name) != 0) && (outbound.profiles[name] == nil)) {
+        return errors.New("Unknown egress profile: '" + name + "'")
+    }
+
+    return nil
+}
+
+// The profile of a session, nil for the default source address
+func (outbound *Outbound) Select(contxt *context.Context) (*Egress) {
+
+    var name string = outbound.fallback
+
+    if rule := contxt.Rule(); (rule != nil) && (len(rule.Egress) != 0) {
+        name = rule.Egress
+    } else if profile := outbound.users[contxt.Username()]; len(profile) != 0 {
+        name = profile
+    } else if (len(contxt.Listener().Egress) != 0) {
+        name = contxt.Listener().Egress
+    }
+
+    return outbound.profiles[name]
+}
+
+/*----------------------------------------------------------
+    Egress Implementation
+-----------------------------------------------------------*/
+func NewEgress(name string, conf *config.EgressConf) (*Egress, error) {
+
+    var egress *Egress = &Egress{ name : name, device : conf.Interface, mark : conf.Mark }
+
+    for _, source := range conf.Source {
+        ip := net.ParseIP(source)
+        if (ip == nil) {
+            return nil, errors.New("Egress '" + name + "': malformed source address: '" + source + "'")
+        }
+        egress.sources = append(egress.sources, ip)
+    }
+
+    if (((len(egress.device) != 0) || (egress.mark != 0)) && !SOCKET_OPTIONS) {
+        return nil, errors.New("Egress '" + name + "': interface and mark are not supported on this system")
+    }
+
+    return egress, nil
+}
+
+func (egress *Egress) Name() (string) {
+    return egress.name
+}
+
+// The next source address of the target's family. A nil target takes
+// the next address of any family. Without a pool the kernel picks it.
+func (egress *Egress) Source(target net.IP) (net.IP, error) {
+
+    if ((egress == nil) || (len(egress.sources) == 0)) {
+        return nil, nil
+    }
+
+    var start uint32 = atomic.AddUint32(&egress.next, 1)
+
+    for index := 0; index < len(egress.sources); index++ {
+        source := egress.sources[(int(start) + index) % len(egress.sources)]
+        if ((target == nil) || ((source.To4() != nil) == (target.To4() != nil))) {
+            return source, nil
+        }
+    }
+
+    return nil, errors.New("Egress '" + egress.name + "' has no source address for " + target.String())
+}
+
+// A dialer leaving from the profile, for a connection to target
+func (egress *Egress) Dialer(target net.IP) (*net.Dialer, error) {
+
+    var dialer *net.Dialer = &net.Dialer{}
+
+    if (egress == nil) {
+        return dialer, nil
+    }
+
+    source, err := egress.Source(target)
+    if (err != nil) {
+        return nil, err
+    }
+
+    if (source != nil) {
+        dialer.LocalAddr = &net.TCPAddr{ IP : source }
+    }
+
+    dialer.Control = egress.control
+
+    return dialer, nil
+}
+
+// A UDP socket leaving from the profile
+func (egress *Egress) ListenUDP() (*net.UDPConn, error) {
+
+    if (egress == nil) {
+        return net.ListenUDP("udp", &net.UDPAddr{})
+    }
+
+    source, err := egress.Source(nil)
+    if (err != nil) {
+        return nil, err
+    }
+
+    var address string = ":0"
+    if (source != nil) {
+        address = net.JoinHostPort(source.String(), "0")
+    }
+
+    var listener net.ListenConfig = net.ListenConfig{ Control : egress.control }
+
+    conn, err := listener.ListenPacket(gocontext.Background(), "udp", address)
+    if (err != nil) {
+        return nil, err
+    }
+
+    return conn.(*net.UDPConn), nil
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+
+// Socket options applied before connecting or binding
+func (egress *Egress) control(network string, address string, conn syscall.RawConn) (error) {
+
+    if ((len(egress.device) == 0) && (egress.mark == 0)) {
+        return nil
+    }
+
+    var err error
+
+    controlErr := conn.Control(func(fd uintptr) {
+        err = setSocketOptions(fd, egress.device, egress.mark)
+    })
+
+    if (controlErr != nil) {
+        return controlErr
+    }
+
+    return err
+}
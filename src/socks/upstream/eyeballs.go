@@ -0,0 +1,179 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package upstream
+
+import (
+        gocontext "context"
+        "net"
+        "time"
+)
+
+/* RFC 8305
+   Happy Eyeballs Version 2: Better Connectivity Using Concurrency
+
+   The recommended value for the Connection Attempt Delay is 250 ms.
+   Connection Attempt Delays MUST NOT be less than 10 ms to avoid
+   congestion collapse in the presence of high packet-loss rates.
+*/
+const (
+        ATTEMPT_DELAY		= 250 * time.Millisecond
+        MIN_ATTEMPT_DELAY	= 10 * time.Millisecond
+)
+
+// The outcome of one connection attempt
+type attempt struct {
+        conn			net.Conn
+        err			error
+}
+
+/*----------------------------------------------------------
+    Happy Eyeballs
+-----------------------------------------------------------*/
+
+// The whole dial is bounded by the timeout and the deadline, when there
+// are some
+func (direct *Direct) context() (gocontext.Context, gocontext.CancelFunc) {
+
+    var deadline time.Time = direct.deadline
+
+    if (direct.timeout != 0) {
+        if limit := time.Now().Add(direct.timeout); deadline.IsZero() || limit.Before(deadline) {
+            deadline = limit
+        }
+    }
+
+    if (deadline.IsZero()) {
+        return gocontext.WithCancel(gocontext.Background())
+    }
+
+    return gocontext.WithDeadline(gocontext.Background(), deadline)
+}
+
+/* RFC 8305
+5.  Connection Attempts
+
+   Once the list of addresses has been constructed, the client will
+   attempt to make connections.  In order to avoid unreasonable network
+   load, connection attempts SHOULD NOT be made simultaneously.
+   Instead, one connection attempt to a single address is started first,
+   followed by the others in the list, one at a time.  Starting a new
+   connection attempt does not affect previous attempts, as multiple
+   connection attempts may occur in parallel.  Once one of the
+   connection attempts succeeds, all other connections attempts that
+   have not yet succeeded SHOULD be canceled.
+*/
+
+// A failed attempt starts the next one right away. Both A and AAAA
+// answers are waited for before the first attempt, the resolver asks
+// for them at once and usually answers from its cache.
+func (direct *Direct) race(ctx gocontext.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+
+    ctx, cancel := gocontext.WithCancel(ctx)
+    defer cancel()
+
+    var results chan attempt = make(chan attempt, len(ips))
+    var next int = 0
+    var pending int = 0
+    var err error
+
+    start := func() {
+        var ip net.IP = ips[next]
+        next++
+        pending++
+        go func() {
+            dialer, err := direct.egress.Dialer(ip)
+            if (err != nil) {
+                results <- attempt{ err : err }
+                return
+            }
+            conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+            results <- attempt{ conn : conn, err : err }
+        }()
+    }
+
+    start()
+
+    var timer *time.Timer = time.NewTimer(direct.attemptDelay)
+    defer timer.Stop()
+
+    for (pending > 0) {
+        select {
+            case result := <-results:
+                pending--
+                if (result.err == nil) {
+                    // The losers still connecting are closed when they finish
+                    go discard(results, pending)
+                    return result.conn, nil
+                }
+                err = result.err
+                if (next < len(ips)) {
+                    start()
+                    timer.Reset(direct.attemptDelay)
+                }
+                break
+            case <-timer.C:
+                if (next < len(ips)) {
+                    start()
+                    timer.Reset(direct.attemptDelay)
+                }
+                break
+        }
+    }
+
+    return nil, err
+}
+
+/* RFC 8305
+4.  Sorting Addresses
+
+   The client SHOULD modify the ordered list to interleave address
+   families.  Whichever address family is first in the list should be
+   followed by an address of the other address family; that is, if the
+   first address in the sorted list is IPv6, then the first IPv4 address
+   should be moved up in the list to be second in the list.
+*/
+func sortAddresses(ips []net.IP, preferV4 bool) ([]net.IP) {
+
+    var first, second []net.IP
+
+    for _, ip := range ips {
+        if ((ip.To4() != nil) == preferV4) {
+            first = append(first, ip)
+        } else {
+            second = append(second, ip)
+        }
+    }
+
+    var sorted []net.IP = make([]net.IP, 0, len(ips))
+
+    for index := 0; (index < len(first)) || (index < len(second)); index++ {
+        if (index < len(first)) {
+            sorted = append(sorted, first[index])
+        }
+        if (index < len(second)) {
+            sorted = append(sorted, second[index])
+        }
+    }
+
+    return sorted
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+
+// Close the connections of the attempts still pending
+func discard(results chan attempt, pending int) {
+
+    for ; pending > 0; pending-- {
+        result := <-results
+        if (result.err == nil) {
+            result.conn.Close()
+        }
+    }
+}
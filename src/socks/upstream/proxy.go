@@ -0,0 +1,304 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package upstream
+
+import (
+        "bufio"
+        "encoding/base64"
+        "errors"
+        "fmt"
+        "io"
+        "net"
+        "net/http"
+        "strconv"
+        "socks"
+)
+
+type Socks5Proxy struct {
+        address		string
+        username		string
+        password		string
+}
+
+type Socks4aProxy struct {
+        address		string
+        userid		string
+}
+
+type HttpProxy struct {
+        address		string
+        username		string
+        password		string
+}
+
+// Keeps the bytes buffered while reading a proxy response
+type bufferedConn struct {
+        net.Conn
+        reader		*bufio.Reader
+}
+
+/*----------------------------------------------------------
+    Socks5Proxy Implementation
+-----------------------------------------------------------*/
+func (proxy *Socks5Proxy) Address() (string) {
+    return proxy.address
+}
+
+func (proxy *Socks5Proxy) Connect(conn net.Conn, address string) (net.Conn, error) {
+
+    // Method negotiation, offer user/password only when configured
+    var methods []byte = []byte{ socks.SOCKS_AUTH_NOAUTHENTICATION }
+    if (len(proxy.username) != 0) {
+        methods = []byte{ socks.SOCKS_AUTH_USERPASSWORD }
+    }
+
+    request := append([]byte{ socks.SOCKS_VERSION_V5, byte(len(methods)) }, methods...)
+    if _, err := conn.Write(request); err != nil {
+        return nil, err
+    }
+
+    var reply []byte = make([]byte, 2)
+    if _, err := io.ReadFull(conn, reply); err != nil {
+        return nil, err
+    }
+
+    switch (reply[1]) {
+        case socks.SOCKS_AUTH_NOAUTHENTICATION:
+            break
+        case socks.SOCKS_AUTH_USERPASSWORD:
+            if err := proxy.authenticate(conn); err != nil {
+                return nil, err
+            }
+            break
+        default:
+            return nil, errors.New("No acceptable authentication method")
+    }
+
+    // The request
+    host, port, err := splitAddress(address)
+    if (err != nil) {
+        return nil, err
+    }
+
+    request = []byte{ socks.SOCKS_VERSION_V5, socks.SOCKS_COMMAND_CONNECT, 0x00 }
+
+    if ip := net.ParseIP(host); ip == nil {
+        if (len(host) > 255) {
+            return nil, errors.New("Domain name is too long")
+        }
+        request = append(request, socks.SOCKS_V5_ATYP_FQDN, byte(len(host)))
+        request = append(request, host...)
+    } else if (ip.To4() != nil) {
+        request = append(request, socks.SOCKS_V5_ATYP_IP4)
+        request = append(request, ip.To4()...)
+    } else {
+        request = append(request, socks.SOCKS_V5_ATYP_IP6)
+        request = append(request, ip.To16()...)
+    }
+
+    request = append(request, byte(port >> 8), byte(port & 0xFF))
+
+    if _, err = conn.Write(request); err != nil {
+        return nil, err
+    }
+
+    // VER, REP, RSV, ATYP
+    reply = make([]byte, 4)
+    if _, err = io.ReadFull(conn, reply); err != nil {
+        return nil, err
+    }
+
+    if (reply[1] != socks.SOCKS_V5_STATUS_SUCCESS) {
+        return nil, &ReplyError{ Code : reply[1] }
+    }
+
+    // Skip BND.ADDR and BND.PORT
+    var length int
+    switch (reply[3]) {
+        case socks.SOCKS_V5_ATYP_IP4:
+            length = 4
+            break
+        case socks.SOCKS_V5_ATYP_IP6:
+            length = 16
+            break
+        case socks.SOCKS_V5_ATYP_FQDN:
+            var count []byte = make([]byte, 1)
+            if _, err = io.ReadFull(conn, count); err != nil {
+                return nil, err
+            }
+            length = int(count[0])
+            break
+        default:
+            return nil, errors.New("No supported address")
+    }
+
+    if _, err = io.ReadFull(conn, make([]byte, length + 2)); err != nil {
+        return nil, err
+    }
+
+    return conn, nil
+}
+
+// RFC 1929 subnegotiation
+func (proxy *Socks5Proxy) authenticate(conn net.Conn) (error) {
+
+    if ((len(proxy.username) > 255) || (len(proxy.password) > 255)) {
+        return errors.New("Username or password is too long")
+    }
+
+    var request []byte = []byte{ 0x01, byte(len(proxy.username)) }
+    request = append(request, proxy.username...)
+    request = append(request, byte(len(proxy.password)))
+    request = append(request, proxy.password...)
+
+    if _, err := conn.Write(request); err != nil {
+        return err
+    }
+
+    var reply []byte = make([]byte, 2)
+    if _, err := io.ReadFull(conn, reply); err != nil {
+        return err
+    }
+
+    if (reply[1] != 0x00) {
+        return errors.New("Authentication failed")
+    }
+
+    return nil
+}
+
+/*----------------------------------------------------------
+    Socks4aProxy Implementation
+-----------------------------------------------------------*/
+func (proxy *Socks4aProxy) Address() (string) {
+    return proxy.address
+}
+
+func (proxy *Socks4aProxy) Connect(conn net.Conn, address string) (net.Conn, error) {
+
+    host, port, err := splitAddress(address)
+    if (err != nil) {
+        return nil, err
+    }
+
+    var request []byte = []byte{ socks.SOCKS_VERSION_V4, socks.SOCKS_COMMAND_CONNECT, byte(port >> 8), byte(port & 0xFF) }
+
+    ip := net.ParseIP(host)
+    if ((ip != nil) && (ip.To4() == nil)) {
+        return nil, errors.New("Socks V4 doesn't support IPv6")
+    }
+
+    // Socks V4a, 0.0.0.1 and the domain name after USERID
+    if (ip == nil) {
+        request = append(request, 0, 0, 0, 1)
+    } else {
+        request = append(request, ip.To4()...)
+    }
+
+    request = append(request, proxy.userid...)
+    request = append(request, 0x00)
+
+    if (ip == nil) {
+        request = append(request, host...)
+        request = append(request, 0x00)
+    }
+
+    if _, err = conn.Write(request); err != nil {
+        return nil, err
+    }
+
+    var reply []byte = make([]byte, 8)
+    if _, err = io.ReadFull(conn, reply); err != nil {
+        return nil, err
+    }
+
+    if (reply[1] != socks.SOCKS_V4_STATUS_GRANTED) {
+        return nil, errors.New("Request rejected: " + strconv.Itoa(int(reply[1])))
+    }
+
+    return conn, nil
+}
+
+/*----------------------------------------------------------
+    HttpProxy Implementation
+-----------------------------------------------------------*/
+func (proxy *HttpProxy) Address() (string) {
+    return proxy.address
+}
+
+func (proxy *HttpProxy) Connect(conn net.Conn, address string) (net.Conn, error) {
+
+    var request string = fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", address, address)
+
+    if (len(proxy.username) != 0) {
+        credential := base64.StdEncoding.EncodeToString([]byte(proxy.username + ":" + proxy.password))
+        request += "Proxy-Authorization: Basic " + credential + "\r\n"
+    }
+
+    request += "\r\n"
+
+    if _, err := conn.Write([]byte(request)); err != nil {
+        return nil, err
+    }
+
+    var reader *bufio.Reader = bufio.NewReader(conn)
+
+    response, err := http.ReadResponse(reader, &http.Request{ Method : http.MethodConnect })
+    if (err != nil) {
+        return nil, err
+    }
+
+    response.Body.Close()
+
+    if ((response.StatusCode < 200) || (response.StatusCode > 299)) {
+        return nil, errors.New("CONNECT failed: " + response.Status)
+    }
+
+    // The target may already have sent some data
+    return &bufferedConn{ Conn : conn, reader : reader }, nil
+}
+
+func (conn *bufferedConn) Read(buffer []byte) (int, error) {
+    return conn.reader.Read(buffer)
+}
+
+/*----------------------------------------------------------
+    ReplyError
+-----------------------------------------------------------*/
+
+// A parent Socks V5 proxy refused the request with REP Code
+type ReplyError struct {
+    Code			byte
+}
+
+func (err *ReplyError) Error() (string) {
+    return "Request failed with reply: " + strconv.Itoa(int(err.Code))
+}
+
+// The parent's reply is passed on to the client
+func (err *ReplyError) ReplyCode() (byte) {
+    return err.Code
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+func splitAddress(address string) (string, int, error) {
+
+    host, portString, err := net.SplitHostPort(address)
+    if (err != nil) {
+        return "", 0, err
+    }
+
+    port, err := strconv.Atoi(portString)
+    if ((err != nil) || (port < 0) || (port > 65535)) {
+        return "", 0, errors.New("Malformed port: " + portString)
+    }
+
+    return host, port, nil
+}
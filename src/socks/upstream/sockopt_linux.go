@@ -0,0 +1,35 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package upstream
+
+import (
+        "syscall"
+)
+
+// Interface and mark can be set on this system
+const SOCKET_OPTIONS = true
+
+// SO_BINDTODEVICE needs CAP_NET_RAW, SO_MARK needs CAP_NET_ADMIN
+func setSocketOptions(fd uintptr, device string, mark int) (error) {
+
+    if (len(device) != 0) {
+        err := syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+        if (err != nil) {
+            return err
+        }
+    }
+
+    if (mark != 0) {
+        err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+        if (err != nil) {
+            return err
+        }
+    }
+
+    return nil
+}
@@ -0,0 +1,21 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+//go:build !linux
+
+package upstream
+
+import (
+        "errors"
+)
+
+// Interface and mark can't be set on this system
+const SOCKET_OPTIONS = false
+
+func setSocketOptions(fd uintptr, device string, mark int) (error) {
+    return errors.New("Interface and mark are only supported on Linux")
+}
@@ -0,0 +1,415 @@
+//---------------------------------------------------------
+// Author: Stanley Wang
+// Copyright 2018. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+//---------------------------------------------------------
+
+package upstream
+
+import (
+        "errors"
+        "net"
+        "strconv"
+        "sync"
+        "time"
+        "socks"
+        "socks/acl"
+        "socks/log"
+        "socks/config"
+        "socks/context"
+        "socks/resolver"
+)
+
+const (
+        PROXY_SOCKS5		= "socks5"
+        PROXY_SOCKS4A	= "socks4a"
+        PROXY_HTTP		= "http"
+)
+
+// Dialer opens a connection to address, either directly or through
+// parent proxies
+type Dialer interface {
+    Dial (network string, address string) (net.Conn, error)
+}
+
+// A parent proxy, connects to address over an established connection
+// to the proxy itself
+type Proxy interface {
+    Connect (conn net.Conn, address string) (net.Conn, error)
+    Address () (string)
+}
+
+// Connects to the target itself. A domain name is resolved with the
+// resolver when there is one, by the system otherwise. allow, when set,
+// tells whether an address the name resolved to may be connected to.
+type Direct struct {
+    resolver		*resolver.Resolver
+    allow		func(net.IP) (error)
+    egress		*Egress
+    preferV4		bool
+    attemptDelay	time.Duration
+    timeout		time.Duration
+    deadline		time.Time
+}
+
+// Proxies are used in order, each one reached through the previous one
+type Chain struct {
+    name			string
+    proxies		[]Proxy
+    direct		Dialer
+    deadline		time.Time
+}
+
+type route struct {
+    rule			*acl.Rule
+    chain		string
+}
+
+type Upstream struct {
+    chains		map[string]*Chain
+    routes		[]*route
+    fallback		string
+}
+
+// Compiled upstreams, keyed by their config
+var upstreams		map[*config.UpstreamConf]*Upstream = make(map[*config.UpstreamConf]*Upstream)
+var upstreamsLock	sync.Mutex
+
+/*----------------------------------------------------------
+    Create an Upstream
+-----------------------------------------------------------*/
+
+// Returns the compiled Upstream of the config. A config that doesn't
+// compile has no route, every connection fails.
+func Get(conf *config.UpstreamConf) (*Upstream) {
+
+    upstreamsLock.Lock()
+    defer upstreamsLock.Unlock()
+
+    upstream, found := upstreams[conf]
+    if (found) {
+        return upstream
+    }
+
+    upstream, err := New(conf)
+    if (err != nil) {
+        log.Errorf("Invalid upstream config, all connections fail: %s\n", err.Error())
+        upstream = nil
+    }
+
+    upstreams[conf] = upstream
+
+    return upstream
+}
+
+// Drop forgets the compiled upstream of conf, it is called once the last
+// session of a config replaced by a reload is over
+func Drop(conf *config.UpstreamConf) {
+
+    upstreamsLock.Lock()
+    defer upstreamsLock.Unlock()
+
+    delete(upstreams, conf)
+}
+
+func New(conf *config.UpstreamConf) (*Upstream, error) {
+
+    var upstream *Upstream = &Upstream{ chains : make(map[string]*Chain), fallback : conf.Default }
+
+    for name, proxies := range conf.Chains {
+        chain, err := NewChain(name, proxies)
+        if (err != nil) {
+            return nil, err
+        }
+        upstream.chains[name] = chain
+    }
+
+    if ((len(conf.Default) != 0) && (upstream.chains[conf.Default] == nil)) {
+        return nil, errors.New("Unknown default chain: '" + conf.Default + "'")
+    }
+
+    for index, routeConf := range conf.Routes {
+
+        if ((len(routeConf.Chain) != 0) && (upstream.chains[routeConf.Chain] == nil)) {
+            return nil, errors.New("Route " + strconv.Itoa(index + 1) + ": unknown chain '" + routeConf.Chain + "'")
+        }
+
+        // A route matches the same way as an ACL rule
+        rule, err := acl.NewRule(&config.AclRule{ Action		: acl.ACTION_ALLOW,
+                                                  Clients		: routeConf.Clients,
+                                                  Users		: routeConf.Users,
+                                                  Destinations	: routeConf.Destinations,
+                                                  Domains		: routeConf.Domains,
+                                                  Ports		: routeConf.Ports })
+        if (err != nil) {
+            return nil, errors.New("Route " + strconv.Itoa(index + 1) + ": " + err.Error())
+        }
+
+        upstream.routes = append(upstream.routes, &route{ rule : rule, chain : routeConf.Chain })
+    }
+
+    return upstream, nil
+}
+
+/*----------------------------------------------------------
+    Upstream Implementation
+-----------------------------------------------------------*/
+
+// Returns the Dialer for the request: the chain of the first matching
+// route, the default chain, or direct. direct also makes the connection
+// to the first proxy of a chain.
+func (upstream *Upstream) Dialer(request *acl.Request, direct *Direct) (Dialer) {
+
+    var name string = upstream.fallback
+
+    for _, route := range upstream.routes {
+        if (route.rule.Match(request)) {
+            name = route.chain
+            break
+        }
+    }
+
+    if (len(name) == 0) {
+        return direct
+    }
+
+    // The compiled chain is shared, use a copy
+    chain := *upstream.chains[name]
+    chain.direct = direct
+    chain.deadline = direct.deadline
+
+    return &chain
+}
+
+// Dial through the upstreams of the session's config, leaving from the
+// session's egress profile
+func Dial(contxt *context.Context, request *acl.Request, network string, address string) (net.Conn, error) {
+
+    var conf *config.Config = contxt.Config()
+
+    upstream := Get(&conf.Upstream)
+    if (upstream == nil) {
+        return nil, errors.New("Invalid upstream config")
+    }
+
+    var direct *Direct = NewDirect(resolver.Get(&conf.Resolver), &conf.Outbound)
+    direct.egress = GetOutbound(&conf.Outbound).Select(contxt)
+
+    // The whole dial, proxies included, has to finish in time
+    if timeout := conf.Timeouts.DialTimeout(); timeout != 0 {
+        direct.deadline = time.Now().Add(timeout)
+    }
+
+    var dialer Dialer = upstream.Dialer(request, direct)
+
+    // A name resolved here is checked again with its addresses, so that
+    // the rules on destination networks apply to it
+    if ((dialer == Dialer(direct)) && (request.Atyp == socks.SOCKS_V5_ATYP_FQDN)) {
+        direct.allow = allowResolved(contxt, request)
+    }
+
+    return dialer.Dial(network, address)
+}
+
+// The addresses host resolves to with the session's config, in the
+// order a direct connection tries them
+func Resolve(conf *config.Config, host string) ([]net.IP, error) {
+
+    ips, err := resolver.Get(&conf.Resolver).LookupIP("ip", host)
+    if (err != nil) {
+        return nil, err
+    }
+
+    return sortAddresses(ips, conf.Outbound.Prefer == "ipv4"), nil
+}
+
+/*----------------------------------------------------------
+    Direct Implementation
+-----------------------------------------------------------*/
+// A nil lookup leaves names to the system resolver
+func NewDirect(lookup *resolver.Resolver, conf *config.OutboundConf) (*Direct) {
+
+    var direct *Direct = &Direct{ resolver		: lookup,
+                                  preferV4		: conf.Prefer == "ipv4",
+                                  attemptDelay	: time.Duration(conf.AttemptDelay) * time.Millisecond,
+                                  timeout		: time.Duration(conf.Timeout) * time.Second }
+
+    if (direct.attemptDelay == 0) {
+        direct.attemptDelay = ATTEMPT_DELAY
+    }
+
+    /* RFC 8305
+       Connection Attempt Delays MUST NOT be less than 10 ms
+    */
+    if (direct.attemptDelay < MIN_ATTEMPT_DELAY) {
+        direct.attemptDelay = MIN_ATTEMPT_DELAY
+    }
+
+    return direct
+}
+
+func (direct *Direct) Dial(network string, address string) (net.Conn, error) {
+
+    ctx, cancel := direct.context()
+    defer cancel()
+
+    host, port, err := net.SplitHostPort(address)
+    if ((err != nil) || (direct.resolver == nil) || (net.ParseIP(host) != nil)) {
+        dialer, err := direct.egress.Dialer(net.ParseIP(host))
+        if (err != nil) {
+            return nil, err
+        }
+        return dialer.DialContext(ctx, network, address)
+    }
+
+    ips, err := direct.resolver.LookupIP(ipNetwork(network), host)
+    if (err != nil) {
+        return nil, err
+    }
+
+    ips, err = direct.filter(ips)
+    if (err != nil) {
+        return nil, err
+    }
+
+    return direct.race(ctx, network, sortAddresses(ips, direct.preferV4), port)
+}
+
+/*----------------------------------------------------------
+    Chain Implementation
+-----------------------------------------------------------*/
+func NewChain(name string, conf []config.ProxyConf) (*Chain, error) {
+
+    if (len(conf) == 0) {
+        return nil, errors.New("Chain '" + name + "' is empty")
+    }
+
+    var chain *Chain = &Chain{ name : name, direct : NewDirect(nil, &config.OutboundConf{}) }
+
+    for index := range conf {
+        proxy, err := NewProxy(&conf[index])
+        if (err != nil) {
+            return nil, errors.New("Chain '" + name + "': " + err.Error())
+        }
+        chain.proxies = append(chain.proxies, proxy)
+    }
+
+    return chain, nil
+}
+
+func (chain *Chain) Dial(network string, address string) (net.Conn, error) {
+
+    // The first proxy is reached directly
+    conn, err := chain.direct.Dial("tcp", chain.proxies[0].Address())
+    if (err != nil) {
+        return nil, err
+    }
+
+    // The proxies' negotiations are bound by the dial deadline
+    if (!chain.deadline.IsZero()) {
+        conn.SetDeadline(chain.deadline)
+        defer conn.SetDeadline(time.Time{})
+    }
+
+    // Each proxy connects to the next one, the last one to the target
+    for index, proxy := range chain.proxies {
+
+        var next string = address
+        if (index + 1 < len(chain.proxies)) {
+            next = chain.proxies[index + 1].Address()
+        }
+
+        proxied, err := proxy.Connect(conn, next)
+        if (err != nil) {
+            conn.Close()
+            log.Errorf("Upstream %s failed to connect to %s: %s\n", proxy.Address(), next, err.Error())
+            return nil, err
+        }
+
+        conn = proxied
+    }
+
+    log.Infof("Connected to %s through chain '%s'\n", address, chain.name)
+
+    return conn, nil
+}
+
+func NewProxy(conf *config.ProxyConf) (Proxy, error) {
+
+    if _, _, err := net.SplitHostPort(conf.Address); err != nil {
+        return nil, errors.New("Malformed proxy address: '" + conf.Address + "'")
+    }
+
+    switch (conf.Type) {
+        case PROXY_SOCKS5:
+            return &Socks5Proxy{ address : conf.Address, username : conf.Username, password : conf.Password }, nil
+        case PROXY_SOCKS4A:
+            return &Socks4aProxy{ address : conf.Address, userid : conf.Username }, nil
+        case PROXY_HTTP:
+            return &HttpProxy{ address : conf.Address, username : conf.Username, password : conf.Password }, nil
+    }
+
+    return nil, errors.New("Unknown proxy type: '" + conf.Type + "'")
+}
+
+/*----------------------------------------------------------
+    private methods
+-----------------------------------------------------------*/
+
+// The resolver network matching a dial network
+func ipNetwork(network string) (string) {
+
+    switch (network) {
+        case "tcp4", "udp4":
+            return "ip4"
+        case "tcp6", "udp6":
+            return "ip6"
+    }
+
+    return "ip"
+}
+
+// The ACL check of the addresses a name of request resolved to
+func allowResolved(contxt *context.Context, request *acl.Request) (func(net.IP) (error)) {
+
+    var rules *acl.Acl = acl.Get(contxt.Config().AclProfile(contxt.Listener().Acl))
+
+    return func(ip net.IP) (error) {
+        allowed, rule := rules.EvaluateResolved(request, ip)
+        if (allowed) {
+            return nil
+        }
+        var name string
+        if (rule != nil) {
+            name = rule.Name
+        }
+        return &acl.DeniedError{ Rule : name }
+    }
+}
+
+// The addresses that may be connected to, an error when none may
+func (direct *Direct) filter(ips []net.IP) ([]net.IP, error) {
+
+    if (direct.allow == nil) {
+        return ips, nil
+    }
+
+    var allowed []net.IP
+    var err error
+
+    for _, ip := range ips {
+        if denied := direct.allow(ip); denied != nil {
+            log.Infof("Resolved address %s denied: %s\n", ip.String(), denied.Error())
+            err = denied
+            continue
+        }
+        allowed = append(allowed, ip)
+    }
+
+    if (len(allowed) == 0) {
+        return nil, err
+    }
+
+    return allowed, nil
+}